@@ -0,0 +1,60 @@
+package donut
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBatchConcurrency is the number of questions of a batch looked up at
+// the same time, unless set otherwise with WithBatchConcurrency.
+const DefaultBatchConcurrency = 16
+
+// BatchResult is the outcome of looking up one question of a batch.
+type BatchResult struct {
+	Question Question
+	Records  []Record
+	Err      error
+}
+
+// LookupBatch looks up each question as Lookup does, several at a time, and
+// returns the results in the order of the questions. A question that fails
+// does not stop the others from being looked up, and its error is given in
+// its result.
+//
+// Each question is sent in a query of its own, since servers do not answer
+// queries with more than one, but they share the connections and cache of the
+// resolver.
+func (r *Resolver) LookupBatch(ctx context.Context, questions []Question) []BatchResult {
+	results := make([]BatchResult, len(questions))
+
+	workers := r.batchConcurrency
+	if workers <= 0 {
+		workers = DefaultBatchConcurrency
+	}
+	workers = min(workers, len(questions))
+
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(workers)
+
+	for range workers {
+		go func() {
+			defer wg.Done()
+
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= len(questions) {
+					return
+				}
+
+				q := questions[i]
+				records, err := r.LookupContext(ctx, q)
+				results[i] = BatchResult{Question: q, Records: records, Err: err}
+			}
+		}()
+	}
+
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,96 @@
+package donut_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tomasbasham/donut"
+)
+
+func TestResolver_LookupBatch(t *testing.T) {
+	errUpstream := errors.New("upstream failed")
+
+	// A concurrency of zero leaves the default of the resolver.
+	tests := map[string]struct {
+		names       int
+		concurrency int
+	}{
+		"empty":               {},
+		"default concurrency": {names: 50},
+		"bounded":             {names: 20, concurrency: 3},
+		"one at a time":       {names: 5, concurrency: 1},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var inFlight, peak atomic.Int32
+
+			// Later names are answered sooner, so that the results arrive out
+			// of order, and every third name fails.
+			transport := transportFunc(func(ctx context.Context, query []byte) ([]byte, error) {
+				n := inFlight.Add(1)
+				defer inFlight.Add(-1)
+				for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+				}
+
+				msg, err := donut.ParseMessage(query)
+				if err != nil {
+					return nil, err
+				}
+
+				var i int
+				fmt.Sscanf(msg.Questions[0].FQDN, "host%d.", &i)
+				time.Sleep(time.Duration(tt.names-i) * 100 * time.Microsecond)
+
+				if i%3 == 0 {
+					return nil, errUpstream
+				}
+				return answerA(query, net.IPv4(192, 0, 2, byte(i)), 300), nil
+			})
+
+			var questions []donut.Question
+			for i := range tt.names {
+				questions = append(questions, donut.Question{FQDN: fmt.Sprintf("host%d.example.", i), Type: donut.A, Class: donut.IN})
+			}
+
+			r := donut.New("", donut.WithTransport(transport), donut.WithBatchConcurrency(tt.concurrency))
+
+			results := r.LookupBatch(context.Background(), questions)
+			if len(results) != len(questions) {
+				t.Fatalf("expected %d results, got %d", len(questions), len(results))
+			}
+
+			for i, res := range results {
+				if res.Question != questions[i] {
+					t.Errorf("result %d: expected question %s, got %s", i, questions[i].FQDN, res.Question.FQDN)
+				}
+				if i%3 == 0 {
+					if !errors.Is(res.Err, errUpstream) {
+						t.Errorf("result %d: expected the upstream error, got %v", i, res.Err)
+					}
+					continue
+				}
+				if res.Err != nil {
+					t.Errorf("result %d: %v", i, res.Err)
+					continue
+				}
+				if len(res.Records) != 1 || !strings.HasSuffix(net.IP(res.Records[0].Data.([]byte)).String(), fmt.Sprintf(".%d", i)) {
+					t.Errorf("result %d: unexpected records %v", i, res.Records)
+				}
+			}
+
+			limit := tt.concurrency
+			if limit == 0 {
+				limit = donut.DefaultBatchConcurrency
+			}
+			if p := peak.Load(); int(p) > limit {
+				t.Errorf("expected at most %d lookups at once, got %d", limit, p)
+			}
+		})
+	}
+}
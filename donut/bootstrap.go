@@ -0,0 +1,200 @@
+package donut
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minBootstrapTTL is the shortest time the addresses of an upstream host are
+// remembered for, so that a host with a very low TTL does not send a bootstrap
+// query before every new connection.
+const minBootstrapTTL = time.Minute
+
+// bootstrap resolves the hosts of upstream servers without going through the
+// system resolver, which may well be the very proxy that needs them. Hosts
+// are resolved from static addresses where given, and otherwise by sending
+// plain DNS queries to the bootstrap servers.
+type bootstrap struct {
+	static  map[string][]string
+	servers []Transport
+	dialer  *net.Dialer
+	now     func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]bootstrapEntry
+}
+
+type bootstrapEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// newBootstrap returns the bootstrap configured for the resolver, or nil if
+// hosts are resolved by the system.
+func (r *Resolver) newBootstrap() (*bootstrap, error) {
+	if len(r.bootstrapAddrs) == 0 && len(r.bootstrapServers) == 0 {
+		return nil, nil
+	}
+
+	b := &bootstrap{
+		static: r.bootstrapAddrs,
+		dialer: &net.Dialer{KeepAlive: httpKeepAlive},
+		now:    time.Now,
+		cache:  make(map[string]bootstrapEntry),
+	}
+
+	for _, server := range r.bootstrapServers {
+		if !strings.Contains(server, "://") {
+			server = "udp://" + server
+		}
+
+		e, err := parseServer(server)
+		if err != nil {
+			return nil, fmt.Errorf("bootstrap server: %w", err)
+		}
+
+		// The bootstrap servers are dialled directly, since resolving their
+		// hosts through the bootstrap would never end.
+		switch e.scheme {
+		case "udp":
+			b.servers = append(b.servers, newUDPTransport(e, b.dialer.DialContext))
+		case "tcp":
+			b.servers = append(b.servers, newTCPTransport(e, b.dialer.DialContext))
+		default:
+			return nil, fmt.Errorf("bootstrap server %q must use plain DNS over udp or tcp", server)
+		}
+	}
+
+	return b, nil
+}
+
+// dialContext connects to the address, resolving its host with the bootstrap
+// if one is configured.
+func (r *Resolver) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if r.bootstrap == nil {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return r.bootstrap.dialContext(ctx, network, addr)
+}
+
+func (b *bootstrap) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if net.ParseIP(host) != nil {
+		return b.dialer.DialContext(ctx, network, addr)
+	}
+
+	addrs, err := b.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	// Try every address in turn, as the system resolver would.
+	var errs []error
+	for _, ip := range addrs {
+		conn, err := b.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		errs = append(errs, err)
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// lookup returns the addresses of the host, from the static addresses if it
+// has any and from the bootstrap servers otherwise.
+func (b *bootstrap) lookup(ctx context.Context, host string) ([]string, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if addrs, ok := b.static[host]; ok {
+		return addrs, nil
+	}
+
+	if len(b.servers) == 0 {
+		return nil, &net.DNSError{Err: "no bootstrap addresses or servers configured", Name: host, IsNotFound: true}
+	}
+
+	b.mu.Lock()
+	entry, ok := b.cache[host]
+	b.mu.Unlock()
+
+	if ok && b.now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	var errs []error
+	for _, server := range b.servers {
+		addrs, ttl, err := b.query(ctx, server, host)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		b.mu.Lock()
+		b.cache[host] = bootstrapEntry{addrs: addrs, expires: b.now().Add(max(ttl, minBootstrapTTL))}
+		b.mu.Unlock()
+
+		return addrs, nil
+	}
+
+	return nil, fmt.Errorf("bootstrap lookup of %s: %w", host, errors.Join(errs...))
+}
+
+// query asks a bootstrap server for the IPv4 and IPv6 addresses of the host,
+// returning them along with the lowest TTL of their records. IPv4 addresses
+// come first.
+func (b *bootstrap) query(ctx context.Context, server Transport, host string) ([]string, time.Duration, error) {
+	var addrs []string
+	var ttl uint32 = 0xFFFFFFFF
+
+	for _, t := range []RecordType{A, AAAA} {
+		resp, err := server.Exchange(ctx, encodeMessage([]Question{{FQDN: host, Type: t, Class: IN}}))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		m := message{resp}
+		msg, err := m.unpack()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// Any CNAME records leading to the addresses are skipped, since a
+		// recursive server answers with the whole chain.
+		for _, rr := range msg.Answers {
+			if rr.Type != t {
+				continue
+			}
+			addrs = append(addrs, net.IP(rr.Data.([]byte)).String())
+			ttl = min(ttl, rr.TTL)
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	return addrs, time.Duration(ttl) * time.Second, nil
+}
+
+// Close closes any connections to the bootstrap servers.
+func (b *bootstrap) Close() error {
+	var errs []error
+	for _, server := range b.servers {
+		errs = append(errs, closeTransport(server))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,191 @@
+package donut_test
+
+import (
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tomasbasham/donut"
+)
+
+// bootstrapServer is a plain DNS server answering every A query with ip, and
+// every other query with no records.
+type bootstrapServer struct {
+	addr    string
+	queries atomic.Int32
+}
+
+func newBootstrapServer(t *testing.T, ip net.IP) *bootstrapServer {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	s := &bootstrapServer{addr: conn.LocalAddr().String()}
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			s.queries.Add(1)
+
+			query := append([]byte(nil), buf[:n]...)
+
+			// The question type follows the name, which ends with a zero
+			// length label.
+			resp := answerA(query, ip, 300)
+			if ip == nil || query[len(query)-3] != byte(donut.A) {
+				resp = append([]byte(nil), query...)
+				resp[2] |= 0x80
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+
+	return s
+}
+
+func TestResolver_LookupBootstrap(t *testing.T) {
+	tests := map[string]struct {
+		resolver func(server string, config *tls.Config, bootstrap string) *donut.Resolver
+		ip       net.IP
+		queries  int32
+		err      bool
+	}{
+		"static": {
+			resolver: func(server string, config *tls.Config, bootstrap string) *donut.Resolver {
+				return donut.New(server, donut.WithTLSConfig(config),
+					donut.WithBootstrap(map[string][]string{"dns.example": {"127.0.0.1"}}))
+			},
+		},
+		"static before server": {
+			resolver: func(server string, config *tls.Config, bootstrap string) *donut.Resolver {
+				return donut.New(server, donut.WithTLSConfig(config),
+					donut.WithBootstrap(map[string][]string{"DNS.example.": {"127.0.0.1"}}),
+					donut.WithBootstrapServers(bootstrap))
+			},
+			ip: net.IPv4(192, 0, 2, 1),
+		},
+		"server": {
+			resolver: func(server string, config *tls.Config, bootstrap string) *donut.Resolver {
+				return donut.New(server, donut.WithTLSConfig(config),
+					donut.WithBootstrapServers("udp://"+bootstrap))
+			},
+			ip:      net.IPv4(127, 0, 0, 1),
+			queries: 2,
+		},
+		"server without answer": {
+			resolver: func(server string, config *tls.Config, bootstrap string) *donut.Resolver {
+				return donut.New(server, donut.WithTLSConfig(config),
+					donut.WithBootstrapServers(bootstrap))
+			},
+			queries: 2,
+			err:     true,
+		},
+		"unsupported server": {
+			resolver: func(server string, config *tls.Config, bootstrap string) *donut.Resolver {
+				return donut.New(server, donut.WithTLSConfig(config),
+					donut.WithBootstrapServers("https://"+bootstrap))
+			},
+			err: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			s, config := newTLSServer(t, 1)
+			_, port, _ := net.SplitHostPort(s.addr)
+
+			bootstrap := newBootstrapServer(t, tt.ip)
+
+			r := tt.resolver("tls://dns.example:"+port, config, bootstrap.addr)
+			defer r.Close()
+
+			// Look up twice over separate connections, which should only
+			// resolve the host once.
+			for i := 0; i < 2; i++ {
+				_, err := r.Lookup(donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN})
+				if tt.err {
+					if err == nil {
+						t.Fatal("expected an error")
+					}
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.Close()
+			}
+
+			if got := bootstrap.queries.Load(); got != tt.queries {
+				t.Errorf("expected %d bootstrap queries, got %d", tt.queries, got)
+			}
+			if got := s.conns.Load(); !tt.err && got != 2 {
+				t.Errorf("expected 2 connections, got %d", got)
+			}
+		})
+	}
+}
+
+func TestResolver_LookupBootstrapHTTPS(t *testing.T) {
+	s := newH2Server(t)
+	_, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+
+	// The certificate of httptest servers is valid for example.com, which is
+	// never resolved by the system.
+	r := donut.New("https://example.com:"+port+"/dns-query",
+		donut.WithTLSConfig(s.config),
+		donut.WithBootstrap(map[string][]string{"example.com": {"127.0.0.1"}}))
+	defer r.Close()
+
+	if _, err := r.Lookup(donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolver_LookupBootstrapQUIC(t *testing.T) {
+	s, config := newQUICServer(t)
+	_, port, _ := net.SplitHostPort(s.addr)
+
+	bootstrap := newBootstrapServer(t, net.IPv4(127, 0, 0, 1))
+
+	r := donut.New("quic://dns.example:"+port, donut.WithTLSConfig(config),
+		donut.WithBootstrapServers("udp://"+bootstrap.addr))
+	defer r.Close()
+
+	if _, err := r.Lookup(donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := bootstrap.queries.Load(); got != 2 {
+		t.Errorf("expected 2 bootstrap queries, got %d", got)
+	}
+}
+
+func TestResolver_LookupBootstrapPlain(t *testing.T) {
+	for _, scheme := range []string{"udp", "tcp"} {
+		t.Run(scheme, func(t *testing.T) {
+			s := newPlainServer(t)
+			_, port, _ := net.SplitHostPort(s.addr)
+
+			bootstrap := newBootstrapServer(t, net.IPv4(127, 0, 0, 1))
+
+			r := donut.New(scheme+"://dns.example:"+port, donut.WithBootstrapServers("udp://"+bootstrap.addr))
+			defer r.Close()
+
+			if _, err := r.Lookup(donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN}); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := bootstrap.queries.Load(); got != 2 {
+				t.Errorf("expected 2 bootstrap queries, got %d", got)
+			}
+		})
+	}
+}
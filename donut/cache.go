@@ -0,0 +1,355 @@
+package donut
+
+import (
+	"container/list"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMaxNegativeTTL is the longest a negative response is cached for by
+// default, following the recommendation in
+// https://datatracker.ietf.org/doc/html/rfc2308#section-5
+const defaultMaxNegativeTTL = 3 * time.Hour
+
+// staleTTL is the TTL given to the records of a stale response, as recommended
+// in https://datatracker.ietf.org/doc/html/rfc8767#section-4
+const staleTTL = 30
+
+// prefetchFraction is the fraction of its original TTL that an entry must have
+// left before it is refreshed in the background.
+const prefetchFraction = 10
+
+// Cache is an in-memory cache of DNS responses that is safe for concurrent use
+// by multiple resolvers. Responses are kept for as long as the TTL of their
+// records allows, and the least recently used response is evicted once the
+// cache is full.
+//
+// Negative responses, saying that a name does not exist or has no records of
+// the requested type, are cached as described in
+// https://datatracker.ietf.org/doc/html/rfc2308
+//
+// The cache may also serve expired responses when the upstream server fails,
+// as described in https://datatracker.ietf.org/doc/html/rfc8767, and refresh
+// popular responses before they expire.
+type Cache struct {
+	capacity       int
+	maxTTL         time.Duration
+	maxNegativeTTL time.Duration
+	serveStale     time.Duration
+	staleTimeout   time.Duration
+	prefetchHits   int
+	now            func() time.Time
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+}
+
+// cacheKey identifies the responses that may be used to answer a query. The
+// DO and CD bits are part of the key since they change what the server
+// includes in its response.
+type cacheKey struct {
+	name  string
+	qtype RecordType
+	class RecordClass
+	do    bool
+	cd    bool
+}
+
+type cacheEntry struct {
+	key cacheKey
+
+	// msg is the response as received, with the TTLs it had when stored.
+	msg []byte
+
+	// ttls are the offsets of the TTL fields in msg that are rewritten when the
+	// response is served from the cache.
+	ttls []int
+
+	stored  time.Time
+	expires time.Time
+
+	// hits is the number of times the entry has been served, used to decide
+	// whether it is popular enough to prefetch.
+	hits        int
+	prefetching bool
+}
+
+// cacheStatus describes the response returned from the cache.
+type cacheStatus int
+
+const (
+	// cacheMiss means there is no usable response in the cache.
+	cacheMiss cacheStatus = iota
+
+	// cacheHit means the response is fresh.
+	cacheHit
+
+	// cachePrefetch means the response is fresh but close to expiry, and the
+	// caller should refresh it in the background.
+	cachePrefetch
+
+	// cacheStale means the response has expired, and should only be used if
+	// the upstream server fails to answer.
+	cacheStale
+)
+
+type cacheOption func(c *Cache)
+
+// WithCacheMaxTTL limits how long a response is cached for, regardless of the
+// TTL of its records. A limit of 0 means that responses are cached for as long
+// as their TTLs allow.
+func WithCacheMaxTTL(d time.Duration) cacheOption {
+	return func(c *Cache) {
+		c.maxTTL = d
+	}
+}
+
+// WithCacheMaxNegativeTTL limits how long a negative response is cached for.
+// The limit defaults to 3 hours, and a limit of 0 disables negative caching.
+func WithCacheMaxNegativeTTL(d time.Duration) cacheOption {
+	return func(c *Cache) {
+		c.maxNegativeTTL = d
+	}
+}
+
+// WithCacheServeStale keeps responses for up to window after they expire, so
+// that they can be served when the upstream server fails or times out. A
+// window of 0, the default, disables serving stale responses.
+func WithCacheServeStale(window time.Duration) cacheOption {
+	return func(c *Cache) {
+		c.serveStale = window
+	}
+}
+
+// WithCacheStaleAnswerTimeout sets how long to wait for the upstream server
+// before answering with a stale response, if there is one. The lookup carries
+// on in the background to refresh the cache. A timeout of 0, the default,
+// waits until the upstream server fails or the context is done.
+func WithCacheStaleAnswerTimeout(d time.Duration) cacheOption {
+	return func(c *Cache) {
+		c.staleTimeout = d
+	}
+}
+
+// WithCachePrefetch refreshes a response in the background once it has been
+// served at least hits times and is within the last tenth of its TTL, so that
+// popular names are never looked up while a client waits. A value of 0, the
+// default, disables prefetching.
+func WithCachePrefetch(hits int) cacheOption {
+	return func(c *Cache) {
+		c.prefetchHits = hits
+	}
+}
+
+// NewCache creates a cache holding up to capacity responses.
+func NewCache(capacity int, opts ...cacheOption) *Cache {
+	c := &Cache{
+		capacity:       capacity,
+		maxNegativeTTL: defaultMaxNegativeTTL,
+		now:            time.Now,
+		entries:        make(map[cacheKey]*list.Element),
+		lru:            list.New(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Len returns the number of responses in the cache.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// newCacheKey returns the key for a query, reporting false for queries whose
+// responses should not be cached.
+func newCacheKey(query []byte) (cacheKey, bool) {
+	q, err := ParseMessage(query)
+	if err != nil || q.Response || q.Opcode != 0 || len(q.Questions) != 1 {
+		return cacheKey{}, false
+	}
+
+	return cacheKey{
+		name:  strings.ToLower(q.Questions[0].FQDN),
+		qtype: q.Questions[0].Type,
+		class: q.Questions[0].Class,
+		do:    dnssecOK(q.Additional),
+		cd:    q.CheckingDisabled,
+	}, true
+}
+
+// get returns a copy of the cached response for key, with the given ID and
+// the TTLs reduced by the time spent in the cache.
+func (c *Cache) get(key cacheKey, id uint16) ([]byte, cacheStatus) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, cacheMiss
+	}
+
+	entry := el.Value.(*cacheEntry)
+
+	now := c.now()
+	if !now.Before(entry.expires) {
+		if now.Before(entry.expires.Add(c.serveStale)) {
+			return entry.stale(id), cacheStale
+		}
+		c.remove(el)
+		return nil, cacheMiss
+	}
+
+	c.lru.MoveToFront(el)
+	entry.hits++
+
+	status := cacheHit
+
+	// Only one refresh is started for an entry. Should it fail, the entry
+	// expires as usual.
+	if c.prefetchHits > 0 && entry.hits >= c.prefetchHits && !entry.prefetching &&
+		entry.expires.Sub(now) <= entry.expires.Sub(entry.stored)/prefetchFraction {
+		entry.prefetching = true
+		status = cachePrefetch
+	}
+
+	return entry.response(id, now), status
+}
+
+// set stores the response to the query with the given key, if it may be
+// cached.
+func (c *Cache) set(key cacheKey, resp []byte) {
+	ttl, ttls, ok := c.ttl(resp)
+	if !ok {
+		return
+	}
+
+	// No record may be served with a TTL outliving the entry itself, which
+	// matters for negative responses and those limited by maxTTL.
+	msg := append([]byte(nil), resp...)
+	for _, offset := range ttls {
+		if binary.BigEndian.Uint32(msg[offset:]) > ttl {
+			binary.BigEndian.PutUint32(msg[offset:], ttl)
+		}
+	}
+
+	now := c.now()
+	entry := &cacheEntry{
+		key:     key,
+		msg:     msg,
+		ttls:    ttls,
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.add(entry)
+}
+
+// add stores the entry as the most recently used, replacing any entry with the
+// same key and evicting the least recently used entries if the cache is full.
+func (c *Cache) add(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[entry.key]; ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[entry.key] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *Cache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
+
+// response returns a copy of the cached response with the TTL of every record
+// reduced by the time elapsed since it was stored.
+func (e *cacheEntry) response(id uint16, now time.Time) []byte {
+	msg := append([]byte(nil), e.msg...)
+	binary.BigEndian.PutUint16(msg, id)
+
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	for _, offset := range e.ttls {
+		ttl := binary.BigEndian.Uint32(msg[offset:])
+		if ttl > elapsed {
+			ttl -= elapsed
+		} else {
+			ttl = 0
+		}
+		binary.BigEndian.PutUint32(msg[offset:], ttl)
+	}
+
+	return msg
+}
+
+// stale returns a copy of the expired response with every TTL set to
+// staleTTL.
+func (e *cacheEntry) stale(id uint16) []byte {
+	msg := append([]byte(nil), e.msg...)
+	binary.BigEndian.PutUint16(msg, id)
+
+	for _, offset := range e.ttls {
+		binary.BigEndian.PutUint32(msg[offset:], staleTTL)
+	}
+
+	return msg
+}
+
+// ttl returns how long a response may be cached for in seconds, along with
+// the offsets of the TTLs of its records. Successful responses with answers
+// are cached for the lowest TTL of their records, and negative responses for
+// the TTL given by their SOA record. Any other response is not cached.
+func (c *Cache) ttl(resp []byte) (uint32, []int, bool) {
+	m := message{resp}
+	msg, err := m.unpack()
+	if err != nil || msg.Truncated {
+		return 0, nil, false
+	}
+
+	offsets, err := m.ttlOffsets()
+	if err != nil || len(offsets) == 0 {
+		return 0, nil, false
+	}
+
+	var ttl uint32
+	var limit time.Duration
+
+	switch {
+	case msg.NXDomain() || msg.NoData():
+		var ok bool
+		if ttl, ok = msg.NegativeTTL(); !ok || c.maxNegativeTTL == 0 {
+			return 0, nil, false
+		}
+		limit = c.maxNegativeTTL
+	case msg.RCode == NoError && len(msg.Answers) > 0:
+		ttl = binary.BigEndian.Uint32(resp[offsets[0]:])
+		for _, offset := range offsets[1:] {
+			ttl = min(ttl, binary.BigEndian.Uint32(resp[offset:]))
+		}
+		limit = c.maxTTL
+	default:
+		return 0, nil, false
+	}
+
+	if limit > 0 {
+		ttl = min(ttl, uint32(limit/time.Second))
+	}
+
+	if ttl == 0 {
+		return 0, nil, false
+	}
+
+	return ttl, offsets, true
+}
@@ -0,0 +1,483 @@
+package donut_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tomasbasham/donut"
+)
+
+// fakeTransport answers every query with an A record, counting the queries it
+// receives.
+type fakeTransport struct {
+	calls atomic.Int32
+	ttl   uint32
+}
+
+func (f *fakeTransport) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	f.calls.Add(1)
+	return answerA(query, net.IPv4(192, 0, 2, 1), f.ttl), nil
+}
+
+// clock is a manually advanced clock for the cache.
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newClock(c *donut.Cache) *clock {
+	cl := &clock{now: time.Now()}
+	donut.SetCacheClock(c, cl.Now)
+	return cl
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// withFlags returns a copy of query with the CD bit set and, if do is true,
+// an OPT record with the DO bit set.
+func withFlags(query []byte, cd, do bool) []byte {
+	q := append([]byte(nil), query...)
+	if cd {
+		q[3] |= 0x10
+	}
+	if do {
+		binary.BigEndian.PutUint16(q[10:12], 1)
+		q = append(q, 0x00, 0x00, 0x29, 0x10, 0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 0x00)
+	}
+	return q
+}
+
+func TestResolver_LookupCached(t *testing.T) {
+	transport := &fakeTransport{ttl: 300}
+	cache := donut.NewCache(10)
+	clock := newClock(cache)
+
+	r := donut.New(donut.GoogleHost, donut.WithTransport(transport), donut.WithCache(cache))
+
+	// The steps depend on one another so they run in order.
+	tests := []struct {
+		name    string
+		query   []byte
+		advance time.Duration
+		calls   int32
+		ttl     uint32
+	}{
+		{name: "miss", query: newQuery(1, "example.com"), calls: 1, ttl: 300},
+		{name: "hit", query: newQuery(2, "example.com"), advance: 100 * time.Second, calls: 1, ttl: 200},
+		{name: "case insensitive", query: newQuery(3, "EXAMPLE.com"), calls: 1, ttl: 200},
+		{name: "checking disabled", query: withFlags(newQuery(4, "example.com"), true, false), calls: 2, ttl: 300},
+		{name: "dnssec ok", query: withFlags(newQuery(5, "example.com"), false, true), calls: 3, ttl: 300},
+		{name: "expired", query: newQuery(6, "example.com"), advance: 200 * time.Second, calls: 4, ttl: 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock.Advance(tt.advance)
+
+			resp, err := r.LookupRaw(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := transport.calls.Load(); got != tt.calls {
+				t.Errorf("expected %d upstream queries, got %d", tt.calls, got)
+			}
+
+			msg, err := donut.ParseMessage(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.ID != binary.BigEndian.Uint16(tt.query) {
+				t.Errorf("expected ID %d, got %d", binary.BigEndian.Uint16(tt.query), msg.ID)
+			}
+			if len(msg.Answers) != 1 || msg.Answers[0].TTL != tt.ttl {
+				t.Errorf("expected TTL %d, got %+v", tt.ttl, msg.Answers)
+			}
+		})
+	}
+}
+
+func TestCache_Eviction(t *testing.T) {
+	transport := &fakeTransport{ttl: 300}
+	cache := donut.NewCache(2)
+
+	r := donut.New(donut.GoogleHost, donut.WithTransport(transport), donut.WithCache(cache))
+
+	lookup := func(name string) {
+		t.Helper()
+		if _, err := r.LookupRaw(newQuery(1, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lookup("a.example")
+	lookup("b.example")
+	lookup("a.example") // a is now the most recently used
+	lookup("c.example") // evicts b
+
+	if got := cache.Len(); got != 2 {
+		t.Errorf("expected 2 cached responses, got %d", got)
+	}
+
+	calls := transport.calls.Load()
+	lookup("a.example")
+	if got := transport.calls.Load(); got != calls {
+		t.Error("expected a.example to still be cached")
+	}
+
+	lookup("b.example")
+	if got := transport.calls.Load(); got != calls+1 {
+		t.Error("expected b.example to have been evicted")
+	}
+}
+
+func TestCache_Uncacheable(t *testing.T) {
+	transport := &fakeTransport{ttl: 0}
+	cache := donut.NewCache(10)
+
+	r := donut.New(donut.GoogleHost, donut.WithTransport(transport), donut.WithCache(cache))
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.LookupRaw(newQuery(1, "example.com")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := transport.calls.Load(); got != 2 {
+		t.Errorf("expected responses with a TTL of 0 not to be cached, got %d upstream queries", got)
+	}
+}
+
+func TestCache_Concurrent(t *testing.T) {
+	transport := &fakeTransport{ttl: 300}
+	cache := donut.NewCache(4)
+
+	r := donut.New(donut.GoogleHost, donut.WithTransport(transport), donut.WithCache(cache))
+
+	names := []string{"a.example", "b.example", "c.example", "d.example", "e.example"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := r.LookupRaw(newQuery(uint16(i), names[i%len(names)])); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := cache.Len(); got > 4 {
+		t.Errorf("expected at most 4 cached responses, got %d", got)
+	}
+}
+
+// negativeTransport answers every query with NXDOMAIN, with an SOA record in
+// the authority section whose TTL is 300 seconds and MINIMUM is 60 seconds.
+type negativeTransport struct {
+	calls atomic.Int32
+}
+
+func (n *negativeTransport) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	n.calls.Add(1)
+
+	msg, err := donut.ParseMessage(query)
+	if err != nil {
+		return nil, err
+	}
+
+	msg.Response = true
+	msg.RCode = donut.NXDomain
+	msg.Additional = nil
+	msg.Authority = []donut.Record{{
+		Name:  "example.com.",
+		Type:  donut.SOA,
+		Class: donut.IN,
+		TTL:   300,
+		Data: []byte("\x02ns\x07example\x03com\x00\x05admin\x07example\x03com\x00" +
+			"\x00\x00\x00\x01\x00\x00\x1c\x20\x00\x00\x0e\x10\x00\x12\x75\x00\x00\x00\x00\x3c"),
+	}}
+
+	return msg.Pack()
+}
+
+func TestCache_Negative(t *testing.T) {
+	tests := map[string]struct {
+		cache *donut.Cache
+		ttl   uint32
+		calls int32
+	}{
+		"soa minimum": {
+			cache: donut.NewCache(10),
+			ttl:   60,
+			calls: 2,
+		},
+		"capped": {
+			cache: donut.NewCache(10, donut.WithCacheMaxNegativeTTL(30*time.Second)),
+			ttl:   30,
+			calls: 3,
+		},
+		"disabled": {
+			cache: donut.NewCache(10, donut.WithCacheMaxNegativeTTL(0)),
+			calls: 4,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			transport := &negativeTransport{}
+			clock := newClock(tt.cache)
+
+			r := donut.New(donut.GoogleHost, donut.WithTransport(transport), donut.WithCache(tt.cache))
+
+			q := donut.Question{FQDN: "missing.example.com", Type: donut.A, Class: donut.IN}
+
+			msg, err := r.LookupMessage(context.Background(), q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !msg.NXDomain() {
+				t.Fatalf("expected NXDOMAIN, got %+v", msg)
+			}
+
+			// Lookups are made at 0, 20, 40 and 70 seconds.
+			for _, advance := range []time.Duration{20, 20, 30} {
+				clock.Advance(advance * time.Second)
+				if msg, err = r.LookupMessage(context.Background(), q); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := transport.calls.Load(); got != tt.calls {
+				t.Errorf("expected %d upstream queries, got %d", tt.calls, got)
+			}
+
+			if tt.ttl > 0 {
+				if _, err = r.LookupMessage(context.Background(), q); err != nil {
+					t.Fatal(err)
+				}
+				clock.Advance(10 * time.Second)
+				if msg, err = r.LookupMessage(context.Background(), q); err != nil {
+					t.Fatal(err)
+				}
+				if len(msg.Authority) != 1 || msg.Authority[0].TTL != tt.ttl-10 {
+					t.Errorf("expected SOA TTL %d, got %+v", tt.ttl-10, msg.Authority)
+				}
+			}
+		})
+	}
+}
+
+// transportFunc is a transport answering queries with a function.
+type transportFunc func(ctx context.Context, query []byte) ([]byte, error)
+
+func (f transportFunc) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	return f(ctx, query)
+}
+
+func TestCache_ServeStale(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	tests := map[string]struct {
+		advance  time.Duration
+		upstream transportFunc
+		expected net.IP
+		ttl      uint32
+		err      bool
+	}{
+		"upstream error": {
+			advance: 90 * time.Second,
+			upstream: func(ctx context.Context, query []byte) ([]byte, error) {
+				return nil, errors.New("connection refused")
+			},
+			expected: net.IPv4(192, 0, 2, 1),
+			ttl:      30,
+		},
+		"upstream servfail": {
+			advance: 90 * time.Second,
+			upstream: func(ctx context.Context, query []byte) ([]byte, error) {
+				resp := append([]byte(nil), query...)
+				resp[2] |= 0x80
+				resp[3] = 0x82
+				return resp, nil
+			},
+			expected: net.IPv4(192, 0, 2, 1),
+			ttl:      30,
+		},
+		"upstream timeout": {
+			advance: 90 * time.Second,
+			upstream: func(ctx context.Context, query []byte) ([]byte, error) {
+				<-release
+				return nil, errors.New("timeout")
+			},
+			expected: net.IPv4(192, 0, 2, 1),
+			ttl:      30,
+		},
+		"upstream recovered": {
+			advance: 90 * time.Second,
+			upstream: func(ctx context.Context, query []byte) ([]byte, error) {
+				return answerA(query, net.IPv4(192, 0, 2, 2), 60), nil
+			},
+			expected: net.IPv4(192, 0, 2, 2),
+			ttl:      60,
+		},
+		"beyond window": {
+			advance: 130 * time.Second,
+			upstream: func(ctx context.Context, query []byte) ([]byte, error) {
+				return nil, errors.New("connection refused")
+			},
+			err: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			cache := donut.NewCache(10,
+				donut.WithCacheServeStale(time.Minute),
+				donut.WithCacheStaleAnswerTimeout(50*time.Millisecond))
+			clock := newClock(cache)
+
+			var upstream atomic.Pointer[transportFunc]
+			transport := transportFunc(func(ctx context.Context, query []byte) ([]byte, error) {
+				return (*upstream.Load())(ctx, query)
+			})
+
+			healthy := transportFunc(func(ctx context.Context, query []byte) ([]byte, error) {
+				return answerA(query, net.IPv4(192, 0, 2, 1), 60), nil
+			})
+			upstream.Store(&healthy)
+
+			r := donut.New(donut.GoogleHost, donut.WithTransport(transport), donut.WithCache(cache))
+
+			q := donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN}
+			if _, err := r.Lookup(q); err != nil {
+				t.Fatal(err)
+			}
+
+			clock.Advance(tt.advance)
+			upstream.Store(&tt.upstream)
+
+			answer, err := r.Lookup(q)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(answer) != 1 || !bytes.Equal(answer[0].Data.([]byte), tt.expected.To4()) || answer[0].TTL != tt.ttl {
+				t.Errorf("expected %s with TTL %d, got %+v", tt.expected, tt.ttl, answer)
+			}
+		})
+	}
+}
+
+func TestCache_ServeStaleCoalesced(t *testing.T) {
+	cache := donut.NewCache(10,
+		donut.WithCacheServeStale(time.Minute),
+		donut.WithCacheStaleAnswerTimeout(10*time.Millisecond))
+	clock := newClock(cache)
+
+	release := make(chan struct{})
+	var calls atomic.Int32
+	transport := transportFunc(func(ctx context.Context, query []byte) ([]byte, error) {
+		if calls.Add(1) > 1 {
+			<-release
+		}
+		return answerA(query, net.IPv4(192, 0, 2, 1), 60), nil
+	})
+
+	m := &metricsRecorder{}
+	r := donut.New(donut.GoogleHost, donut.WithTransport(transport), donut.WithCache(cache), donut.WithMetrics(m))
+
+	q := donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN}
+	if _, err := r.Lookup(q); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(90 * time.Second)
+
+	// Every lookup is answered with the stale response while the upstream
+	// is stuck, and all of their refreshes wait on the first.
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := r.Lookup(q); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	waitForWaiting(t, r, 9)
+	close(release)
+	r.Close()
+
+	if got := calls.Load(); got != 2 {
+		t.Errorf("expected 2 upstream queries, got %d", got)
+	}
+	if len(m.refreshes) != 1 || m.refreshes[0].Cache != "stale" || m.refreshes[0].Upstream != donut.GoogleHost {
+		t.Errorf("expected a single stale refresh, got %+v", m.refreshes)
+	}
+}
+
+func TestCache_Prefetch(t *testing.T) {
+	transport := &fakeTransport{ttl: 100}
+	cache := donut.NewCache(10, donut.WithCachePrefetch(2))
+	clock := newClock(cache)
+
+	r := donut.New(donut.GoogleHost, donut.WithTransport(transport), donut.WithCache(cache))
+
+	q := donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN}
+
+	// The first hit is too far from expiry, and the second is not popular
+	// enough until it has been served twice.
+	for _, advance := range []time.Duration{0, 50, 45} {
+		clock.Advance(advance * time.Second)
+		if _, err := r.Lookup(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Wait for the background refresh.
+	r.Close()
+
+	if got := transport.calls.Load(); got != 2 {
+		t.Fatalf("expected 2 upstream queries, got %d", got)
+	}
+
+	// The refreshed response was stored 95 seconds in.
+	clock.Advance(55 * time.Second)
+	answer, err := r.Lookup(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := transport.calls.Load(); got != 2 {
+		t.Errorf("expected the refreshed response to be served, got %d upstream queries", got)
+	}
+	if len(answer) != 1 || answer[0].TTL != 45 {
+		t.Errorf("expected TTL 45, got %+v", answer)
+	}
+}
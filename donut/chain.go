@@ -0,0 +1,202 @@
+package donut
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// DefaultMaxAliases is the number of CNAME and DNAME records followed from a
+// name before giving up, unless set otherwise with WithFollowAliases.
+const DefaultMaxAliases = 8
+
+// Chain is the result of following the CNAME and DNAME records of a name to
+// the records of the type asked for.
+type Chain struct {
+	// Aliases holds the CNAME and DNAME records followed, in order. A CNAME
+	// record synthesised from a DNAME record is left out.
+	Aliases []Record `json:"aliases,omitempty"`
+
+	// Name is the name at the end of the chain, which is the name itself if
+	// it has no aliases.
+	Name string `json:"name"`
+
+	// Records holds the records of the type asked for at the end of the
+	// chain, if there are any.
+	Records []Record `json:"records"`
+}
+
+// AliasError is returned when a chain of CNAME and DNAME records loops back on
+// itself or is longer than allowed.
+type AliasError struct {
+	// Name is the name at which the chain was abandoned.
+	Name string
+
+	// Aliases holds the records followed up to that point.
+	Aliases []Record
+
+	// Loop reports whether the chain leads back to a name already in it.
+	Loop bool
+}
+
+func (e *AliasError) Error() string {
+	if e.Loop {
+		return fmt.Sprintf("alias loop at %s after %d records", e.Name, len(e.Aliases))
+	}
+	return fmt.Sprintf("more than %d aliases followed to %s", len(e.Aliases), e.Name)
+}
+
+// LookupChain sends the question and follows any CNAME and DNAME records in
+// the answer, returning the records of the type asked for along with the
+// aliases that lead to them. It follows chains whether or not the resolver
+// was created with WithFollowAliases.
+func (r *Resolver) LookupChain(ctx context.Context, q Question) (*Chain, error) {
+	// The search list may try several names, so remember the chain of each
+	// response to return the one the search settles on.
+	chains := make(map[*Message]*Chain)
+
+	msg, err := r.resolvConf.search(q.FQDN, func(name string) (*Message, error) {
+		msg, chain, err := r.followAliases(ctx, Question{FQDN: name, Type: q.Type, Class: q.Class})
+		if err == nil {
+			chains[msg] = chain
+		}
+		return msg, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return chains[msg], nil
+}
+
+// followAliases looks up the question, querying again for the end of the
+// chain for as long as a response holds only part of it. The response
+// returned is the last one received with its answer replaced by the whole
+// chain, as if a single server had given it.
+func (r *Resolver) followAliases(ctx context.Context, q Question) (*Message, *Chain, error) {
+	limit := r.maxAliases
+	if limit <= 0 {
+		limit = DefaultMaxAliases
+	}
+
+	name := q.FQDN
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	chain := &Chain{Name: name}
+	seen := map[string]bool{strings.ToLower(name): true}
+
+	for {
+		msg, err := r.lookupQuestion(ctx, Question{FQDN: chain.Name, Type: q.Type, Class: q.Class})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		followed := len(chain.Aliases)
+		if err := chain.follow(msg.Answers, q.Type, q.Class, limit, seen); err != nil {
+			return nil, nil, err
+		}
+
+		// A response that ends the chain without the records asked for says
+		// that there are none if it is negative, as described in
+		// https://datatracker.ietf.org/doc/html/rfc6604#section-3. Otherwise
+		// it was cut short by leaving the zones the server knows about.
+		if len(chain.Records) > 0 || len(chain.Aliases) == followed || msg.NXDomain() || hasSOA(msg.Authority) {
+			msg.Questions = []Question{q}
+			msg.Answers = append(slices.Clone(chain.Aliases), chain.Records...)
+			return msg, chain, nil
+		}
+	}
+}
+
+// follow walks the chain through the records of an answer from the current
+// end of the chain, stopping at the records of the given type or at a name
+// without aliases in the answer.
+func (c *Chain) follow(answers []Record, t RecordType, class RecordClass, limit int, seen map[string]bool) error {
+	for {
+		for _, rr := range answers {
+			if rr.Type == t && rr.Class == class && strings.EqualFold(rr.Name, c.Name) {
+				c.Records = append(c.Records, rr)
+			}
+		}
+		if len(c.Records) > 0 {
+			return nil
+		}
+
+		alias, target, ok := findAlias(answers, c.Name, class)
+		if !ok {
+			return nil
+		}
+
+		if len(c.Aliases) == limit {
+			return &AliasError{Name: c.Name, Aliases: c.Aliases}
+		}
+		c.Aliases = append(c.Aliases, alias)
+
+		key := strings.ToLower(target)
+		if seen[key] {
+			return &AliasError{Name: target, Aliases: c.Aliases, Loop: true}
+		}
+		seen[key] = true
+
+		c.Name = target
+	}
+}
+
+// findAlias returns the record aliasing name in the answer and the name it
+// leads to. A DNAME record is preferred over a CNAME record, so that the
+// CNAME record a server synthesises from it is not reported as well, as
+// described in https://datatracker.ietf.org/doc/html/rfc6672#section-3.4
+func findAlias(answers []Record, name string, class RecordClass) (Record, string, bool) {
+	lower := strings.ToLower(name)
+
+	for _, rr := range answers {
+		if rr.Type != DNAME || rr.Class != class || rr.Name == "." {
+			continue
+		}
+
+		owner := strings.ToLower(rr.Name)
+		if !strings.HasSuffix(lower, "."+owner) {
+			continue
+		}
+
+		target, err := rdataName(rr.Data.([]byte), 0)
+		if err != nil {
+			continue
+		}
+
+		// The labels below the owner are kept and the owner replaced by the
+		// target, as described in
+		// https://datatracker.ietf.org/doc/html/rfc6672#section-2.2
+		prefix := name[:len(name)-len(owner)]
+		if target == "." {
+			return rr, prefix, true
+		}
+		return rr, prefix + target, true
+	}
+
+	for _, rr := range answers {
+		if rr.Type != CNAME || rr.Class != class || !strings.EqualFold(rr.Name, name) {
+			continue
+		}
+
+		target, err := rdataName(rr.Data.([]byte), 0)
+		if err != nil {
+			continue
+		}
+		return rr, target, true
+	}
+
+	return Record{}, "", false
+}
+
+func hasSOA(authority []Record) bool {
+	for _, rr := range authority {
+		if rr.Type == SOA {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,272 @@
+package donut_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tomasbasham/donut"
+)
+
+// authTransport answers queries as an authoritative server would, with only
+// the records at the name asked for and never following CNAME records. Names
+// below the owner of a DNAME record are answered with the DNAME record and
+// the CNAME record synthesised from it.
+type authTransport struct {
+	records []donut.Record
+	dnames  map[string]string
+	queries atomic.Int32
+}
+
+func (a *authTransport) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	a.queries.Add(1)
+
+	msg, err := donut.ParseMessage(query)
+	if err != nil {
+		return nil, err
+	}
+
+	msg.Response = true
+	msg.Additional = nil
+
+	q := msg.Questions[0]
+
+	found := false
+	for _, rr := range a.records {
+		if strings.EqualFold(rr.Name, q.FQDN) {
+			found = true
+			if rr.Type == q.Type || rr.Type == donut.CNAME {
+				msg.Answers = append(msg.Answers, rr)
+			}
+		}
+	}
+
+	for owner, target := range a.dnames {
+		if prefix, ok := strings.CutSuffix(q.FQDN, "."+owner); ok {
+			found = true
+			msg.Answers = append(msg.Answers,
+				donut.Record{Name: owner, Type: donut.DNAME, Class: donut.IN, TTL: 300, Data: wireName(target)},
+				donut.Record{Name: q.FQDN, Type: donut.CNAME, Class: donut.IN, TTL: 300, Data: wireName(prefix + "." + target)},
+			)
+		}
+	}
+
+	if !found {
+		msg.RCode = donut.NXDomain
+	}
+	if len(msg.Answers) == 0 {
+		msg.Authority = []donut.Record{{
+			Name:  "example.",
+			Type:  donut.SOA,
+			Class: donut.IN,
+			TTL:   300,
+			Data: []byte("\x02ns\x07example\x00\x05admin\x07example\x00" +
+				"\x00\x00\x00\x01\x00\x00\x1c\x20\x00\x00\x0e\x10\x00\x12\x75\x00\x00\x00\x00\x3c"),
+		}}
+	}
+
+	return msg.Pack()
+}
+
+func cnameRecord(name, target string) donut.Record {
+	return donut.Record{Name: name, Type: donut.CNAME, Class: donut.IN, TTL: 300, Data: wireName(target)}
+}
+
+func aRecord(name string, ip ...byte) donut.Record {
+	return donut.Record{Name: name, Type: donut.A, Class: donut.IN, TTL: 300, Data: ip}
+}
+
+func TestResolver_LookupChain(t *testing.T) {
+	tests := map[string]struct {
+		transport donut.Transport
+		question  donut.Question
+		aliases   []string
+		name      string
+		records   int
+		queries   int32
+		loop      bool
+		tooLong   bool
+	}{
+		"no aliases": {
+			transport: &authTransport{records: []donut.Record{aRecord("host.example.", 192, 0, 2, 1)}},
+			question:  donut.Question{FQDN: "host.example", Type: donut.A, Class: donut.IN},
+			name:      "host.example.",
+			records:   1,
+			queries:   1,
+		},
+		"whole chain in one answer": {
+			transport: zone,
+			question:  donut.Question{FQDN: "www.example.com", Type: donut.A, Class: donut.IN},
+			aliases:   []string{"www.example.com.", "web.example.com."},
+			name:      "example.com.",
+			records:   1,
+		},
+		"chain across zones": {
+			transport: &authTransport{records: []donut.Record{
+				cnameRecord("www.example.", "www.cdn.example."),
+				cnameRecord("www.cdn.example.", "edge.cdn.example."),
+				aRecord("edge.cdn.example.", 192, 0, 2, 1),
+			}},
+			question: donut.Question{FQDN: "www.example.", Type: donut.A, Class: donut.IN},
+			aliases:  []string{"www.example.", "www.cdn.example."},
+			name:     "edge.cdn.example.",
+			records:  1,
+			queries:  3,
+		},
+		"dname": {
+			transport: &authTransport{
+				records: []donut.Record{aRecord("host.new.example.", 192, 0, 2, 1)},
+				dnames:  map[string]string{"old.example.": "new.example."},
+			},
+			question: donut.Question{FQDN: "host.old.example.", Type: donut.A, Class: donut.IN},
+			aliases:  []string{"old.example."},
+			name:     "host.new.example.",
+			records:  1,
+			queries:  2,
+		},
+		"no records at the end": {
+			transport: &authTransport{records: []donut.Record{
+				cnameRecord("www.example.", "host.example."),
+				{Name: "host.example.", Type: donut.TXT, Class: donut.IN, TTL: 300, Data: []byte("\x02hi")},
+			}},
+			question: donut.Question{FQDN: "www.example.", Type: donut.A, Class: donut.IN},
+			aliases:  []string{"www.example."},
+			name:     "host.example.",
+			queries:  2,
+		},
+		"cname asked for": {
+			transport: &authTransport{records: []donut.Record{cnameRecord("www.example.", "host.example.")}},
+			question:  donut.Question{FQDN: "www.example.", Type: donut.CNAME, Class: donut.IN},
+			name:      "www.example.",
+			records:   1,
+			queries:   1,
+		},
+		"loop": {
+			transport: &authTransport{records: []donut.Record{
+				cnameRecord("a.example.", "b.example."),
+				cnameRecord("b.example.", "A.example."),
+			}},
+			question: donut.Question{FQDN: "a.example.", Type: donut.A, Class: donut.IN},
+			loop:     true,
+		},
+		"too long": {
+			transport: &authTransport{records: []donut.Record{
+				cnameRecord("1.example.", "2.example."),
+				cnameRecord("2.example.", "3.example."),
+				cnameRecord("3.example.", "4.example."),
+				cnameRecord("4.example.", "5.example."),
+				cnameRecord("5.example.", "6.example."),
+				cnameRecord("6.example.", "7.example."),
+				cnameRecord("7.example.", "8.example."),
+				cnameRecord("8.example.", "9.example."),
+				cnameRecord("9.example.", "10.example."),
+				aRecord("10.example.", 192, 0, 2, 1),
+			}},
+			question: donut.Question{FQDN: "1.example.", Type: donut.A, Class: donut.IN},
+			tooLong:  true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := donut.New("", donut.WithTransport(tt.transport))
+
+			chain, err := r.LookupChain(context.Background(), tt.question)
+			if tt.loop || tt.tooLong {
+				var aliasErr *donut.AliasError
+				if !errors.As(err, &aliasErr) || aliasErr.Loop != tt.loop {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if tt.tooLong && len(aliasErr.Aliases) != donut.DefaultMaxAliases {
+					t.Errorf("expected %d aliases, got %d", donut.DefaultMaxAliases, len(aliasErr.Aliases))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var aliases []string
+			for _, rr := range chain.Aliases {
+				aliases = append(aliases, rr.Name)
+			}
+			if strings.Join(aliases, " ") != strings.Join(tt.aliases, " ") {
+				t.Errorf("expected aliases %v, got %v", tt.aliases, aliases)
+			}
+			if chain.Name != tt.name {
+				t.Errorf("expected name %q, got %q", tt.name, chain.Name)
+			}
+			if len(chain.Records) != tt.records {
+				t.Errorf("expected %d records, got %d", tt.records, len(chain.Records))
+			}
+
+			if auth, ok := tt.transport.(*authTransport); ok {
+				if got := auth.queries.Load(); got != tt.queries {
+					t.Errorf("expected %d queries, got %d", tt.queries, got)
+				}
+			}
+		})
+	}
+}
+
+func TestResolver_LookupFollowAliases(t *testing.T) {
+	records := []donut.Record{
+		cnameRecord("www.example.", "www.cdn.example."),
+		cnameRecord("www.cdn.example.", "edge.cdn.example."),
+		aRecord("edge.cdn.example.", 192, 0, 2, 1),
+	}
+
+	tests := map[string]struct {
+		resolver func(transport donut.Transport) *donut.Resolver
+		types    []donut.RecordType
+	}{
+		"disabled": {
+			resolver: func(transport donut.Transport) *donut.Resolver {
+				return donut.New("", donut.WithTransport(transport))
+			},
+			types: []donut.RecordType{donut.CNAME},
+		},
+		"enabled": {
+			resolver: func(transport donut.Transport) *donut.Resolver {
+				return donut.New("", donut.WithTransport(transport), donut.WithFollowAliases(0))
+			},
+			types: []donut.RecordType{donut.CNAME, donut.CNAME, donut.A},
+		},
+		"limited": {
+			resolver: func(transport donut.Transport) *donut.Resolver {
+				return donut.New("", donut.WithTransport(transport), donut.WithFollowAliases(1))
+			},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := tt.resolver(&authTransport{records: records})
+
+			answers, err := r.Lookup(donut.Question{FQDN: "www.example.", Type: donut.A, Class: donut.IN})
+			if tt.types == nil {
+				var aliasErr *donut.AliasError
+				if !errors.As(err, &aliasErr) {
+					t.Fatalf("expected an alias error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var types []donut.RecordType
+			for _, rr := range answers {
+				types = append(types, rr.Type)
+			}
+			if len(types) != len(tt.types) {
+				t.Fatalf("expected %v, got %v", tt.types, types)
+			}
+			for i := range types {
+				if types[i] != tt.types[i] {
+					t.Errorf("expected %v, got %v", tt.types, types)
+				}
+			}
+		})
+	}
+}
@@ -1,5 +1,7 @@
 package donut
 
+import "strconv"
+
 type RecordType uint16
 
 const (
@@ -12,8 +14,34 @@ const (
 	TXT   RecordType = 16
 	AAAA  RecordType = 28
 	SRV   RecordType = 33
+	DNAME RecordType = 39
+	OPT   RecordType = 41
 )
 
+var recordTypeNames = map[RecordType]string{
+	A:     "A",
+	NS:    "NS",
+	CNAME: "CNAME",
+	SOA:   "SOA",
+	PTR:   "PTR",
+	MX:    "MX",
+	TXT:   "TXT",
+	AAAA:  "AAAA",
+	SRV:   "SRV",
+	DNAME: "DNAME",
+	OPT:   "OPT",
+}
+
+// String returns the mnemonic of the record type, or the generic TYPEnnn form
+// described in https://datatracker.ietf.org/doc/html/rfc3597#section-5 for
+// types without one.
+func (t RecordType) String() string {
+	if name, ok := recordTypeNames[t]; ok {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
 type RecordClass uint16
 
 const (
@@ -22,3 +50,50 @@ const (
 	CH RecordClass = 3
 	HS RecordClass = 4
 )
+
+// RCode is the response code of a DNS message.
+type RCode uint8
+
+const (
+	NoError  RCode = 0
+	FormErr  RCode = 1
+	ServFail RCode = 2
+	NXDomain RCode = 3
+	NotImp   RCode = 4
+	Refused  RCode = 5
+)
+
+var recordClassNames = map[RecordClass]string{
+	IN: "IN",
+	CS: "CS",
+	CH: "CH",
+	HS: "HS",
+}
+
+// String returns the mnemonic of the record class, or the generic CLASSnnn
+// form described in https://datatracker.ietf.org/doc/html/rfc3597#section-5
+// for classes without one.
+func (c RecordClass) String() string {
+	if name, ok := recordClassNames[c]; ok {
+		return name
+	}
+	return "CLASS" + strconv.Itoa(int(c))
+}
+
+var rcodeNames = map[RCode]string{
+	NoError:  "NOERROR",
+	FormErr:  "FORMERR",
+	ServFail: "SERVFAIL",
+	NXDomain: "NXDOMAIN",
+	NotImp:   "NOTIMP",
+	Refused:  "REFUSED",
+}
+
+// String returns the mnemonic of the response code as used by dig, or
+// RCODEnnn for codes without one.
+func (r RCode) String() string {
+	if name, ok := rcodeNames[r]; ok {
+		return name
+	}
+	return "RCODE" + strconv.Itoa(int(r))
+}
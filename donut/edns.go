@@ -0,0 +1,92 @@
+package donut
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// EDNS(0) option codes as registered in
+// https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml#dns-parameters-11
+const (
+	ednsExtendedError uint16 = 15
+)
+
+// ednsDNSSECOK is the DO bit in the flags carried by the TTL of an OPT record,
+// as described in https://datatracker.ietf.org/doc/html/rfc3225
+const ednsDNSSECOK = 0x8000
+
+// findOPT returns the OPT pseudo-record of a message, if it has one.
+func findOPT(additional []Record) (Record, bool) {
+	for _, rr := range additional {
+		if rr.Type == OPT {
+			return rr, true
+		}
+	}
+	return Record{}, false
+}
+
+// dnssecOK reports whether the DO bit is set in the OPT pseudo-record of a
+// message, signalling that the sender understands DNSSEC records.
+func dnssecOK(additional []Record) bool {
+	opt, ok := findOPT(additional)
+	return ok && opt.TTL&ednsDNSSECOK != 0
+}
+
+// ednsOptions calls fn for every option carried in the OPT pseudo-record.
+func ednsOptions(opt Record, fn func(code uint16, data []byte)) {
+	rdata, _ := opt.Data.([]byte)
+	for len(rdata) >= 4 {
+		code := binary.BigEndian.Uint16(rdata[0:2])
+		length := int(binary.BigEndian.Uint16(rdata[2:4]))
+		if len(rdata) < 4+length {
+			return
+		}
+		fn(code, rdata[4:4+length])
+		rdata = rdata[4+length:]
+	}
+}
+
+// extendedErrorText returns the EXTRA-TEXT of any extended DNS errors in the
+// additional section, joined by newlines.
+func extendedErrorText(additional []Record) string {
+	opt, ok := findOPT(additional)
+	if !ok {
+		return ""
+	}
+
+	var text []string
+	ednsOptions(opt, func(code uint16, data []byte) {
+		if code == ednsExtendedError && len(data) > 2 {
+			text = append(text, string(data[2:]))
+		}
+	})
+
+	return strings.Join(text, "\n")
+}
+
+// newOPT returns an OPT pseudo-record advertising the given UDP payload size
+// and carrying an extended DNS error with the given EXTRA-TEXT, if any.
+func newOPT(size uint16, do bool, text string) Record {
+	var rdata []byte
+	if text != "" {
+		// INFO-CODE 0 is "Other Error", which is the best we can say about free
+		// form text.
+		rdata = binary.BigEndian.AppendUint16(rdata, ednsExtendedError)
+		rdata = binary.BigEndian.AppendUint16(rdata, uint16(2+len(text)))
+		rdata = binary.BigEndian.AppendUint16(rdata, 0)
+		rdata = append(rdata, text...)
+	}
+
+	var flags uint32
+	if do {
+		flags |= ednsDNSSECOK
+	}
+
+	return Record{
+		Name:  ".",
+		Type:  OPT,
+		Class: RecordClass(size),
+		TTL:   flags,
+		Data:  rdata,
+	}
+}
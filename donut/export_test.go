@@ -0,0 +1,15 @@
+package donut
+
+import "time"
+
+// SetCacheClock replaces the clock used by the cache, letting tests move time
+// forward without waiting.
+func SetCacheClock(c *Cache, now func() time.Time) {
+	c.now = now
+}
+
+// SetHostsClock replaces the clock used to decide when to check the hosts file
+// for changes.
+func SetHostsClock(r *Resolver, now func() time.Time) {
+	r.hosts.now = now
+}
@@ -0,0 +1,113 @@
+package donut
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// flightGroup coalesces identical queries that are in flight at the same
+// time, so that a single exchange with the upstream server answers them all.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[cacheKey]*flight
+
+	// waiting is the number of queries waiting on an exchange made for
+	// another.
+	waiting atomic.Int64
+}
+
+// flight is an exchange in progress on behalf of one or more queries.
+type flight struct {
+	done chan struct{}
+	resp []byte
+	err  error
+}
+
+// do calls fn for the first query with the given key, and has any identical
+// query arriving before it returns wait for its response instead. It reports
+// whether the response was shared with an earlier query.
+//
+// The response is copied and given the ID of the query for every waiter. A
+// waiter whose context is still live when the first query is cancelled makes
+// the exchange itself.
+func (g *flightGroup) do(ctx context.Context, key cacheKey, query []byte, fn func() ([]byte, error)) ([]byte, bool, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[cacheKey]*flight)
+	}
+
+	if f, ok := g.calls[key]; ok {
+		g.waiting.Add(1)
+		g.mu.Unlock()
+
+		select {
+		case <-f.done:
+			g.waiting.Add(-1)
+		case <-ctx.Done():
+			g.waiting.Add(-1)
+			return nil, false, ctx.Err()
+		}
+
+		if f.err != nil {
+			if errors.Is(f.err, context.Canceled) || errors.Is(f.err, context.DeadlineExceeded) {
+				resp, err := fn()
+				return resp, false, err
+			}
+			return nil, true, f.err
+		}
+
+		resp := append([]byte(nil), f.resp...)
+		copy(resp, query[:2])
+		return resp, true, nil
+	}
+
+	f := &flight{done: make(chan struct{})}
+	g.calls[key] = f
+	g.mu.Unlock()
+
+	f.resp, f.err = fn()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(f.done)
+
+	return f.resp, false, f.err
+}
+
+// Stats holds counters describing the queries made through a resolver.
+type Stats struct {
+	// Queries is the number of queries looked up.
+	Queries uint64
+
+	// Coalesced is the number of queries answered by an exchange made for an
+	// identical query that was already in flight.
+	Coalesced uint64
+
+	// Waiting is the number of queries waiting for the response to an
+	// identical query in flight right now.
+	Waiting uint64
+}
+
+// Stats returns the counters of the queries made through the resolver.
+func (r *Resolver) Stats() Stats {
+	return Stats{
+		Queries:   r.queries.Load(),
+		Coalesced: r.coalesced.Load(),
+		Waiting:   uint64(r.flights.waiting.Load()),
+	}
+}
+
+// exchange sends the query upstream, coalescing it with any identical query
+// in flight. It reports whether the response was shared.
+func (r *Resolver) exchange(ctx context.Context, key cacheKey, query []byte) ([]byte, bool, error) {
+	resp, shared, err := r.flights.do(ctx, key, query, func() ([]byte, error) {
+		return r.transport.Exchange(ctx, query)
+	})
+	if shared {
+		r.coalesced.Add(1)
+	}
+	return resp, shared, err
+}
@@ -0,0 +1,110 @@
+package donut_test
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tomasbasham/donut"
+)
+
+// waitForWaiting blocks until n queries are waiting on an exchange made for
+// another query.
+func waitForWaiting(t *testing.T, r *donut.Resolver, n uint64) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Stats().Waiting != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d waiting queries, got %+v", n, r.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestResolver_LookupCoalesced(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int32
+	transport := transportFunc(func(ctx context.Context, query []byte) ([]byte, error) {
+		calls.Add(1)
+		<-release
+		return answerA(query, net.IPv4(192, 0, 2, 1), 300), nil
+	})
+
+	r := donut.New(donut.GoogleHost, donut.WithTransport(transport))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			query := newQuery(uint16(i), "example.com")
+			resp, err := r.LookupRaw(query)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if id := binary.BigEndian.Uint16(resp); id != uint16(i) {
+				t.Errorf("expected ID %d, got %d", i, id)
+			}
+		}()
+	}
+
+	// Only answer once every other query has joined the first.
+	waitForWaiting(t, r, 199)
+	close(release)
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("expected 1 upstream query, got %d", got)
+	}
+
+	stats := r.Stats()
+	if stats.Queries != 200 || stats.Coalesced != 199 || stats.Waiting != 0 {
+		t.Errorf("expected 200 queries with 199 coalesced, got %+v", stats)
+	}
+}
+
+func TestResolver_LookupCoalescedCancelled(t *testing.T) {
+	started := make(chan struct{})
+	var calls atomic.Int32
+	transport := transportFunc(func(ctx context.Context, query []byte) ([]byte, error) {
+		if calls.Add(1) == 1 {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return answerA(query, net.IPv4(192, 0, 2, 1), 300), nil
+	})
+
+	r := donut.New(donut.GoogleHost, donut.WithTransport(transport))
+
+	q := donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		r.LookupContext(ctx, q)
+	}()
+	<-started
+
+	// The second lookup waits on the first, which is then cancelled.
+	done := make(chan error)
+	go func() {
+		_, err := r.Lookup(q)
+		done <- err
+	}()
+	waitForWaiting(t, r, 1)
+	cancel()
+
+	if err := <-done; err != nil {
+		t.Fatalf("expected the waiting lookup to make its own exchange, got %v", err)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("expected 2 upstream queries, got %d", got)
+	}
+}
@@ -0,0 +1,114 @@
+package donut_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCertificate returns a self-signed certificate valid for dns.example
+// and the loopback address, along with a pool that trusts it.
+func newTestCertificate(t testing.TB) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dns.example"},
+		DNSNames:              []string{"dns.example"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, pool
+}
+
+// answerA builds a response to query containing a single A record for the
+// question name pointing at ip.
+func answerA(query []byte, ip net.IP, ttl uint32) []byte {
+	// Drop any additional records, such as an OPT record, from the query so
+	// that the answer directly follows the question.
+	end := 12
+	for query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	resp := append([]byte(nil), query[:end+5]...)
+
+	// Set QR and RA, and one answer record.
+	resp[2] |= 0x80
+	resp[3] |= 0x80
+	binary.BigEndian.PutUint16(resp[6:8], 1)
+	binary.BigEndian.PutUint16(resp[10:12], 0)
+
+	// The answer name is a pointer to the question name at offset 12.
+	resp = append(resp, 0xC0, 0x0C)
+	resp = binary.BigEndian.AppendUint16(resp, 1)
+	resp = binary.BigEndian.AppendUint16(resp, 1)
+	resp = binary.BigEndian.AppendUint32(resp, ttl)
+	resp = binary.BigEndian.AppendUint16(resp, 4)
+	resp = append(resp, ip.To4()...)
+
+	return resp
+}
+
+// newQuery builds a wire format query with the given ID for the A record of
+// name.
+func newQuery(id uint16, name string) []byte {
+	query := binary.BigEndian.AppendUint16(nil, id)
+	query = append(query, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0x00, 0x00, 0x01, 0x00, 0x01)
+	return query
+}
+
+// wireName encodes name as a sequence of labels, as found in the RDATA of a
+// record.
+func wireName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0x00)
+}
@@ -0,0 +1,281 @@
+package donut
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHostsFile is where the static table of host names is usually found.
+const DefaultHostsFile = "/etc/hosts"
+
+const (
+	// DefaultHostsTTL is the TTL of records answered from the hosts file and
+	// static records, unless set otherwise in HostsConfig.
+	DefaultHostsTTL = 60 * time.Second
+
+	// hostsCheckInterval is how often the hosts file is checked for changes,
+	// the same as in the net package, so that a busy resolver does not stat
+	// the file on every query.
+	hostsCheckInterval = 5 * time.Second
+)
+
+// HostsConfig configures answering queries from a hosts file and static
+// records before going upstream, set with WithHosts.
+type HostsConfig struct {
+	// File names a file in the format of hosts(5), which is read again
+	// whenever it changes. No file is read if empty.
+	File string
+
+	// Static maps names to the addresses they resolve to. A name given here
+	// is answered with these addresses alone, even if it is also in the
+	// file.
+	Static map[string][]string
+
+	// TTL is the TTL of the records answered, DefaultHostsTTL if not set.
+	TTL time.Duration
+}
+
+// hosts answers A and AAAA queries for the names in a hosts file or static
+// records, and PTR queries for their addresses. Other queries, and queries
+// for names it does not know, are left to the upstream.
+type hosts struct {
+	file   string
+	static hostsTable
+	ttl    uint32
+	now    func() time.Time
+
+	mu      sync.Mutex
+	table   hostsTable
+	checked time.Time
+	modTime time.Time
+	size    int64
+}
+
+// hostsTable holds the addresses of each name and the names of each address,
+// keyed by the name under in-addr.arpa or ip6.arpa, in the order given.
+type hostsTable struct {
+	addrs map[string][]net.IP
+	names map[string][]string
+}
+
+func newHostsTable() hostsTable {
+	return hostsTable{
+		addrs: make(map[string][]net.IP),
+		names: make(map[string][]string),
+	}
+}
+
+// add records the names as resolving to the address, the first being its
+// canonical name.
+func (t hostsTable) add(addr string, names ...string) error {
+	// The zone of a link-local address has no meaning in a DNS record.
+	addr, _, _ = strings.Cut(addr, "%")
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return fmt.Errorf("invalid address %q", addr)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	reverse, err := reverseName(addr)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		name = fqdn(name)
+		t.addrs[name] = append(t.addrs[name], ip)
+		t.names[reverse] = append(t.names[reverse], name)
+	}
+
+	return nil
+}
+
+// newHosts returns nil if there is neither a file nor any static records, so
+// that queries are not looked at needlessly.
+func newHosts(c HostsConfig) (*hosts, error) {
+	if c.File == "" && len(c.Static) == 0 {
+		return nil, nil
+	}
+
+	ttl := c.TTL
+	if ttl <= 0 {
+		ttl = DefaultHostsTTL
+	}
+
+	h := &hosts{
+		file:   c.File,
+		static: newHostsTable(),
+		ttl:    uint32(ttl / time.Second),
+		now:    time.Now,
+	}
+
+	for name, addrs := range c.Static {
+		for _, addr := range addrs {
+			if err := h.static.add(addr, name); err != nil {
+				return nil, fmt.Errorf("static record for %s: %w", name, err)
+			}
+		}
+	}
+
+	h.table = h.static
+	if h.file != "" {
+		if err := h.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
+
+// load reads the hosts file, merging in the static records.
+func (h *hosts) load() error {
+	f, err := os.Open(h.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	table, err := parseHosts(f)
+	if err != nil {
+		return fmt.Errorf("hosts file %s: %w", h.file, err)
+	}
+
+	// Static records replace those in the file for the same name, and are
+	// added in front of them for the same address.
+	for name := range h.static.addrs {
+		delete(table.addrs, name)
+	}
+	for reverse, names := range h.static.names {
+		table.names[reverse] = slices.Concat(names, table.names[reverse])
+	}
+	for name, addrs := range h.static.addrs {
+		table.addrs[name] = addrs
+	}
+
+	h.table = table
+	h.modTime = info.ModTime()
+	h.size = info.Size()
+
+	return nil
+}
+
+// refresh reads the hosts file again if it has changed since it was last
+// read, checking at most once every hostsCheckInterval. If the file can no
+// longer be read, the entries last read from it are kept.
+func (h *hosts) refresh() {
+	now := h.now()
+	if h.file == "" || now.Sub(h.checked) < hostsCheckInterval {
+		return
+	}
+	h.checked = now
+
+	info, err := os.Stat(h.file)
+	if err != nil || (info.ModTime().Equal(h.modTime) && info.Size() == h.size) {
+		return
+	}
+
+	h.load()
+}
+
+// parseHosts reads a file in the format of hosts(5), in which each line holds
+// an address followed by its canonical name and any aliases, and anything
+// following a hash is a comment. Lines with an invalid address are skipped,
+// as they are by the C library.
+func parseHosts(r io.Reader) (hostsTable, error) {
+	table := newHostsTable()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			continue
+		}
+		table.add(fields[0], fields[1:]...)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return hostsTable{}, err
+	}
+
+	return table, nil
+}
+
+// answer returns the response to the query if it is for a name or address
+// known to the hosts file or static records. A name asked for addresses of
+// the other family gets a response with no records, so that it cannot be
+// answered differently upstream.
+func (h *hosts) answer(query []byte) ([]byte, bool) {
+	m := message{query}
+	req, err := m.unpack()
+	if err != nil || len(req.Questions) != 1 || req.Questions[0].Class != IN {
+		return nil, false
+	}
+
+	q := req.Questions[0]
+	name := fqdn(q.FQDN)
+
+	h.mu.Lock()
+	h.refresh()
+	table := h.table
+	h.mu.Unlock()
+
+	var answers []Record
+	switch q.Type {
+	case A, AAAA:
+		addrs, ok := table.addrs[name]
+		if !ok {
+			return nil, false
+		}
+		for _, ip := range addrs {
+			if (len(ip) == net.IPv4len) == (q.Type == A) {
+				answers = append(answers, Record{Name: q.FQDN, Type: q.Type, Class: IN, TTL: h.ttl, Data: []byte(ip)})
+			}
+		}
+	case PTR:
+		names, ok := table.names[name]
+		if !ok {
+			return nil, false
+		}
+		for _, target := range names {
+			answers = append(answers, Record{Name: q.FQDN, Type: PTR, Class: IN, TTL: h.ttl, Data: appendName(nil, target)})
+		}
+	default:
+		return nil, false
+	}
+
+	resp := &Message{
+		ID:                 req.ID,
+		Response:           true,
+		Authoritative:      true,
+		RecursionDesired:   req.RecursionDesired,
+		RecursionAvailable: true,
+		Questions:          req.Questions,
+		Answers:            answers,
+	}
+
+	opt, _ := findOPT(req.Additional)
+	resp.echoOPT(req, max(uint16(opt.Class), minUDPSize), "")
+
+	b, err := resp.Pack()
+	if err != nil {
+		return nil, false
+	}
+
+	return b, true
+}
@@ -0,0 +1,192 @@
+package donut_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tomasbasham/donut"
+)
+
+const hostsFile = `# static table
+127.0.0.1      localhost
+192.0.2.1      host.example host   # the canonical name comes first
+2001:db8::1    host.example
+fe80::1%lo0    link.example
+bogus          skipped.example
+192.0.2.2      other.example
+`
+
+// upstream answers every A query with 203.0.113.1, showing that the query was
+// not answered locally.
+var upstream = transportFunc(func(ctx context.Context, query []byte) ([]byte, error) {
+	return answerA(query, net.IPv4(203, 0, 113, 1), 300), nil
+})
+
+// answerStrings returns the addresses or names in the answers.
+func answerStrings(answers []donut.Record) []string {
+	var s []string
+	for _, rr := range answers {
+		switch rr.Type {
+		case donut.A, donut.AAAA:
+			s = append(s, net.IP(rr.Data.([]byte)).String())
+		case donut.PTR:
+			s = append(s, readName(rr.Data.([]byte)))
+		}
+	}
+	return s
+}
+
+func writeHosts(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolver_LookupHosts(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hosts")
+	writeHosts(t, file, hostsFile)
+
+	tests := map[string]struct {
+		question donut.Question
+		static   map[string][]string
+		expected []string
+	}{
+		"address": {
+			question: donut.Question{FQDN: "host.example.", Type: donut.A, Class: donut.IN},
+			expected: []string{"192.0.2.1"},
+		},
+		"alias": {
+			question: donut.Question{FQDN: "host", Type: donut.A, Class: donut.IN},
+			expected: []string{"192.0.2.1"},
+		},
+		"case insensitive": {
+			question: donut.Question{FQDN: "HOST.Example.", Type: donut.A, Class: donut.IN},
+			expected: []string{"192.0.2.1"},
+		},
+		"ipv6 address": {
+			question: donut.Question{FQDN: "host.example.", Type: donut.AAAA, Class: donut.IN},
+			expected: []string{"2001:db8::1"},
+		},
+		"zone dropped": {
+			question: donut.Question{FQDN: "link.example.", Type: donut.AAAA, Class: donut.IN},
+			expected: []string{"fe80::1"},
+		},
+		"no addresses of the family": {
+			question: donut.Question{FQDN: "other.example.", Type: donut.AAAA, Class: donut.IN},
+		},
+		"reverse": {
+			question: donut.Question{FQDN: "1.2.0.192.in-addr.arpa.", Type: donut.PTR, Class: donut.IN},
+			expected: []string{"host.example.", "host."},
+		},
+		"ipv6 reverse": {
+			question: donut.Question{FQDN: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", Type: donut.PTR, Class: donut.IN},
+			expected: []string{"host.example."},
+		},
+		"static record overrides the file": {
+			question: donut.Question{FQDN: "host.example.", Type: donut.A, Class: donut.IN},
+			static:   map[string][]string{"host.example": {"192.0.2.9"}},
+			expected: []string{"192.0.2.9"},
+		},
+		"static reverse": {
+			question: donut.Question{FQDN: "9.2.0.192.in-addr.arpa.", Type: donut.PTR, Class: donut.IN},
+			static:   map[string][]string{"router.example": {"192.0.2.9"}},
+			expected: []string{"router.example."},
+		},
+		"invalid address skipped": {
+			question: donut.Question{FQDN: "skipped.example.", Type: donut.A, Class: donut.IN},
+			expected: []string{"203.0.113.1"},
+		},
+		"unknown name": {
+			question: donut.Question{FQDN: "www.example.", Type: donut.A, Class: donut.IN},
+			expected: []string{"203.0.113.1"},
+		},
+		"other type": {
+			question: donut.Question{FQDN: "host.example.", Type: donut.MX, Class: donut.IN},
+			expected: []string{"203.0.113.1"},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := donut.New("", donut.WithTransport(upstream), donut.WithHosts(donut.HostsConfig{File: file, Static: tt.static}))
+
+			msg, err := r.LookupMessage(context.Background(), tt.question)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := answerStrings(msg.Answers); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestResolver_LookupHostsReload(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "hosts")
+	writeHosts(t, name, "192.0.2.1 host.example\n")
+
+	r := donut.New("", donut.WithTransport(upstream), donut.WithHosts(donut.HostsConfig{File: name}))
+
+	now := time.Now()
+	donut.SetHostsClock(r, func() time.Time { return now })
+
+	lookup := func() []string {
+		t.Helper()
+		answers, err := r.Lookup(donut.Question{FQDN: "host.example.", Type: donut.A, Class: donut.IN})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return answerStrings(answers)
+	}
+
+	steps := []struct {
+		change   func()
+		advance  time.Duration
+		expected string
+	}{
+		{expected: "192.0.2.1"},
+		{
+			change:   func() { writeHosts(t, name, "192.0.2.22 host.example\n") },
+			advance:  time.Second,
+			expected: "192.0.2.1",
+		},
+		{advance: 5 * time.Second, expected: "192.0.2.22"},
+		{
+			change:   func() { os.Remove(name) },
+			advance:  5 * time.Second,
+			expected: "192.0.2.22",
+		},
+	}
+	for i, step := range steps {
+		if step.change != nil {
+			step.change()
+		}
+		now = now.Add(step.advance)
+
+		if got := lookup(); len(got) != 1 || got[0] != step.expected {
+			t.Errorf("step %d: expected %s, got %v", i, step.expected, got)
+		}
+	}
+}
+
+func TestResolver_LookupHostsInvalid(t *testing.T) {
+	tests := map[string]donut.HostsConfig{
+		"missing file":   {File: filepath.Join(t.TempDir(), "missing")},
+		"invalid static": {Static: map[string][]string{"host.example": {"bogus"}}},
+	}
+	for name, c := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := donut.New("", donut.WithTransport(upstream), donut.WithHosts(c))
+
+			if _, err := r.Lookup(donut.Question{FQDN: "host.example.", Type: donut.A, Class: donut.IN}); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package donut
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// StatusError is returned when an HTTP based upstream server answers with a
+// status other than 200 OK.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
+}
+
+// httpsTransport sends queries to a DNS over HTTPS server as described in
+// https://datatracker.ietf.org/doc/html/rfc8484
+type httpsTransport struct {
+	url    string
+	client *http.Client
+}
+
+func (r *Resolver) newHTTPSTransport(e endpoint) (*httpsTransport, error) {
+	path := e.path
+	if path == "" {
+		path = "/dns-query"
+	}
+
+	client, err := r.newHTTPClient(e)
+	if err != nil {
+		return nil, err
+	}
+
+	return &httpsTransport{
+		url:    "https://" + e.authority() + path,
+		client: client,
+	}, nil
+}
+
+// Settings of the HTTP transport used for DNS over HTTPS. Queries are small
+// and frequent, so connections are kept open and reused for as long as the
+// server allows rather than paying for a new TLS handshake every time.
+const (
+	httpKeepAlive           = 30 * time.Second
+	httpIdleConnTimeout     = 90 * time.Second
+	httpMaxIdleConns        = 64
+	httpMaxIdleConnsPerHost = 8
+	httpTLSHandshakeTimeout = 10 * time.Second
+
+	// tlsSessionCacheSize is the number of TLS sessions kept for resumption,
+	// which saves a round trip when a connection has to be reopened.
+	tlsSessionCacheSize = 64
+)
+
+// newHTTPClient returns the client used to send requests to the endpoint.
+func (r *Resolver) newHTTPClient(e endpoint) (*http.Client, error) {
+	if r.client != nil {
+		if e.ip != "" || len(e.hashes) > 0 || r.bootstrap != nil || r.rootCAs != nil || len(r.certificates) > 0 || len(r.pins) > 0 {
+			return nil, errors.New("the server address, bootstrap, certificates and pins cannot be honoured with a custom client")
+		}
+		return r.client, nil
+	}
+
+	dialer := &net.Dialer{KeepAlive: httpKeepAlive}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          httpMaxIdleConns,
+		MaxIdleConnsPerHost:   httpMaxIdleConnsPerHost,
+		IdleConnTimeout:       httpIdleConnTimeout,
+		TLSHandshakeTimeout:   httpTLSHandshakeTimeout,
+		ExpectContinueTimeout: time.Second,
+		TLSClientConfig:       &tls.Config{},
+	}
+
+	// The defaults of the system are kept unless asked otherwise, taking the
+	// server name from the URL of each request.
+	if r.customTLS() || e.ip != "" || len(e.hashes) > 0 {
+		transport.TLSClientConfig = r.newTLSConfig(e)
+	}
+
+	if transport.TLSClientConfig.ClientSessionCache == nil {
+		transport.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(tlsSessionCacheSize)
+	}
+
+	// Hosts are resolved by the bootstrap, if any, rather than the system.
+	if r.bootstrap != nil {
+		transport.DialContext = r.bootstrap.dialContext
+	}
+
+	// When the address of the server is known all connections go straight to
+	// it, without resolving the host or going through a proxy.
+	if e.ip != "" {
+		addr := e.addr()
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+
+	client := &http.Client{Transport: transport}
+	r.httpClients = append(r.httpClients, client)
+
+	return client, nil
+}
+
+func (t *httpsTransport) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	body := bytes.NewBuffer(query)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	addContextHeader(req)
+	req.Header.Set("Accept", "application/dns-message")
+	req.Header.Set("Content-Type", "application/dns-message")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{StatusCode: resp.StatusCode}
+	}
+
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,125 @@
+package donut_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tomasbasham/donut"
+)
+
+// h2Server is a DNS over HTTPS server supporting HTTP/2, recording the
+// protocol of each request and whether its TLS session was resumed.
+type h2Server struct {
+	*httptest.Server
+	config  *tls.Config
+	http2   atomic.Int32
+	resumed atomic.Int32
+}
+
+func newH2Server(tb testing.TB) *h2Server {
+	tb.Helper()
+
+	s := &h2Server{}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 {
+			s.http2.Add(1)
+		}
+		if r.TLS.DidResume {
+			s.resumed.Add(1)
+		}
+
+		query, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(answerA(query, net.IPv4(192, 0, 2, 1), 300))
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	tb.Cleanup(s.Close)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+	s.config = &tls.Config{RootCAs: pool}
+
+	return s
+}
+
+func TestResolver_LookupHTTP2(t *testing.T) {
+	s := newH2Server(t)
+
+	r := donut.New(s.URL+"/dns-query", donut.WithTLSConfig(s.config))
+	defer r.Close()
+
+	q := donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN}
+
+	if _, err := r.Lookup(q); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing the resolver drops its idle connections, so the next lookup
+	// opens a new one which should resume the TLS session of the first.
+	r.Close()
+
+	if _, err := r.Lookup(q); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := s.http2.Load(); got != 2 {
+		t.Errorf("expected 2 HTTP/2 requests, got %d", got)
+	}
+	if got := s.resumed.Load(); got != 1 {
+		t.Errorf("expected 1 resumed TLS session, got %d", got)
+	}
+}
+
+func BenchmarkResolver_Lookup(b *testing.B) {
+	s := newH2Server(b)
+	q := donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN}
+
+	// A new resolver for every query, as the proxy used to do, pays for a new
+	// connection and TLS handshake every time.
+	b.Run("resolver per query", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			r := donut.New(s.URL+"/dns-query", donut.WithTLSConfig(s.config))
+			if _, err := r.Lookup(q); err != nil {
+				b.Fatal(err)
+			}
+			r.Close()
+		}
+	})
+
+	b.Run("shared resolver", func(b *testing.B) {
+		r := donut.New(s.URL+"/dns-query", donut.WithTLSConfig(s.config))
+		defer r.Close()
+
+		for i := 0; i < b.N; i++ {
+			if _, err := r.Lookup(q); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("shared resolver parallel", func(b *testing.B) {
+		r := donut.New(s.URL+"/dns-query", donut.WithTLSConfig(s.config))
+		defer r.Close()
+
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := r.Lookup(q); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
@@ -0,0 +1,150 @@
+package donut
+
+import (
+	"context"
+	"encoding/binary"
+	"net/http"
+)
+
+// ExchangeFunc exchanges a query for its response, as Transport does.
+type ExchangeFunc func(ctx context.Context, query []byte) ([]byte, error)
+
+// Exchange calls f, so that an ExchangeFunc may be used as a Transport.
+func (f ExchangeFunc) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	return f(ctx, query)
+}
+
+// Interceptor wraps every exchange of a query with the upstream, such as to
+// trace it. It is called with a description of the exchange and must call
+// next to send the query on, unless it answers the query itself. Interceptors
+// are set with WithInterceptors.
+//
+// An exchange is intercepted once, however many attempts the RetryPolicy
+// set with WithRetry makes, so that a single span covers them all. Queries
+// that are not exchanged are not intercepted: those answered from the hosts
+// file or the cache, and those that wait on the exchange of an identical
+// query already in flight rather than making their own.
+//
+// Trace context may be propagated to DNS over HTTPS servers by adding headers
+// to the context passed to next with ContextWithHeader.
+type Interceptor func(ctx context.Context, info *ExchangeInfo, query []byte, next ExchangeFunc) ([]byte, error)
+
+// ExchangeInfo describes a query exchanged with the upstream. Upstream and
+// RCode are only set once next has returned.
+type ExchangeInfo struct {
+	// Question is the question of the query, which is the zero Question if
+	// the query has none.
+	Question Question
+
+	// Cache is the status in the cache of the response to the query that led
+	// to the exchange: "miss" if there was none, "prefetch" if it is being
+	// refreshed as it nears expiry, and "stale" if it has expired. It is
+	// empty if the resolver has no cache or the query could not be cached.
+	Cache string
+
+	// Upstream is the server that answered the query.
+	Upstream string
+
+	// RCode is the response code of the response, if there was one.
+	RCode RCode
+}
+
+// interceptedTransport passes queries through a chain of interceptors before
+// exchanging them with another transport.
+type interceptedTransport struct {
+	transport    Transport
+	interceptors []Interceptor
+
+	// host is reported as the upstream when the transport does not say which
+	// server answered.
+	host string
+}
+
+func (t *interceptedTransport) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	info := &ExchangeInfo{}
+	if status, ok := ctx.Value(cacheStatusKey{}).(string); ok {
+		info.Cache = status
+	}
+
+	m := message{query}
+	if len(query) > headerLen && binary.BigEndian.Uint16(query[4:6]) > 0 {
+		if q, _, err := m.decodeQuestion(headerLen); err == nil {
+			info.Question = q
+		}
+	}
+
+	next := func(ctx context.Context, query []byte) ([]byte, error) {
+		exchangeCtx, upstream := withUpstreamRecorder(ctx)
+		resp, err := t.transport.Exchange(exchangeCtx, query)
+
+		info.Upstream = t.host
+		if server := upstream.get(); server != "" {
+			info.Upstream = server
+			recordUpstream(ctx, server)
+		}
+		if err == nil && len(resp) >= headerLen {
+			info.RCode = RCode(resp[3] & 0x0F)
+		}
+		return resp, err
+	}
+
+	// The first interceptor is the outermost, so the chain is built from the
+	// last one in.
+	for i := len(t.interceptors) - 1; i >= 0; i-- {
+		interceptor, inner := t.interceptors[i], next
+		next = func(ctx context.Context, query []byte) ([]byte, error) {
+			return interceptor(ctx, info, query, inner)
+		}
+	}
+
+	return next(ctx, query)
+}
+
+// Close closes the underlying transport.
+func (t *interceptedTransport) Close() error {
+	return closeTransport(t.transport)
+}
+
+// cacheStatusKey is the context key of the status in the cache of the query
+// being exchanged, given in ExchangeInfo.
+type cacheStatusKey struct{}
+
+func withCacheStatus(ctx context.Context, status string) context.Context {
+	return context.WithValue(ctx, cacheStatusKey{}, status)
+}
+
+// headerKey is the context key of the headers added to HTTP requests.
+type headerKey struct{}
+
+// ContextWithHeader returns a context that adds the headers to the HTTP
+// requests of queries sent with it over DNS over HTTPS and the JSON API, on
+// top of any added already, such as to propagate trace context to the
+// upstream. The headers are not sent through Oblivious DNS over HTTPS relays,
+// which would defeat its purpose.
+func ContextWithHeader(ctx context.Context, h http.Header) context.Context {
+	merged := http.Header{}
+	if prev, ok := ctx.Value(headerKey{}).(http.Header); ok {
+		merged = prev.Clone()
+	}
+	for key, values := range h {
+		for _, v := range values {
+			merged.Add(key, v)
+		}
+	}
+	return context.WithValue(ctx, headerKey{}, merged)
+}
+
+// addContextHeader adds the headers of the context, set with
+// ContextWithHeader, to req. It is called before the headers of the protocol
+// are set, so that they cannot be overridden.
+func addContextHeader(req *http.Request) {
+	h, ok := req.Context().Value(headerKey{}).(http.Header)
+	if !ok {
+		return
+	}
+	for key, values := range h {
+		for _, v := range values {
+			req.Header.Add(key, v)
+		}
+	}
+}
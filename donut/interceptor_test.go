@@ -0,0 +1,178 @@
+package donut_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/tomasbasham/donut"
+)
+
+func TestResolver_Interceptors(t *testing.T) {
+	s := newPlainServer(t)
+
+	// answering is an interceptor answering queries without sending them on.
+	answering := func(ctx context.Context, info *donut.ExchangeInfo, query []byte, next donut.ExchangeFunc) ([]byte, error) {
+		return answerA(query, net.IPv4(192, 0, 2, 2), 300), nil
+	}
+
+	question := donut.Question{FQDN: "host.example.", Type: donut.A, Class: donut.IN}
+
+	tests := map[string]struct {
+		resolver  func(interceptors ...donut.Interceptor) *donut.Resolver
+		extra     donut.Interceptor
+		lookups   int
+		exchanges []donut.ExchangeInfo
+		answer    string
+	}{
+		"upstream": {
+			resolver: func(interceptors ...donut.Interceptor) *donut.Resolver {
+				return donut.New(donut.GoogleHost, donut.WithTransport(upstream), donut.WithInterceptors(interceptors...))
+			},
+			lookups: 1,
+			exchanges: []donut.ExchangeInfo{
+				{Question: question, Upstream: donut.GoogleHost, RCode: donut.NoError},
+			},
+			answer: "203.0.113.1",
+		},
+		"cache": {
+			resolver: func(interceptors ...donut.Interceptor) *donut.Resolver {
+				return donut.New(donut.GoogleHost, donut.WithTransport(upstream), donut.WithCache(donut.NewCache(10)), donut.WithInterceptors(interceptors...))
+			},
+			lookups: 2,
+			exchanges: []donut.ExchangeInfo{
+				{Question: question, Cache: "miss", Upstream: donut.GoogleHost, RCode: donut.NoError},
+			},
+			answer: "203.0.113.1",
+		},
+		"upstream that answered": {
+			resolver: func(interceptors ...donut.Interceptor) *donut.Resolver {
+				return donut.New("udp://127.0.0.1:1", donut.WithUpstreams("udp://"+s.addr), donut.WithInterceptors(interceptors...))
+			},
+			lookups: 1,
+			exchanges: []donut.ExchangeInfo{
+				{Question: question, Upstream: "udp://" + s.addr, RCode: donut.NoError},
+			},
+			answer: "192.0.2.1",
+		},
+		"answered by an interceptor": {
+			resolver: func(interceptors ...donut.Interceptor) *donut.Resolver {
+				return donut.New(donut.GoogleHost, donut.WithTransport(upstream), donut.WithInterceptors(interceptors...))
+			},
+			extra:   answering,
+			lookups: 1,
+			exchanges: []donut.ExchangeInfo{
+				{Question: question},
+			},
+			answer: "192.0.2.2",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var calls []string
+			var exchanges []donut.ExchangeInfo
+
+			recording := func(name string) donut.Interceptor {
+				return func(ctx context.Context, info *donut.ExchangeInfo, query []byte, next donut.ExchangeFunc) ([]byte, error) {
+					calls = append(calls, name+" before")
+					resp, err := next(ctx, query)
+					calls = append(calls, name+" after")
+					if name == "outer" {
+						exchanges = append(exchanges, *info)
+					}
+					return resp, err
+				}
+			}
+
+			interceptors := []donut.Interceptor{recording("outer"), recording("inner")}
+			if tt.extra != nil {
+				interceptors = append(interceptors, tt.extra)
+			}
+
+			r := tt.resolver(interceptors...)
+			defer r.Close()
+
+			var answer []donut.Record
+			for range tt.lookups {
+				var err error
+				if answer, err = r.Lookup(question); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := answerStrings(answer); len(got) != 1 || got[0] != tt.answer {
+				t.Errorf("expected %s, got %q", tt.answer, got)
+			}
+
+			expectedCalls := []string{"outer before", "inner before", "inner after", "outer after"}
+			if !slices.Equal(calls, expectedCalls) {
+				t.Errorf("expected calls %q, got %q", expectedCalls, calls)
+			}
+			if !slices.Equal(exchanges, tt.exchanges) {
+				t.Errorf("expected exchanges %+v, got %+v", tt.exchanges, exchanges)
+			}
+		})
+	}
+}
+
+func TestResolver_InterceptorHeader(t *testing.T) {
+	var mu sync.Mutex
+	var headers http.Header
+
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		headers = r.Header.Clone()
+		mu.Unlock()
+
+		query, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(answerA(query, net.IPv4(192, 0, 2, 1), 300))
+	}))
+	defer s.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+
+	// propagating adds trace context as a tracing library would, along with
+	// a header that would break the exchange if it were not ignored.
+	propagating := func(ctx context.Context, info *donut.ExchangeInfo, query []byte, next donut.ExchangeFunc) ([]byte, error) {
+		ctx = donut.ContextWithHeader(ctx, http.Header{
+			"Traceparent":  {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+			"Content-Type": {"text/plain"},
+		})
+		ctx = donut.ContextWithHeader(ctx, http.Header{"tracestate": {"vendor=value"}})
+		return next(ctx, query)
+	}
+
+	r := donut.New(s.URL+"/dns-query", donut.WithTLSConfig(&tls.Config{RootCAs: pool}), donut.WithInterceptors(propagating))
+	defer r.Close()
+
+	if _, err := r.Lookup(donut.Question{FQDN: "host.example.", Type: donut.A, Class: donut.IN}); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for key, expected := range map[string]string{
+		"Traceparent":  "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"Tracestate":   "vendor=value",
+		"Content-Type": "application/dns-message",
+	} {
+		if got := headers.Values(key); len(got) != 1 || got[0] != expected {
+			t.Errorf("expected header %s to be %q, got %q", key, expected, got)
+		}
+	}
+}
@@ -1,27 +1,95 @@
 package cmd
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/spf13/cobra"
 
 	"github.com/tomasbasham/donut"
+	"github.com/tomasbasham/donut/cli-runtime/iooption"
 )
 
 func NewLookupCommand() *cobra.Command {
-	return &cobra.Command{
+	var server, serverName, relay, rootHints, resolvConf, file string
+	var follow, iterative, stub, debug bool
+	var concurrency int
+
+	cmd := &cobra.Command{
 		Use:   "lookup",
 		Short: "Lookup a domain name",
-		Args:  cobra.RangeArgs(1, 2),
+		Args: func(cmd *cobra.Command, args []string) error {
+			// Names read from a file may be followed by the type to look up
+			// those without one for.
+			if file != "" {
+				return cobra.MaximumNArgs(1)(cmd, args)
+			}
+			return cobra.RangeArgs(1, 2)(cmd, args)
+		},
 		Run: func(cmd *cobra.Command, args []string) {
-			resolver := donut.New(donut.GoogleHost)
+			// Nothing is logged unless asked to with --debug, in which case
+			// queries and responses are logged to standard error, so that
+			// they do not mix with the answer. Leaving the logger unset keeps
+			// the resolver silent.
+			logging := donut.WithLogger(nil)
+			if debug {
+				logging = donut.WithDebug()
+			}
+
+			var resolver *donut.Resolver
+			if iterative {
+				resolver = donut.New("", donut.WithIterative(donut.IterativeConfig{RootHints: rootHints}), donut.WithBatchConcurrency(concurrency), logging)
+			} else if stub {
+				conf, err := donut.LoadResolvConf(resolvConf)
+				if err != nil {
+					panic(err)
+				}
+
+				// The name servers of the file are used unless a server is
+				// given explicitly.
+				if !cmd.Flags().Changed("server") {
+					server = ""
+				}
+				resolver = donut.New(server, donut.WithServerName(serverName), donut.WithRelay(relay), donut.WithResolvConf(conf), donut.WithBatchConcurrency(concurrency), logging)
+			} else {
+				resolver = donut.New(server, donut.WithServerName(serverName), donut.WithRelay(relay), donut.WithBatchConcurrency(concurrency), logging)
+			}
+			defer resolver.Close()
+
+			if file != "" {
+				t := donut.A
+				if len(args) == 1 {
+					var err error
+					if t, err = getType(args[0]); err != nil {
+						panic(err)
+					}
+				}
+
+				answers, err := lookupFile(cmd.Context(), resolver, file, t)
+				if err != nil {
+					panic(err)
+				}
+
+				b, err := json.MarshalIndent(answers, "", "  ")
+				if err != nil {
+					panic(err)
+				}
+
+				fmt.Println(string(b))
+				return
+			}
 
 			fqdn := args[0]
 
 			t := donut.A
 			if len(args) == 2 {
-				t = getType(args[1])
+				var err error
+				if t, err = getType(args[1]); err != nil {
+					panic(err)
+				}
 			}
 
 			question := donut.Question{
@@ -30,7 +98,15 @@ func NewLookupCommand() *cobra.Command {
 				Class: donut.IN,
 			}
 
-			answer, err := resolver.Lookup(question)
+			// A chain is shown as the aliases followed and the records they
+			// lead to, rather than as a single answer.
+			var answer any
+			var err error
+			if follow {
+				answer, err = resolver.LookupChain(cmd.Context(), question)
+			} else {
+				answer, err = resolver.LookupContext(cmd.Context(), question)
+			}
 			if err != nil {
 				panic(err)
 			}
@@ -43,29 +119,106 @@ func NewLookupCommand() *cobra.Command {
 			fmt.Println(string(b))
 		},
 	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&server, "server", donut.GoogleHost, "DNS server to query as a URL or sdns:// stamp, e.g. dns.google, tls://1.1.1.1:853 or udp://9.9.9.9")
+	flags.StringVar(&serverName, "tls-server-name", "", "name used to authenticate the server when it differs from the host")
+	flags.StringVar(&relay, "relay", "", "relay to send queries through to an odoh:// server")
+	flags.BoolVar(&iterative, "iterative", false, "resolve the name from the root servers rather than asking the server")
+	flags.StringVar(&rootHints, "root-hints", "", "root hints file in the format of named.root, used with --iterative in place of the built in hints")
+	flags.BoolVar(&stub, "stub", false, "apply the search list and ndots option of the resolv.conf file, asking its name servers unless --server is given")
+	flags.StringVar(&resolvConf, "resolv-conf", donut.DefaultResolvConf, "resolv.conf file used with --stub")
+	flags.StringVar(&file, "file", "", "file of names to look up, one per line and optionally followed by a type, or - to read standard input")
+	flags.IntVar(&concurrency, "concurrency", donut.DefaultBatchConcurrency, "number of names from --file looked up at the same time")
+	flags.BoolVar(&debug, "debug", false, "log the queries sent and responses received to standard error, decoded in the style of dig")
+	flags.BoolVar(&follow, "follow", false, "follow CNAME and DNAME records to the records of the requested type and show the chain")
+
+	// Names read from a file are looked up in a batch, which does not follow
+	// aliases.
+	cmd.MarkFlagsMutuallyExclusive("file", "follow")
+
+	return cmd
+}
+
+// batchAnswer is the outcome of looking up one name read from a file.
+type batchAnswer struct {
+	Name    string           `json:"name"`
+	Type    donut.RecordType `json:"type"`
+	Records []donut.Record   `json:"records"`
+	Error   string           `json:"error,omitempty"`
+}
+
+// lookupFile looks up the names in the named file, or standard input if the
+// name is -, in a single batch. Each line holds a name and optionally its
+// type, which is otherwise t. Blank lines and those starting with # are
+// skipped, and an unknown type fails the whole file before any name is looked
+// up.
+func lookupFile(ctx context.Context, resolver *donut.Resolver, name string, t donut.RecordType) ([]batchAnswer, error) {
+	f, err := iooption.OpenFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var questions []donut.Question
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		q := donut.Question{FQDN: fields[0], Type: t, Class: donut.IN}
+		if len(fields) > 1 {
+			if q.Type, err = getType(fields[1]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+			}
+		}
+		questions = append(questions, q)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	results := resolver.LookupBatch(ctx, questions)
+
+	answers := make([]batchAnswer, len(results))
+	for i, res := range results {
+		answers[i] = batchAnswer{Name: res.Question.FQDN, Type: res.Question.Type, Records: res.Records}
+		if res.Err != nil {
+			answers[i].Error = res.Err.Error()
+		}
+	}
+
+	return answers, nil
 }
 
-func getType(s string) donut.RecordType {
-	switch s {
+// getType returns the record type with the mnemonic s, in any case.
+func getType(s string) (donut.RecordType, error) {
+	switch strings.ToUpper(s) {
 	case "A":
-		return donut.A
+		return donut.A, nil
 	case "AAAA":
-		return donut.AAAA
+		return donut.AAAA, nil
 	case "CNAME":
-		return donut.CNAME
+		return donut.CNAME, nil
+	case "DNAME":
+		return donut.DNAME, nil
 	case "MX":
-		return donut.MX
+		return donut.MX, nil
 	case "NS":
-		return donut.NS
+		return donut.NS, nil
 	case "PTR":
-		return donut.PTR
+		return donut.PTR, nil
 	case "SOA":
-		return donut.SOA
+		return donut.SOA, nil
 	case "SRV":
-		return donut.SRV
+		return donut.SRV, nil
 	case "TXT":
-		return donut.TXT
+		return donut.TXT, nil
 	default:
-		return donut.A
+		return 0, fmt.Errorf("unknown record type %q", s)
 	}
 }
@@ -2,11 +2,17 @@ package cmd
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io/fs"
 	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 
@@ -16,11 +22,39 @@ import (
 const maxBufferSize = 1024
 
 func NewProxyCommand() *cobra.Command {
-	return &cobra.Command{
+	var upstreams []string
+	var relay, strategyName string
+	var cacheSize int
+	var cacheMaxTTL, cacheMaxNegativeTTL, cacheServeStale, cacheStaleTimeout time.Duration
+	var cachePrefetch int
+	var cacheFile string
+	var maxAttempts int
+	var bootstrapAddrs, bootstrapServers, pinFlags []string
+	var rootCAFile, clientCertFile, clientKeyFile string
+	var hostsFile, logLevel, adminAddr string
+	var staticHosts []string
+	var attemptTimeout time.Duration
+	var cacheSaveInterval time.Duration
+
+	cmd := &cobra.Command{
 		Use:   "proxy",
 		Short: "Run a DNS proxy server",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			h := slog.NewJSONHandler(os.Stdout, nil)
+			strategy, err := donut.ParseStrategy(strategyName)
+			if err != nil {
+				return err
+			}
+
+			if len(upstreams) == 0 {
+				return errors.New("at least one upstream is required")
+			}
+
+			var level slog.Level
+			if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+				return fmt.Errorf("invalid log level: %w", err)
+			}
+
+			h := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})
 			logger := slog.New(h)
 			logger.Info("starting DNS proxy server")
 
@@ -42,21 +76,121 @@ func NewProxyCommand() *cobra.Command {
 			ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 			defer stop()
 
-			buf := make([]byte, maxBufferSize)
+			// The cache is created here rather than by the resolver so that it
+			// can be saved to and loaded from a snapshot.
+			var cache *donut.Cache
+			if cacheSize > 0 {
+				cache = donut.NewCache(cacheSize,
+					donut.WithCacheMaxTTL(cacheMaxTTL),
+					donut.WithCacheMaxNegativeTTL(cacheMaxNegativeTTL),
+					donut.WithCacheServeStale(cacheServeStale),
+					donut.WithCacheStaleAnswerTimeout(cacheStaleTimeout),
+					donut.WithCachePrefetch(cachePrefetch))
+			}
+
+			// Warm the cache from the last snapshot so that a restart does not
+			// send every client query to the upstream at once.
+			if cache != nil && cacheFile != "" {
+				if err := loadCache(cache, cacheFile); err != nil {
+					logger.Error("failed to load cache: " + err.Error())
+				}
+
+				go func() {
+					ticker := time.NewTicker(cacheSaveInterval)
+					defer ticker.Stop()
+
+					for {
+						select {
+						case <-ticker.C:
+						case <-ctx.Done():
+							return
+						}
+
+						if err := saveCache(cache, cacheFile); err != nil {
+							logger.Error("failed to save cache: " + err.Error())
+						}
+					}
+				}()
+
+				defer func() {
+					if err := saveCache(cache, cacheFile); err != nil {
+						logger.Error("failed to save cache: " + err.Error())
+					}
+				}()
+			}
+
+			retry := donut.DefaultRetryPolicy
+			retry.MaxAttempts = maxAttempts
+			retry.AttemptTimeout = attemptTimeout
+
+			bootstrap, err := parseHostValues(bootstrapAddrs)
+			if err != nil {
+				return fmt.Errorf("invalid bootstrap address: %w", err)
+			}
+
+			pins, err := parseHostValues(pinFlags)
+			if err != nil {
+				return fmt.Errorf("invalid pin: %w", err)
+			}
+
+			tlsConfig, err := loadTLSConfig(rootCAFile, clientCertFile, clientKeyFile)
+			if err != nil {
+				return err
+			}
+
+			static, err := parseHostValues(staticHosts)
+			if err != nil {
+				return fmt.Errorf("invalid host: %w", err)
+			}
+
+			// Metrics are only recorded when there is somewhere to serve them.
+			metrics := donut.WithMetrics(nil)
+			if adminAddr != "" {
+				m := donut.NewPrometheusMetrics()
+				if err := serveAdmin(ctx, logger, adminAddr, m); err != nil {
+					return err
+				}
+				metrics = donut.WithMetrics(m)
+			}
+
+			// A single resolver serves every request so that connections to
+			// the upstream, and the TLS sessions to resume them, are reused.
+			resolver := donut.New(upstreams[0],
+				donut.WithUpstreams(upstreams[1:]...),
+				donut.WithStrategy(strategy),
+				donut.WithRetry(retry),
+				donut.WithRelay(relay),
+				donut.WithCache(cache),
+				donut.WithBootstrapServers(bootstrapServers...),
+				donut.WithBootstrap(bootstrap),
+				donut.WithTLSConfig(tlsConfig),
+				donut.WithPins(pins),
+				donut.WithHosts(donut.HostsConfig{File: hostsFile, Static: static}),
+				donut.WithLogger(logger),
+				metrics)
+			defer resolver.Close()
 
 			// Given that waiting for packets to arrive is blocking by nature and we
 			// want to be able of canceling such action if desired, we do that in a
 			// separate go routine.
 			go func() {
+				buf := make([]byte, maxBufferSize)
 				for {
 					n, addr, err := conn.ReadFromUDP(buf)
 					if err != nil {
+						if ctx.Err() != nil {
+							return
+						}
 						logger.Error("failed to read from UDP connection: " + err.Error())
 						continue
 					}
 
+					// The buffer is reused for the next packet, so the request
+					// gets a copy of its own.
+					query := append([]byte(nil), buf[:n]...)
+
 					// handle the request
-					go handleRequest(conn, addr, buf[:n])
+					go handleRequest(cmd.Context(), logger, conn, addr, query, resolver)
 				}
 			}()
 
@@ -64,21 +198,113 @@ func NewProxyCommand() *cobra.Command {
 			return nil
 		},
 	}
+
+	flags := cmd.Flags()
+	flags.StringSliceVar(&upstreams, "upstream", []string{donut.GoogleHost}, "DNS server to forward queries to as a URL or sdns:// stamp, e.g. dns.google, tls://1.1.1.1:853 or udp://9.9.9.9, repeated to use several")
+	flags.StringVar(&strategyName, "strategy", donut.Failover.String(), "how to spread queries between upstreams: failover, random, round-robin, fastest or race")
+	flags.IntVar(&maxAttempts, "max-attempts", 1, "number of times to send a query that fails with a network error, 5xx status or SERVFAIL")
+	flags.DurationVar(&attemptTimeout, "attempt-timeout", 2*time.Second, "how long to wait for the upstream on each attempt, or 0 for no limit")
+	flags.StringArrayVar(&bootstrapAddrs, "bootstrap", nil, "address of an upstream host as host=ip, repeated for each address, so that it is not resolved by the system")
+	flags.StringSliceVar(&bootstrapServers, "bootstrap-server", nil, "plain DNS server used to resolve upstream hosts instead of the system resolver, e.g. 9.9.9.9:53")
+	flags.StringVar(&rootCAFile, "root-ca", "", "PEM file of the certificate authorities trusted to sign upstream certificates, instead of those of the system")
+	flags.StringVar(&clientCertFile, "client-cert", "", "PEM file of the certificate presented to upstreams asking for one")
+	flags.StringVar(&clientKeyFile, "client-key", "", "PEM file of the private key of the client certificate")
+	flags.StringArrayVar(&pinFlags, "pin", nil, "public key an upstream host must present as host=sha256/base64, repeated for each pin")
+	flags.StringVar(&logLevel, "log-level", "info", "level of the events logged: debug, info, warn or error, with every query and response logged at debug")
+	flags.StringVar(&adminAddr, "admin-addr", "", "address to serve Prometheus metrics on at /metrics, e.g. localhost:9153, or empty to disable")
+	flags.StringVar(&hostsFile, "hosts", "", "file in the format of /etc/hosts whose names are answered locally rather than forwarded, read again when it changes")
+	flags.StringArrayVar(&staticHosts, "host", nil, "address a name is answered with locally as name=ip, repeated for each address, overriding the hosts file")
+	flags.StringVar(&relay, "relay", "", "relay to send queries through to an odoh:// upstream")
+	flags.IntVar(&cacheSize, "cache-size", 0, "number of responses to cache, or 0 to disable caching")
+	flags.DurationVar(&cacheMaxTTL, "cache-max-ttl", 0, "longest time to cache a response for, or 0 for no limit")
+	flags.DurationVar(&cacheMaxNegativeTTL, "cache-max-negative-ttl", 3*time.Hour, "longest time to cache a response for a name or type that does not exist, or 0 to disable negative caching")
+	flags.DurationVar(&cacheServeStale, "cache-serve-stale", 0, "how long after expiry to serve a cached response when the upstream fails, or 0 to disable serving stale responses")
+	flags.DurationVar(&cacheStaleTimeout, "cache-stale-answer-timeout", 1800*time.Millisecond, "how long to wait for the upstream before serving a stale response")
+	flags.IntVar(&cachePrefetch, "cache-prefetch", 0, "number of hits after which a response is refreshed before it expires, or 0 to disable prefetching")
+	flags.StringVar(&cacheFile, "cache-file", "", "file to save the cache to on shutdown and periodically, and to load it from on startup")
+	flags.DurationVar(&cacheSaveInterval, "cache-save-interval", 5*time.Minute, "how often to save the cache to the cache file")
+
+	return cmd
 }
 
-func handleRequest(conn *net.UDPConn, addr *net.UDPAddr, buf []byte) {
-	resolver := donut.New(donut.GoogleHost)
-	message, err := resolver.LookupRaw(buf)
+func handleRequest(ctx context.Context, logger *slog.Logger, conn *net.UDPConn, addr *net.UDPAddr, query []byte, resolver *donut.Resolver) {
+	message, err := resolver.LookupRawContext(ctx, query)
 	if err != nil {
-		panic(err)
+		logger.Error("failed to look up query: " + err.Error())
+		return
 	}
 
 	b, err := conn.WriteTo(message, addr)
 	if err != nil {
-		panic(err)
+		logger.Error("failed to write response: " + err.Error())
+		return
 	}
 
 	if b != len(message) {
-		panic("message not sent")
+		logger.Error("message not sent")
+	}
+}
+
+// serveAdmin serves the metrics over HTTP on addr until ctx is done.
+func serveAdmin(ctx context.Context, logger *slog.Logger, addr string, metrics http.Handler) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on admin address: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("failed to serve admin requests: " + err.Error())
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	return nil
+}
+
+// loadCache warms the cache from the snapshot in the named file, if it exists.
+func loadCache(cache *donut.Cache, name string) error {
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return cache.Load(f)
+}
+
+// saveCache writes a snapshot of the cache to the named file. The snapshot is
+// written to a temporary file first so that a crash never leaves a partial
+// snapshot behind.
+func saveCache(cache *donut.Cache, name string) error {
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := cache.Save(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
 	}
+
+	return os.Rename(f.Name(), name)
 }
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// loadTLSConfig returns the TLS configuration for connecting to upstreams
+// with the given root CA and client certificate files, or nil if none are
+// given.
+func loadTLSConfig(rootCAFile, certFile, keyFile string) (*tls.Config, error) {
+	if rootCAFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+
+	if rootCAFile != "" {
+		pem, err := os.ReadFile(rootCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", rootCAFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("a client certificate needs both a certificate and a key file")
+		}
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// parseHostValues parses flags of the form host=value into the values for
+// each host.
+func parseHostValues(flags []string) (map[string][]string, error) {
+	values := make(map[string][]string)
+	for _, flag := range flags {
+		host, value, ok := strings.Cut(flag, "=")
+		if !ok || host == "" || value == "" {
+			return nil, fmt.Errorf("%q, expected host=value", flag)
+		}
+		values[host] = append(values[host], value)
+	}
+	return values, nil
+}
@@ -0,0 +1,216 @@
+// Package hpke implements the base mode of Hybrid Public Key Encryption as
+// described in https://datatracker.ietf.org/doc/html/rfc9180
+//
+// Only the DHKEM(X25519, HKDF-SHA256), HKDF-SHA256 and AES-128-GCM suite is
+// supported, being the one required by Oblivious DNS over HTTPS.
+package hpke
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Algorithm identifiers as registered in
+// https://datatracker.ietf.org/doc/html/rfc9180#section-7
+const (
+	KEMX25519HKDFSHA256 uint16 = 0x0020
+	KDFHKDFSHA256       uint16 = 0x0001
+	AEADAES128GCM       uint16 = 0x0001
+)
+
+// Sizes of the keys, nonces and hashes used by the supported suite.
+const (
+	Nk      = 16
+	Nn      = 12
+	Nh      = sha256.Size
+	Nsecret = 32
+)
+
+var errMessageLimit = errors.New("hpke: message limit reached")
+
+// Context is an encryption context established between a sender and a
+// receiver.
+type Context struct {
+	aead           cipher.AEAD
+	baseNonce      []byte
+	seq            uint64
+	exporterSecret []byte
+}
+
+// SetupBaseS establishes a context for sending messages to the holder of the
+// private key for the public key pkR. It returns the encapsulated key that
+// the receiver needs to establish the matching context.
+func SetupBaseS(pkR, info []byte) ([]byte, *Context, error) {
+	skE, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pub, err := ecdh.X25519().NewPublicKey(pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dh, err := skE.ECDH(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	enc := skE.PublicKey().Bytes()
+	sharedSecret := extractAndExpand(dh, append(append([]byte(nil), enc...), pkR...))
+
+	ctx, err := keySchedule(sharedSecret, info)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return enc, ctx, nil
+}
+
+// SetupBaseR establishes the context for receiving messages from a sender that
+// produced the encapsulated key enc.
+func SetupBaseR(enc []byte, skR *ecdh.PrivateKey, info []byte) (*Context, error) {
+	pub, err := ecdh.X25519().NewPublicKey(enc)
+	if err != nil {
+		return nil, err
+	}
+
+	dh, err := skR.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	pkR := skR.PublicKey().Bytes()
+	sharedSecret := extractAndExpand(dh, append(append([]byte(nil), enc...), pkR...))
+
+	return keySchedule(sharedSecret, info)
+}
+
+// Seal encrypts and authenticates the plaintext pt, along with the additional
+// data aad.
+func (c *Context) Seal(aad, pt []byte) ([]byte, error) {
+	nonce, err := c.nextNonce()
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nil, nonce, pt, aad), nil
+}
+
+// Open decrypts the ciphertext ct and verifies it, along with the additional
+// data aad.
+func (c *Context) Open(aad, ct []byte) ([]byte, error) {
+	nonce, err := c.nextNonce()
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Open(nil, nonce, ct, aad)
+}
+
+// Export derives a secret of length l from the context, bound to
+// exporterContext.
+func (c *Context) Export(exporterContext []byte, l int) []byte {
+	return labeledExpand(hpkeSuiteID, c.exporterSecret, "sec", exporterContext, l)
+}
+
+func (c *Context) nextNonce() ([]byte, error) {
+	if c.seq == math.MaxUint64 {
+		return nil, errMessageLimit
+	}
+
+	nonce := append([]byte(nil), c.baseNonce...)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], c.seq)
+	for i := range seq {
+		nonce[Nn-8+i] ^= seq[i]
+	}
+
+	c.seq++
+	return nonce, nil
+}
+
+var (
+	kemSuiteID  = []byte{'K', 'E', 'M', 0x00, 0x20}
+	hpkeSuiteID = []byte{'H', 'P', 'K', 'E', 0x00, 0x20, 0x00, 0x01, 0x00, 0x01}
+)
+
+func extractAndExpand(dh, kemContext []byte) []byte {
+	prk := labeledExtract(kemSuiteID, nil, "eae_prk", dh)
+	return labeledExpand(kemSuiteID, prk, "shared_secret", kemContext, Nsecret)
+}
+
+func keySchedule(sharedSecret, info []byte) (*Context, error) {
+	pskIDHash := labeledExtract(hpkeSuiteID, nil, "psk_id_hash", nil)
+	infoHash := labeledExtract(hpkeSuiteID, nil, "info_hash", info)
+
+	// The context starts with the mode, which is 0 for the base mode.
+	ksc := append([]byte{0x00}, pskIDHash...)
+	ksc = append(ksc, infoHash...)
+
+	secret := labeledExtract(hpkeSuiteID, sharedSecret, "secret", nil)
+	key := labeledExpand(hpkeSuiteID, secret, "key", ksc, Nk)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Context{
+		aead:           aead,
+		baseNonce:      labeledExpand(hpkeSuiteID, secret, "base_nonce", ksc, Nn),
+		exporterSecret: labeledExpand(hpkeSuiteID, secret, "exp", ksc, Nh),
+	}, nil
+}
+
+func labeledExtract(suiteID, salt []byte, label string, ikm []byte) []byte {
+	labeled := append([]byte("HPKE-v1"), suiteID...)
+	labeled = append(labeled, label...)
+	labeled = append(labeled, ikm...)
+	return Extract(salt, labeled)
+}
+
+func labeledExpand(suiteID, prk []byte, label string, info []byte, l int) []byte {
+	labeled := binary.BigEndian.AppendUint16(nil, uint16(l))
+	labeled = append(labeled, "HPKE-v1"...)
+	labeled = append(labeled, suiteID...)
+	labeled = append(labeled, label...)
+	labeled = append(labeled, info...)
+	return Expand(prk, labeled, l)
+}
+
+// Extract is the HKDF-Extract function of
+// https://datatracker.ietf.org/doc/html/rfc5869 using SHA-256.
+func Extract(salt, ikm []byte) []byte {
+	if len(salt) == 0 {
+		salt = make([]byte, Nh)
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+// Expand is the HKDF-Expand function of
+// https://datatracker.ietf.org/doc/html/rfc5869 using SHA-256.
+func Expand(prk, info []byte, l int) []byte {
+	var out, t []byte
+	for i := byte(1); len(out) < l; i++ {
+		mac := hmac.New(sha256.New, prk)
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:l]
+}
@@ -0,0 +1,85 @@
+package hpke_test
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/hex"
+	"testing"
+
+	"github.com/tomasbasham/donut/internal/hpke"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestSetupBaseR uses the test vector from
+// https://datatracker.ietf.org/doc/html/rfc9180#appendix-A.1.1
+func TestSetupBaseR(t *testing.T) {
+	skR, err := ecdh.X25519().NewPrivateKey(decodeHex(t, "4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc := decodeHex(t, "37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431")
+	info := decodeHex(t, "4f6465206f6e2061204772656369616e2055726e")
+
+	ctx, err := hpke.SetupBaseR(enc, skR, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pt, err := ctx.Open(
+		decodeHex(t, "436f756e742d30"),
+		decodeHex(t, "f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := decodeHex(t, "4265617574792069732074727574682c20747275746820626561757479"); !bytes.Equal(pt, want) {
+		t.Errorf("expected %x, got %x", want, pt)
+	}
+}
+
+func TestContext_SealOpen(t *testing.T) {
+	skR, err := ecdh.X25519().NewPrivateKey(bytes.Repeat([]byte{0x42}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc, sender, err := hpke.SetupBaseS(skR.PublicKey().Bytes(), []byte("info"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := hpke.SetupBaseR(enc, skR, []byte("info"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range []string{"first", "second"} {
+		ct, err := sender.Seal([]byte("aad"), []byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pt, err := receiver.Open([]byte("aad"), ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(pt) != msg {
+			t.Errorf("expected %q, got %q", msg, pt)
+		}
+	}
+
+	if !bytes.Equal(sender.Export([]byte("ctx"), 16), receiver.Export([]byte("ctx"), 16)) {
+		t.Error("expected sender and receiver to export the same secret")
+	}
+}
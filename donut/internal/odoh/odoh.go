@@ -0,0 +1,347 @@
+// Package odoh implements the message formats and encryption of Oblivious DNS
+// over HTTPS as described in https://datatracker.ietf.org/doc/html/rfc9230
+package odoh
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/tomasbasham/donut/internal/hpke"
+)
+
+// ContentType is the media type of encrypted queries and responses.
+const ContentType = "application/oblivious-dns-message"
+
+// version is the only configuration version defined by RFC 9230.
+const version uint16 = 0x0001
+
+// Message types of an ObliviousDoHMessage.
+const (
+	messageTypeQuery    byte = 0x01
+	messageTypeResponse byte = 0x02
+)
+
+// paddingBlock is the size to which plaintext queries are padded, hiding
+// their exact length from the target's network.
+const paddingBlock = 128
+
+var errInvalidMessage = errors.New("odoh: invalid message")
+
+// Config is the public key configuration of an Oblivious DoH target.
+type Config struct {
+	KEM       uint16
+	KDF       uint16
+	AEAD      uint16
+	PublicKey []byte
+}
+
+// ParseConfigs decodes the ObliviousDoHConfigs published by a target,
+// returning the configurations using a version and suite that we support.
+func ParseConfigs(b []byte) ([]Config, error) {
+	configs, rest, ok := readVector(b)
+	if !ok || len(rest) != 0 {
+		return nil, errors.New("odoh: invalid configs")
+	}
+
+	var supported []Config
+	for len(configs) > 0 {
+		if len(configs) < 2 {
+			return nil, errors.New("odoh: invalid configs")
+		}
+
+		v := binary.BigEndian.Uint16(configs)
+		contents, next, ok := readVector(configs[2:])
+		if !ok {
+			return nil, errors.New("odoh: invalid configs")
+		}
+		configs = next
+
+		// Configurations of unknown versions must be skipped.
+		if v != version {
+			continue
+		}
+
+		config, ok := parseConfigContents(contents)
+		if ok && config.supported() {
+			supported = append(supported, config)
+		}
+	}
+
+	if len(supported) == 0 {
+		return nil, errors.New("odoh: no supported configs")
+	}
+
+	return supported, nil
+}
+
+func parseConfigContents(b []byte) (Config, bool) {
+	if len(b) < 6 {
+		return Config{}, false
+	}
+
+	key, rest, ok := readVector(b[6:])
+	if !ok || len(rest) != 0 {
+		return Config{}, false
+	}
+
+	return Config{
+		KEM:       binary.BigEndian.Uint16(b[0:2]),
+		KDF:       binary.BigEndian.Uint16(b[2:4]),
+		AEAD:      binary.BigEndian.Uint16(b[4:6]),
+		PublicKey: key,
+	}, true
+}
+
+func (c Config) supported() bool {
+	return c.KEM == hpke.KEMX25519HKDFSHA256 && c.KDF == hpke.KDFHKDFSHA256 && c.AEAD == hpke.AEADAES128GCM
+}
+
+// contents encodes the ObliviousDoHConfigContents.
+func (c Config) contents() []byte {
+	b := binary.BigEndian.AppendUint16(nil, c.KEM)
+	b = binary.BigEndian.AppendUint16(b, c.KDF)
+	b = binary.BigEndian.AppendUint16(b, c.AEAD)
+	return appendVector(b, c.PublicKey)
+}
+
+// KeyID returns the identifier of the configuration's key, as described in
+// https://datatracker.ietf.org/doc/html/rfc9230#section-6.2
+func (c Config) KeyID() []byte {
+	return hpke.Expand(hpke.Extract(nil, c.contents()), []byte("odoh key id"), hpke.Nh)
+}
+
+// MarshalConfigs encodes configurations as ObliviousDoHConfigs.
+func MarshalConfigs(configs ...Config) []byte {
+	var b []byte
+	for _, c := range configs {
+		b = binary.BigEndian.AppendUint16(b, version)
+		b = appendVector(b, c.contents())
+	}
+	return appendVector(nil, b)
+}
+
+// QueryContext holds the state needed to decrypt the response to a query.
+type QueryContext struct {
+	plaintext []byte
+	hpke      *hpke.Context
+}
+
+// EncryptQuery encrypts a DNS query for the target with this configuration,
+// returning the encoded ObliviousDoHMessage.
+func (c Config) EncryptQuery(query []byte) ([]byte, *QueryContext, error) {
+	if !c.supported() {
+		return nil, nil, errors.New("odoh: unsupported config")
+	}
+
+	enc, ctx, err := hpke.SetupBaseS(c.PublicKey, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	padding := (paddingBlock - len(query)%paddingBlock) % paddingBlock
+	plaintext := appendVector(nil, query)
+	plaintext = appendVector(plaintext, make([]byte, padding))
+
+	keyID := c.KeyID()
+	ct, err := ctx.Seal(aad(messageTypeQuery, keyID), plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	msg := marshalMessage(messageTypeQuery, keyID, append(enc, ct...))
+	return msg, &QueryContext{plaintext: plaintext, hpke: ctx}, nil
+}
+
+// DecryptResponse decrypts the ObliviousDoHMessage received in response to
+// the query, returning the DNS response.
+func (q *QueryContext) DecryptResponse(b []byte) ([]byte, error) {
+	typ, nonce, ct, err := parseMessage(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if typ != messageTypeResponse {
+		return nil, errInvalidMessage
+	}
+
+	aead, key, err := q.responseKey(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := aead.Open(nil, key, ct, aad(messageTypeResponse, nonce))
+	if err != nil {
+		return nil, fmt.Errorf("odoh: decrypting response: %w", err)
+	}
+
+	return unpad(plaintext)
+}
+
+// responseKey derives the AEAD and nonce protecting a response, as described
+// in https://datatracker.ietf.org/doc/html/rfc9230#section-6.4
+func (q *QueryContext) responseKey(responseNonce []byte) (cipher.AEAD, []byte, error) {
+	secret := q.hpke.Export([]byte("odoh response"), hpke.Nk)
+
+	salt := append(append([]byte(nil), q.plaintext...), appendVector(nil, responseNonce)...)
+	prk := hpke.Extract(salt, secret)
+
+	block, err := aes.NewCipher(hpke.Expand(prk, []byte("odoh key"), hpke.Nk))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return aead, hpke.Expand(prk, []byte("odoh nonce"), hpke.Nn), nil
+}
+
+// KeyPair is the private key of a target along with its configuration.
+type KeyPair struct {
+	Config     Config
+	privateKey *ecdh.PrivateKey
+}
+
+// GenerateKeyPair creates a new key pair for a target.
+func GenerateKeyPair() (*KeyPair, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyPair{
+		Config: Config{
+			KEM:       hpke.KEMX25519HKDFSHA256,
+			KDF:       hpke.KDFHKDFSHA256,
+			AEAD:      hpke.AEADAES128GCM,
+			PublicKey: key.PublicKey().Bytes(),
+		},
+		privateKey: key,
+	}, nil
+}
+
+// DecryptQuery decrypts an ObliviousDoHMessage holding a query, returning the
+// DNS query and the context needed to encrypt the response.
+func (k *KeyPair) DecryptQuery(b []byte) ([]byte, *QueryContext, error) {
+	typ, keyID, encrypted, err := parseMessage(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if typ != messageTypeQuery || len(encrypted) < 32 {
+		return nil, nil, errInvalidMessage
+	}
+
+	ctx, err := hpke.SetupBaseR(encrypted[:32], k.privateKey, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plaintext, err := ctx.Open(aad(messageTypeQuery, keyID), encrypted[32:])
+	if err != nil {
+		return nil, nil, fmt.Errorf("odoh: decrypting query: %w", err)
+	}
+
+	query, err := unpad(plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return query, &QueryContext{plaintext: plaintext, hpke: ctx}, nil
+}
+
+// EncryptResponse encrypts the DNS response to the query, returning the
+// encoded ObliviousDoHMessage.
+func (q *QueryContext) EncryptResponse(resp []byte) ([]byte, error) {
+	nonce := make([]byte, max(hpke.Nn, hpke.Nk))
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	aead, key, err := q.responseKey(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := appendVector(nil, resp)
+	plaintext = appendVector(plaintext, nil)
+
+	ct := aead.Seal(nil, key, plaintext, aad(messageTypeResponse, nonce))
+	return marshalMessage(messageTypeResponse, nonce, ct), nil
+}
+
+func aad(typ byte, keyID []byte) []byte {
+	return appendVector([]byte{typ}, keyID)
+}
+
+func marshalMessage(typ byte, keyID, encrypted []byte) []byte {
+	b := appendVector([]byte{typ}, keyID)
+	return appendVector(b, encrypted)
+}
+
+func parseMessage(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 1 {
+		return 0, nil, nil, errInvalidMessage
+	}
+
+	keyID, rest, ok := readVector(b[1:])
+	if !ok {
+		return 0, nil, nil, errInvalidMessage
+	}
+
+	encrypted, rest, ok := readVector(rest)
+	if !ok || len(rest) != 0 {
+		return 0, nil, nil, errInvalidMessage
+	}
+
+	return b[0], keyID, encrypted, nil
+}
+
+// unpad returns the DNS message from an ObliviousDoHMessagePlaintext, checking
+// that the padding is all zeros.
+func unpad(plaintext []byte) ([]byte, error) {
+	msg, rest, ok := readVector(plaintext)
+	if !ok {
+		return nil, errInvalidMessage
+	}
+
+	padding, rest, ok := readVector(rest)
+	if !ok || len(rest) != 0 {
+		return nil, errInvalidMessage
+	}
+
+	for _, b := range padding {
+		if b != 0 {
+			return nil, errInvalidMessage
+		}
+	}
+
+	return msg, nil
+}
+
+// readVector reads a vector with a two octet length prefix from b, returning
+// its contents and the remainder of b.
+func readVector(b []byte) ([]byte, []byte, bool) {
+	if len(b) < 2 {
+		return nil, nil, false
+	}
+
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return nil, nil, false
+	}
+
+	return b[2 : 2+n], b[2+n:], true
+}
+
+func appendVector(b, v []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+	return append(b, v...)
+}
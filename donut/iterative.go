@@ -0,0 +1,549 @@
+package donut
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// iterativeTimeout bounds each query sent to an authoritative server, so
+	// that an unresponsive server leaves time to try the others.
+	iterativeTimeout = 2 * time.Second
+
+	// iterativeUDPSize is the UDP payload size advertised to authoritative
+	// servers, as recommended by https://www.dnsflagday.net/2020/
+	iterativeUDPSize = 1232
+
+	// maxIterativeQueries bounds the queries sent to resolve a single
+	// question, including those needed to find the addresses of name servers
+	// and to follow aliases, so that a maliciously configured zone cannot
+	// make us send an unbounded number of them.
+	maxIterativeQueries = 100
+
+	// maxIterativeDepth bounds how deeply lookups may nest to find the
+	// addresses of name servers without glue.
+	maxIterativeDepth = 6
+
+	// maxReferrals bounds the zone cuts followed to resolve a single name.
+	maxReferrals = 32
+
+	// maxMinimisedQueries is the most queries sent with a minimised name
+	// before sending the full name, which stops a name of many labels from
+	// costing one query per label, as described in
+	// https://datatracker.ietf.org/doc/html/rfc9156#section-2.3
+	maxMinimisedQueries = 10
+
+	// maxDelegations bounds the zone cuts remembered between questions.
+	maxDelegations = 10000
+)
+
+// IterativeConfig configures resolving names iteratively, set with
+// WithIterative.
+type IterativeConfig struct {
+	// RootHints names a file of root hints in the format of named.root. The
+	// root servers published by IANA are used when empty.
+	RootHints string
+
+	// Port is the port authoritative servers are queried on, which is 53
+	// unless set. Other ports are only of use for testing.
+	Port string
+
+	// DisableQNAMEMinimisation sends the full name asked for to every server,
+	// rather than only as much of it as each needs to see, as described in
+	// https://datatracker.ietf.org/doc/html/rfc9156
+	DisableQNAMEMinimisation bool
+}
+
+// iterativeTransport answers queries by resolving them itself, starting from
+// the root servers and following referrals down to the servers authoritative
+// for the name, as described in
+// https://datatracker.ietf.org/doc/html/rfc1034#section-5.3.3
+type iterativeTransport struct {
+	resolver *Resolver
+	roots    []nameserver
+	port     string
+	minimise bool
+	now      func() time.Time
+
+	mu          sync.Mutex
+	servers     map[string]*udpTransport
+	delegations map[string]delegation
+}
+
+// delegation is a zone cut learnt from a referral.
+type delegation struct {
+	servers []nameserver
+	expires time.Time
+}
+
+func (r *Resolver) newIterativeTransport(c IterativeConfig) (*iterativeTransport, error) {
+	roots, err := loadRootHints(c.RootHints)
+	if err != nil {
+		return nil, err
+	}
+
+	port := c.Port
+	if port == "" {
+		port = defaultPorts["udp"]
+	}
+
+	return &iterativeTransport{
+		resolver:    r,
+		roots:       roots,
+		port:        port,
+		minimise:    !c.DisableQNAMEMinimisation,
+		now:         time.Now,
+		servers:     make(map[string]*udpTransport),
+		delegations: make(map[string]delegation),
+	}, nil
+}
+
+func (t *iterativeTransport) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	m := message{query}
+	req, err := m.unpack()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(req.Questions) != 1 {
+		return nil, errors.New("iterative resolution supports exactly one question per query")
+	}
+
+	q := req.Questions[0]
+	q.FQDN = fqdn(q.FQDN)
+
+	resp := &Message{
+		ID:                 req.ID,
+		Response:           true,
+		RecursionDesired:   req.RecursionDesired,
+		RecursionAvailable: true,
+		Questions:          req.Questions,
+	}
+
+	s := &resolution{transport: t, budget: maxIterativeQueries}
+
+	msg, err := s.resolve(ctx, q, 0)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		// The reason for the failure is given as an extended DNS error, so
+		// that it is not lost on the client.
+		resp.RCode = ServFail
+		resp.echoOPT(req, iterativeUDPSize, err.Error())
+		return resp.Pack()
+	}
+
+	resp.RCode = msg.RCode
+	resp.Answers = msg.Answers
+
+	// Only the SOA record of a negative response is passed on, which is
+	// needed to cache it.
+	for _, rr := range msg.Authority {
+		if rr.Type == SOA {
+			resp.Authority = append(resp.Authority, rr)
+		}
+	}
+
+	resp.echoOPT(req, iterativeUDPSize, "")
+
+	return resp.Pack()
+}
+
+// Close closes any TCP connections to authoritative servers.
+func (t *iterativeTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var errs []error
+	for _, server := range t.servers {
+		errs = append(errs, server.Close())
+	}
+	clear(t.servers)
+
+	return errors.Join(errs...)
+}
+
+// exchange sends a question to the authoritative server at addr, without
+// asking it to recurse.
+func (t *iterativeTransport) exchange(ctx context.Context, addr string, q Question) (*Message, error) {
+	t.mu.Lock()
+	server, ok := t.servers[addr]
+	if !ok {
+		server = newUDPTransport(endpoint{scheme: "udp", host: addr, port: t.port}, t.resolver.dialContext)
+		t.servers[addr] = server
+	}
+	t.mu.Unlock()
+
+	query, err := (&Message{
+		Questions:  []Question{q},
+		Additional: []Record{newOPT(iterativeUDPSize, false, "")},
+	}).Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, iterativeTimeout)
+	defer cancel()
+
+	resp, err := server.Exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	m := message{resp}
+	return m.unpack()
+}
+
+// closest returns the deepest zone cut known above or at name, along with a
+// copy of its servers. The root is the zone cut of last resort.
+func (t *iterativeTransport) closest(name string) (string, []nameserver) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	for zone := name; zone != "."; zone = parentName(zone) {
+		d, ok := t.delegations[zone]
+		if !ok {
+			continue
+		}
+		if now.After(d.expires) {
+			delete(t.delegations, zone)
+			continue
+		}
+		return zone, cloneNameservers(d.servers)
+	}
+
+	return ".", cloneNameservers(t.roots)
+}
+
+// delegate remembers the servers of a zone for as long as its NS records may
+// be cached.
+func (t *iterativeTransport) delegate(zone string, servers []nameserver, ttl uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Remembering zone cuts only saves queries, so forgetting all of them is
+	// a simple way to bound their memory.
+	if len(t.delegations) >= maxDelegations {
+		clear(t.delegations)
+	}
+
+	t.delegations[zone] = delegation{
+		servers: cloneNameservers(servers),
+		expires: t.now().Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// resolution is the state of resolving a single question, shared by the
+// lookups made along the way.
+type resolution struct {
+	transport *iterativeTransport
+	budget    int
+}
+
+// resolve looks up the question, following any CNAME and DNAME records to
+// the records of the type asked for.
+func (s *resolution) resolve(ctx context.Context, q Question, depth int) (*Message, error) {
+	chain := &Chain{Name: q.FQDN}
+	seen := map[string]bool{q.FQDN: true}
+
+	for {
+		msg, err := s.lookup(ctx, Question{FQDN: chain.Name, Type: q.Type, Class: q.Class}, depth)
+		if err != nil {
+			return nil, err
+		}
+
+		followed := len(chain.Aliases)
+		if err := chain.follow(msg.Answers, q.Type, q.Class, DefaultMaxAliases, seen); err != nil {
+			return nil, err
+		}
+
+		if len(chain.Records) > 0 || len(chain.Aliases) == followed || msg.RCode != NoError {
+			msg.Answers = append(chain.Aliases, chain.Records...)
+			return msg, nil
+		}
+
+		chain.Name = fqdn(chain.Name)
+	}
+}
+
+// lookup walks down from the closest known zone cut to the servers
+// authoritative for the name in the question, and returns their answer.
+// Records in the answer that lie outside the zone of those servers are
+// dropped, since they have no authority over them.
+func (s *resolution) lookup(ctx context.Context, q Question, depth int) (*Message, error) {
+	zone, servers := s.transport.closest(q.FQDN)
+
+	// known is the deepest name the servers of the zone have confirmed to
+	// exist, which with QNAME minimisation is where the next query picks up.
+	known := zone
+	minimise := s.transport.minimise
+	minimised := 0
+
+	for referrals := 0; referrals <= maxReferrals; {
+		question := q
+		if minimise && minimised < maxMinimisedQueries && known != q.FQDN {
+			if child := childName(known, q.FQDN); child != q.FQDN {
+				// A is the type least likely to upset servers, as
+				// recommended by
+				// https://datatracker.ietf.org/doc/html/rfc9156#section-3
+				question = Question{FQDN: child, Type: A, Class: q.Class}
+			}
+		}
+
+		msg, err := s.query(ctx, zone, servers, question, depth)
+		if err != nil {
+			// Some servers answer minimised queries wrongly, so they are
+			// asked the full name before giving up.
+			if question.FQDN != q.FQDN && ctx.Err() == nil {
+				minimise = false
+				continue
+			}
+			return nil, err
+		}
+
+		if cut, ns, ok := referral(msg, zone, question.FQDN); ok {
+			if servers, err = s.delegation(zone, cut, ns, msg.Additional); err != nil {
+				return nil, err
+			}
+			zone, known = cut, cut
+			referrals++
+			continue
+		}
+
+		if question.FQDN != q.FQDN {
+			// A name that does not exist should mean that nothing below it
+			// does either, but the full name is asked for rather than relying
+			// on every server getting this right, as described in
+			// https://datatracker.ietf.org/doc/html/rfc9156#section-2.3
+			if msg.RCode == NXDomain {
+				minimise = false
+				continue
+			}
+			known = question.FQDN
+			minimised++
+			continue
+		}
+
+		msg.Answers = slices.DeleteFunc(msg.Answers, func(rr Record) bool {
+			return !inZone(fqdn(rr.Name), zone)
+		})
+
+		return msg, nil
+	}
+
+	return nil, fmt.Errorf("more than %d referrals resolving %s", maxReferrals, q.FQDN)
+}
+
+// query sends the question to each server of the zone in turn until one
+// gives a usable response, which is an answer, a negative response or a
+// referral to a zone below it. Servers with addresses are tried before those
+// whose addresses must first be looked up.
+func (s *resolution) query(ctx context.Context, zone string, servers []nameserver, q Question, depth int) (*Message, error) {
+	slices.SortStableFunc(servers, func(a, b nameserver) int {
+		return min(len(b.addrs), 1) - min(len(a.addrs), 1)
+	})
+
+	var errs []error
+	for i := range servers {
+		ns := &servers[i]
+
+		if len(ns.addrs) == 0 {
+			addrs, err := s.addresses(ctx, ns.name, depth+1)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", ns.name, err))
+				continue
+			}
+			ns.addrs = addrs
+		}
+
+		for _, addr := range ns.addrs {
+			if s.budget == 0 {
+				return nil, fmt.Errorf("more than %d queries needed to resolve %s", maxIterativeQueries, q.FQDN)
+			}
+			s.budget--
+
+			msg, err := s.transport.exchange(ctx, addr, q)
+			if err == nil {
+				err = usable(msg, zone, q.FQDN)
+			}
+			if err == nil {
+				return msg, nil
+			}
+
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			errs = append(errs, fmt.Errorf("%s (%s): %w", ns.name, addr, err))
+		}
+	}
+
+	return nil, fmt.Errorf("no usable response from the servers of %s: %w", zone, errors.Join(errs...))
+}
+
+// addresses looks up the addresses of a name server that came without glue.
+func (s *resolution) addresses(ctx context.Context, name string, depth int) ([]string, error) {
+	if depth > maxIterativeDepth {
+		return nil, errors.New("too many name servers without glue")
+	}
+
+	msg, err := s.resolve(ctx, Question{FQDN: name, Type: A, Class: IN}, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, rr := range msg.Answers {
+		if rr.Type == A {
+			addrs = append(addrs, net.IP(rr.Data.([]byte)).String())
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses")
+	}
+
+	return addrs, nil
+}
+
+// delegation returns the servers of the zone cut from a referral, taking
+// their addresses from the glue in the additional section. Glue is only
+// trusted for names within the zone that gave the referral, which is the
+// bailiwick of its servers. The zone cut is remembered for later questions.
+func (s *resolution) delegation(zone, cut string, ns []Record, additional []Record) ([]nameserver, error) {
+	var servers []nameserver
+	ttl := uint32(0xFFFFFFFF)
+
+	for _, rr := range ns {
+		name, err := rdataName(rr.Data.([]byte), 0)
+		if err != nil {
+			continue
+		}
+		name = fqdn(name)
+		ttl = min(ttl, rr.TTL)
+
+		server := nameserver{name: name}
+		if inZone(name, zone) {
+			for _, glue := range additional {
+				if (glue.Type == A || glue.Type == AAAA) && fqdn(glue.Name) == name {
+					server.addrs = append(server.addrs, net.IP(glue.Data.([]byte)).String())
+				}
+			}
+		}
+		servers = append(servers, server)
+	}
+
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("referral to %s without name servers", cut)
+	}
+
+	s.transport.delegate(cut, servers, ttl)
+
+	return servers, nil
+}
+
+// referral returns the zone cut and NS records of a response referring the
+// question to the servers of a zone below the one asked. NS records for any
+// other zone are not a referral.
+func referral(msg *Message, zone, name string) (string, []Record, bool) {
+	if msg.RCode != NoError || len(msg.Answers) > 0 || hasSOA(msg.Authority) {
+		return "", nil, false
+	}
+
+	var cut string
+	var ns []Record
+	for _, rr := range msg.Authority {
+		if rr.Type != NS {
+			continue
+		}
+
+		owner := fqdn(rr.Name)
+		if owner == zone || !inZone(owner, zone) || !inZone(name, owner) {
+			continue
+		}
+		if cut != "" && owner != cut {
+			continue
+		}
+
+		cut = owner
+		ns = append(ns, rr)
+	}
+
+	return cut, ns, cut != ""
+}
+
+// usable reports why a response from a server of the zone cannot be used, if
+// it cannot. A server that refuses or fails the question, or that refers it
+// back up the tree or to a zone it has no authority over, is lame.
+func usable(msg *Message, zone, name string) error {
+	switch msg.RCode {
+	case NoError, NXDomain:
+	default:
+		return fmt.Errorf("response code %d", msg.RCode)
+	}
+
+	if msg.Truncated {
+		return errors.New("truncated response")
+	}
+
+	if _, _, ok := referral(msg, zone, name); ok {
+		return nil
+	}
+
+	if len(msg.Answers) > 0 || msg.Authoritative || hasSOA(msg.Authority) || msg.RCode == NXDomain {
+		return nil
+	}
+
+	for _, rr := range msg.Authority {
+		if rr.Type == NS {
+			return fmt.Errorf("referral to %s outside the bailiwick of %s", fqdn(rr.Name), zone)
+		}
+	}
+
+	return errors.New("lame response")
+}
+
+// inZone reports whether the name is at or below the zone, both of which must
+// be lowercased and end with a dot.
+func inZone(name, zone string) bool {
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// parentName returns the name with its first label removed.
+func parentName(name string) string {
+	if _, parent, ok := strings.Cut(name, "."); ok && parent != "" {
+		return parent
+	}
+	return "."
+}
+
+// childName returns the name one label below known on the way to name.
+func childName(known, name string) string {
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+
+	n := 0
+	if known != "." {
+		n = strings.Count(known, ".")
+	}
+	if n+1 >= len(labels) {
+		return name
+	}
+
+	return strings.Join(labels[len(labels)-n-1:], ".") + "."
+}
+
+func cloneNameservers(servers []nameserver) []nameserver {
+	clone := make([]nameserver, len(servers))
+	for i, ns := range servers {
+		clone[i] = nameserver{name: ns.name, addrs: slices.Clone(ns.addrs)}
+	}
+	return clone
+}
@@ -0,0 +1,421 @@
+package donut_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tomasbasham/donut"
+)
+
+// authServer is an authoritative server for a set of zones, standing in for
+// the root, TLD and leaf servers of the real tree. Names below an NS record
+// other than at the origin of a zone are referred, with glue from any address
+// records the server has for the name servers.
+type authServer struct {
+	ip      string
+	zones   []string
+	records []donut.Record
+
+	// override answers a question in place of the zones, if it returns a
+	// message.
+	override func(q donut.Question) *donut.Message
+
+	mu        sync.Mutex
+	questions []donut.Question
+}
+
+func (s *authServer) names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+	for _, q := range s.questions {
+		names = append(names, q.FQDN)
+	}
+	return names
+}
+
+func (s *authServer) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.questions = nil
+}
+
+func (s *authServer) answer(query []byte) []byte {
+	msg, err := donut.ParseMessage(query)
+	if err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+
+	q := msg.Questions[0]
+	name := strings.ToLower(q.FQDN)
+
+	s.mu.Lock()
+	s.questions = append(s.questions, q)
+	s.mu.Unlock()
+
+	var resp *donut.Message
+	if s.override != nil {
+		resp = s.override(q)
+	}
+	if resp == nil {
+		resp = &donut.Message{}
+		s.resolve(resp, name, q.Type)
+	}
+	resp.ID, resp.Response, resp.Questions = msg.ID, true, msg.Questions
+
+	b, err := resp.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func (s *authServer) resolve(resp *donut.Message, name string, t donut.RecordType) {
+	zone := ""
+	for _, z := range s.zones {
+		if under(name, z) && len(z) > len(zone) {
+			zone = z
+		}
+	}
+	if zone == "" {
+		resp.RCode = donut.Refused
+		return
+	}
+
+	// The deepest zone cut above the name refers the question.
+	cut := ""
+	for _, rr := range s.records {
+		if rr.Type == donut.NS && rr.Name != zone && under(rr.Name, zone) && under(name, rr.Name) && len(rr.Name) > len(cut) {
+			cut = rr.Name
+		}
+	}
+	if cut != "" {
+		for _, rr := range s.records {
+			if rr.Type == donut.NS && rr.Name == cut {
+				resp.Authority = append(resp.Authority, rr)
+				target := readName(rr.Data.([]byte))
+				for _, glue := range s.records {
+					if glue.Type == donut.A && glue.Name == target {
+						resp.Additional = append(resp.Additional, glue)
+					}
+				}
+			}
+		}
+		return
+	}
+
+	resp.Authoritative = true
+
+	exists := false
+	for _, rr := range s.records {
+		if rr.Name == name && (rr.Type == t || rr.Type == donut.CNAME) {
+			resp.Answers = append(resp.Answers, rr)
+		}
+		if under(rr.Name, name) {
+			exists = true
+		}
+	}
+
+	if len(resp.Answers) > 0 {
+		return
+	}
+	if !exists {
+		resp.RCode = donut.NXDomain
+	}
+	resp.Authority = []donut.Record{{
+		Name:  zone,
+		Type:  donut.SOA,
+		Class: donut.IN,
+		TTL:   300,
+		Data: append(append(wireName("ns."+zone), wireName("admin."+zone)...),
+			0, 0, 0, 1, 0, 0, 0x1c, 0x20, 0, 0, 0x0e, 0x10, 0, 0x12, 0x75, 0, 0, 0, 0, 0x3c),
+	}}
+}
+
+// under reports whether name is at or below zone.
+func under(name, zone string) bool {
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// readName decodes an uncompressed name in wire format.
+func readName(b []byte) string {
+	var labels []string
+	for len(b) > 0 && b[0] != 0 {
+		labels = append(labels, string(b[1:1+b[0]]))
+		b = b[1+b[0]:]
+	}
+	return strings.Join(labels, ".") + "."
+}
+
+// startAuthServers serves each server over UDP on its own loopback address,
+// all on the same port, which is returned.
+func startAuthServers(t *testing.T, servers ...*authServer) string {
+	t.Helper()
+
+	for attempt := 0; attempt < 10; attempt++ {
+		first, err := net.ListenPacket("udp", servers[0].ip+":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, port, _ := net.SplitHostPort(first.LocalAddr().String())
+
+		conns := []net.PacketConn{first}
+		for _, s := range servers[1:] {
+			conn, err := net.ListenPacket("udp", net.JoinHostPort(s.ip, port))
+			if err != nil {
+				break
+			}
+			conns = append(conns, conn)
+		}
+
+		if len(conns) != len(servers) {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			continue
+		}
+
+		for i, conn := range conns {
+			t.Cleanup(func() { conn.Close() })
+			go serveAuth(conn, servers[i])
+		}
+
+		return port
+	}
+
+	t.Skip("no port free on every loopback address")
+	return ""
+}
+
+func serveAuth(conn net.PacketConn, s *authServer) {
+	buf := make([]byte, 0xFFFF)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp := s.answer(buf[:n]); resp != nil {
+			conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+func nsRecord(name, target string) donut.Record {
+	return donut.Record{Name: name, Type: donut.NS, Class: donut.IN, TTL: 300, Data: wireName(target)}
+}
+
+func TestResolver_LookupIterative(t *testing.T) {
+	root := &authServer{
+		ip:    "127.0.0.1",
+		zones: []string{"."},
+		records: []donut.Record{
+			nsRecord(".", "a.root.test."),
+			aRecord("a.root.test.", 127, 0, 0, 1),
+			nsRecord("example.", "ns.example."),
+			aRecord("ns.example.", 127, 0, 0, 2),
+		},
+	}
+	tld := &authServer{
+		ip:    "127.0.0.2",
+		zones: []string{"example."},
+		records: []donut.Record{
+			nsRecord("zone.example.", "ns.zone.example."),
+			aRecord("ns.zone.example.", 127, 0, 0, 3),
+			nsRecord("glueless.example.", "ns2.zone.example."),
+
+			// The address of a name server outside the zone is not glue the
+			// server has any authority to give.
+			nsRecord("poison.example.", "ns.other."),
+			aRecord("ns.other.", 127, 0, 0, 3),
+		},
+
+		// The server refers questions under hijack.example. to a zone it has
+		// no authority over.
+		override: func(q donut.Question) *donut.Message {
+			if !under(q.FQDN, "hijack.example.") {
+				return nil
+			}
+			return &donut.Message{
+				Authority:  []donut.Record{nsRecord("com.", "ns.zone.example.")},
+				Additional: []donut.Record{aRecord("ns.zone.example.", 127, 0, 0, 3)},
+			}
+		},
+	}
+	leaf := &authServer{
+		ip:    "127.0.0.3",
+		zones: []string{"zone.example.", "glueless.example.", "poison.example."},
+		records: []donut.Record{
+			aRecord("ns.zone.example.", 127, 0, 0, 3),
+			aRecord("ns2.zone.example.", 127, 0, 0, 3),
+			aRecord("www.zone.example.", 192, 0, 2, 1),
+			aRecord("a.b.c.zone.example.", 192, 0, 2, 2),
+			cnameRecord("alias.zone.example.", "www.zone.example."),
+			aRecord("www.glueless.example.", 192, 0, 2, 3),
+			aRecord("www.poison.example.", 192, 0, 2, 4),
+		},
+	}
+
+	port := startAuthServers(t, root, tld, leaf)
+
+	hints := filepath.Join(t.TempDir(), "named.root")
+	if err := os.WriteFile(hints, []byte("; local root\n.  3600000  NS  A.ROOT.TEST.\nA.ROOT.TEST.  3600000  IN  A  127.0.0.1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		question     donut.Question
+		disableQMin  bool
+		rcode        donut.RCode
+		answers      []string
+		rootQuestion []string
+		tldQuestion  []string
+	}{
+		"address": {
+			question:     donut.Question{FQDN: "www.zone.example", Type: donut.A, Class: donut.IN},
+			answers:      []string{"www.zone.example. A"},
+			rootQuestion: []string{"example."},
+			tldQuestion:  []string{"zone.example."},
+		},
+		"without minimisation": {
+			question:     donut.Question{FQDN: "www.zone.example.", Type: donut.A, Class: donut.IN},
+			disableQMin:  true,
+			answers:      []string{"www.zone.example. A"},
+			rootQuestion: []string{"www.zone.example."},
+			tldQuestion:  []string{"www.zone.example."},
+		},
+		"empty non-terminals": {
+			question: donut.Question{FQDN: "a.b.c.zone.example.", Type: donut.A, Class: donut.IN},
+			answers:  []string{"a.b.c.zone.example. A"},
+		},
+		"alias": {
+			question: donut.Question{FQDN: "alias.zone.example.", Type: donut.A, Class: donut.IN},
+			answers:  []string{"alias.zone.example. CNAME", "www.zone.example. A"},
+		},
+		"no such name": {
+			question: donut.Question{FQDN: "missing.zone.example.", Type: donut.A, Class: donut.IN},
+			rcode:    donut.NXDomain,
+		},
+		"no data": {
+			question: donut.Question{FQDN: "www.zone.example.", Type: donut.AAAA, Class: donut.IN},
+		},
+		"name server without glue": {
+			question: donut.Question{FQDN: "www.glueless.example.", Type: donut.A, Class: donut.IN},
+			answers:  []string{"www.glueless.example. A"},
+		},
+		"glue outside the bailiwick": {
+			question: donut.Question{FQDN: "www.poison.example.", Type: donut.A, Class: donut.IN},
+			rcode:    donut.ServFail,
+		},
+		"referral outside the bailiwick": {
+			question: donut.Question{FQDN: "www.hijack.example.", Type: donut.A, Class: donut.IN},
+			rcode:    donut.ServFail,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			root.reset()
+			tld.reset()
+
+			r := donut.New("", donut.WithIterative(donut.IterativeConfig{
+				RootHints:                hints,
+				Port:                     port,
+				DisableQNAMEMinimisation: tt.disableQMin,
+			}))
+			defer r.Close()
+
+			msg, err := r.LookupMessage(context.Background(), tt.question)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if msg.RCode != tt.rcode {
+				t.Fatalf("expected rcode %d, got %d (%s)", tt.rcode, msg.RCode, msg.Comment)
+			}
+
+			var answers []string
+			for _, rr := range msg.Answers {
+				answers = append(answers, rr.Name+" "+rr.Type.String())
+			}
+			if !slices.Equal(answers, tt.answers) {
+				t.Errorf("expected answers %v, got %v", tt.answers, answers)
+			}
+
+			if tt.rootQuestion != nil && !slices.Equal(root.names(), tt.rootQuestion) {
+				t.Errorf("expected the root to be asked %v, got %v", tt.rootQuestion, root.names())
+			}
+			if tt.tldQuestion != nil && !slices.Equal(tld.names(), tt.tldQuestion) {
+				t.Errorf("expected the TLD to be asked %v, got %v", tt.tldQuestion, tld.names())
+			}
+		})
+	}
+}
+
+func TestResolver_LookupIterativeDelegations(t *testing.T) {
+	root := &authServer{
+		ip:    "127.0.0.1",
+		zones: []string{"."},
+		records: []donut.Record{
+			nsRecord("example.", "ns.example."),
+			aRecord("ns.example.", 127, 0, 0, 2),
+		},
+	}
+	tld := &authServer{
+		ip:      "127.0.0.2",
+		zones:   []string{"example."},
+		records: []donut.Record{aRecord("www.example.", 192, 0, 2, 1), aRecord("mail.example.", 192, 0, 2, 2)},
+	}
+
+	port := startAuthServers(t, root, tld)
+
+	hints := filepath.Join(t.TempDir(), "named.root")
+	if err := os.WriteFile(hints, []byte(". NS a.root.test.\na.root.test. A 127.0.0.1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := donut.New("", donut.WithIterative(donut.IterativeConfig{RootHints: hints, Port: port}))
+	defer r.Close()
+
+	for _, name := range []string{"www.example.", "mail.example."} {
+		if _, err := r.Lookup(donut.Question{FQDN: name, Type: donut.A, Class: donut.IN}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The zone cut learnt for the first name is used for the second.
+	if got := root.names(); len(got) != 1 {
+		t.Errorf("expected the root to be asked once, got %v", got)
+	}
+}
+
+func TestResolver_LookupIterativeRootHints(t *testing.T) {
+	tests := map[string]string{
+		"missing file":    filepath.Join(t.TempDir(), "missing"),
+		"no addresses":    ". NS a.root.test.\n",
+		"unexpected type": ". NS a.root.test.\na.root.test. MX 10 mail.test.\n",
+	}
+	for name, contents := range tests {
+		t.Run(name, func(t *testing.T) {
+			hints := contents
+			if !strings.HasPrefix(contents, "/") {
+				hints = filepath.Join(t.TempDir(), "named.root")
+				if err := os.WriteFile(hints, []byte(contents), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			r := donut.New("", donut.WithIterative(donut.IterativeConfig{RootHints: hints}))
+			defer r.Close()
+
+			if _, err := r.Lookup(donut.Question{FQDN: "example.", Type: donut.A, Class: donut.IN}); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
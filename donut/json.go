@@ -0,0 +1,199 @@
+package donut
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// jsonTransport sends queries to the JSON API offered by Google and
+// Cloudflare, as described in
+// https://developers.google.com/speed/public-dns/docs/doh/json
+//
+// The JSON response is converted back into a wire format message so that it
+// can be used anywhere the response from any other transport can.
+type jsonTransport struct {
+	url    string
+	client *http.Client
+}
+
+// jsonMessage is the response returned by the JSON API.
+type jsonMessage struct {
+	Status    RCode          `json:"Status"`
+	TC        bool           `json:"TC"`
+	RD        bool           `json:"RD"`
+	RA        bool           `json:"RA"`
+	AD        bool           `json:"AD"`
+	CD        bool           `json:"CD"`
+	Question  []jsonQuestion `json:"Question"`
+	Answer    []jsonRecord   `json:"Answer"`
+	Authority []jsonRecord   `json:"Authority"`
+	Comment   jsonComment    `json:"Comment"`
+}
+
+type jsonQuestion struct {
+	Name string     `json:"name"`
+	Type RecordType `json:"type"`
+}
+
+type jsonRecord struct {
+	Name string     `json:"name"`
+	Type RecordType `json:"type"`
+	TTL  uint32     `json:"TTL"`
+	Data string     `json:"data"`
+}
+
+// jsonComment accepts the comment as either a string or, as Cloudflare
+// sometimes sends, a list of strings.
+type jsonComment string
+
+func (c *jsonComment) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*c = jsonComment(s)
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+
+	for i, s := range list {
+		if i > 0 {
+			*c += "\n"
+		}
+		*c += jsonComment(s)
+	}
+
+	return nil
+}
+
+func (r *Resolver) newJSONTransport(e endpoint) (*jsonTransport, error) {
+	path := e.path
+	if path == "" {
+		path = "/resolve"
+	}
+
+	client, err := r.newHTTPClient(e)
+	if err != nil {
+		return nil, err
+	}
+
+	return &jsonTransport{
+		url:    "https://" + e.authority() + path,
+		client: client,
+	}, nil
+}
+
+func (t *jsonTransport) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	q, err := ParseMessage(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(q.Questions) != 1 {
+		return nil, errors.New("the JSON API supports exactly one question per query")
+	}
+
+	params := url.Values{}
+	params.Set("name", q.Questions[0].FQDN)
+	params.Set("type", strconv.Itoa(int(q.Questions[0].Type)))
+	if q.CheckingDisabled {
+		params.Set("cd", "1")
+	}
+	if dnssecOK(q.Additional) {
+		params.Set("do", "1")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", t.url+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	addContextHeader(req)
+	req.Header.Set("Accept", "application/dns-json")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{StatusCode: resp.StatusCode}
+	}
+
+	var body jsonMessage
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("invalid JSON response: %w", err)
+	}
+
+	msg, err := body.message(q)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg.Pack()
+}
+
+// message converts the JSON response into a message answering the query q.
+func (m *jsonMessage) message(q *Message) (*Message, error) {
+	msg := &Message{
+		ID:                 q.ID,
+		Response:           true,
+		Opcode:             q.Opcode,
+		Truncated:          m.TC,
+		RecursionDesired:   m.RD,
+		RecursionAvailable: m.RA,
+		AuthenticData:      m.AD,
+		CheckingDisabled:   m.CD,
+		RCode:              m.Status,
+		Questions:          q.Questions,
+	}
+
+	var err error
+	if msg.Answers, err = jsonRecords(m.Answer); err != nil {
+		return nil, err
+	}
+	if msg.Authority, err = jsonRecords(m.Authority); err != nil {
+		return nil, err
+	}
+
+	if m.Comment != "" {
+		msg.Comment = string(m.Comment)
+		msg.Additional = append(msg.Additional, newOPT(4096, dnssecOK(q.Additional), msg.Comment))
+	}
+
+	return msg, nil
+}
+
+// jsonRecords converts the records of a JSON response. Records of types whose
+// data cannot be parsed, such as HTTPS, CAA or RRSIG, are left out rather than
+// failing the whole lookup, unless the server gave them in the generic format.
+func jsonRecords(records []jsonRecord) ([]Record, error) {
+	var rrs []Record
+	for _, rr := range records {
+		rdata, err := parseRData(rr.Type, rr.Data)
+		if errors.Is(err, errUnsupportedRData) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		rrs = append(rrs, Record{
+			Name:  rr.Name,
+			Type:  rr.Type,
+			Class: IN,
+			TTL:   rr.TTL,
+			Data:  rdata,
+		})
+	}
+	return rrs, nil
+}
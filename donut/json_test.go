@@ -0,0 +1,110 @@
+package donut_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tomasbasham/donut"
+)
+
+const jsonResponse = `{
+  "Status": 3,
+  "TC": false,
+  "RD": true,
+  "RA": true,
+  "AD": true,
+  "CD": false,
+  "Question": [{"name": "example.com.", "type": 15}],
+  "Answer": [
+    {"name": "example.com.", "type": 15, "TTL": 300, "data": "10 mail.example.com."},
+    {"name": "example.com.", "type": 16, "TTL": 60, "data": "\"v=spf1\" \"-all\""},
+    {"name": "example.com.", "type": 65, "TTL": 300, "data": "1 . alpn=h2,h3"},
+    {"name": "example.com.", "type": 257, "TTL": 300, "data": "\\# 4 00016100"},
+    {"name": "example.com.", "type": 39, "TTL": 300, "data": "example.net."}
+  ],
+  "Authority": [
+    {"name": "com.", "type": 6, "TTL": 900, "data": "a.gtld-servers.net. nstld.verisign-grs.com. 1 1800 900 604800 86400"}
+  ],
+  "Comment": "Response from 192.0.2.53."
+}`
+
+func TestResolver_LookupJSON(t *testing.T) {
+	var query http.Header
+	var params string
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.Header
+		params = r.URL.RawQuery
+		w.Header().Set("Content-Type", "application/dns-json")
+		w.Write([]byte(jsonResponse))
+	}))
+	defer srv.Close()
+
+	r := donut.New("https+json://"+srv.Listener.Addr().String(), donut.WithClient(srv.Client()))
+
+	msg, err := r.LookupMessage(context.Background(), donut.Question{FQDN: "example.com", Type: donut.MX, Class: donut.IN})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := query.Get("Accept"); got != "application/dns-json" {
+		t.Errorf("expected Accept application/dns-json, got %q", got)
+	}
+	if params != "name=example.com.&type=15" {
+		t.Errorf("unexpected query parameters %q", params)
+	}
+
+	if msg.RCode != donut.NXDomain || !msg.RecursionDesired || !msg.RecursionAvailable || !msg.AuthenticData || msg.CheckingDisabled {
+		t.Errorf("unexpected header %+v", msg)
+	}
+	if msg.Comment != "Response from 192.0.2.53." {
+		t.Errorf("unexpected comment %q", msg.Comment)
+	}
+
+	// The HTTPS record cannot be parsed and is left out.
+	if len(msg.Answers) != 4 {
+		t.Fatalf("expected 4 answers, got %+v", msg.Answers)
+	}
+
+	tests := map[string]struct {
+		record   donut.Record
+		expected donut.Record
+	}{
+		"mx": {
+			record:   msg.Answers[0],
+			expected: donut.Record{Name: "example.com.", Type: donut.MX, Class: donut.IN, TTL: 300, Data: []byte("\x00\x0a\x04mail\x07example\x03com\x00")},
+		},
+		"txt": {
+			record:   msg.Answers[1],
+			expected: donut.Record{Name: "example.com.", Type: donut.TXT, Class: donut.IN, TTL: 60, Data: []byte("\x06v=spf1\x04-all")},
+		},
+		"generic": {
+			record:   msg.Answers[2],
+			expected: donut.Record{Name: "example.com.", Type: donut.RecordType(257), Class: donut.IN, TTL: 300, Data: []byte("\x00\x01a\x00")},
+		},
+		"dname": {
+			record:   msg.Answers[3],
+			expected: donut.Record{Name: "example.com.", Type: donut.DNAME, Class: donut.IN, TTL: 300, Data: []byte("\x07example\x03net\x00")},
+		},
+		"soa": {
+			record: msg.Authority[0],
+			expected: donut.Record{Name: "com.", Type: donut.SOA, Class: donut.IN, TTL: 900, Data: []byte(
+				"\x01a\x0cgtld-servers\x03net\x00\x05nstld\x0cverisign-grs\x03com\x00" +
+					"\x00\x00\x00\x01\x00\x00\x07\x08\x00\x00\x03\x84\x00\x09\x3a\x80\x00\x01\x51\x80")},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, want := tt.record, tt.expected
+			if got.Name != want.Name || got.Type != want.Type || got.Class != want.Class || got.TTL != want.TTL {
+				t.Errorf("expected %+v, got %+v", want, got)
+			}
+			if !bytes.Equal(got.Data.([]byte), want.Data.([]byte)) {
+				t.Errorf("expected data %q, got %q", want.Data, got.Data)
+			}
+		})
+	}
+}
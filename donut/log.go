@@ -0,0 +1,233 @@
+package donut
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamKey is the context key of the upstreamRecorder through which a
+// transport that chooses between several servers says which one answered.
+type upstreamKey struct{}
+
+// upstreamRecorder holds the upstream server that answered a query.
+type upstreamRecorder struct {
+	mu     sync.Mutex
+	server string
+}
+
+func withUpstreamRecorder(ctx context.Context) (context.Context, *upstreamRecorder) {
+	rec := &upstreamRecorder{}
+	return context.WithValue(ctx, upstreamKey{}, rec), rec
+}
+
+// recordUpstream notes the server that answered the query being exchanged
+// with ctx, if anyone is asking.
+func recordUpstream(ctx context.Context, server string) {
+	if rec, ok := ctx.Value(upstreamKey{}).(*upstreamRecorder); ok {
+		rec.mu.Lock()
+		rec.server = server
+		rec.mu.Unlock()
+	}
+}
+
+func (rec *upstreamRecorder) get() string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.server
+}
+
+// newDebugLogger returns the logger used by WithDebug when none is set with
+// WithLogger, which writes to standard error so that it never mixes with the
+// output of a program.
+func newDebugLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
+// logEnabled reports whether events at the level are logged, so that they are
+// only put together when needed.
+func (r *Resolver) logEnabled(ctx context.Context, level slog.Level) bool {
+	return r.logger != nil && r.logger.Enabled(ctx, level)
+}
+
+// queryAttrs returns the attributes describing a query, along with a dump of
+// the message if the resolver was created with WithDebug.
+func (r *Resolver) queryAttrs(query []byte) []slog.Attr {
+	var attrs []slog.Attr
+
+	m := message{query}
+	if len(query) >= headerLen {
+		attrs = append(attrs, slog.Int("id", int(binary.BigEndian.Uint16(query))))
+		if binary.BigEndian.Uint16(query[4:6]) > 0 {
+			if q, _, err := m.decodeQuestion(headerLen); err == nil {
+				attrs = append(attrs, slog.String("name", q.FQDN), slog.String("type", q.Type.String()))
+			}
+		}
+	}
+
+	if r.debug {
+		attrs = append(attrs, slog.String("message", dumpMessage(query)))
+	}
+
+	return attrs
+}
+
+// logQuery logs a query about to be sent upstream.
+func (r *Resolver) logQuery(ctx context.Context, query []byte) {
+	if !r.logEnabled(ctx, slog.LevelDebug) {
+		return
+	}
+	r.logger.LogAttrs(ctx, slog.LevelDebug, "query sent", r.queryAttrs(query)...)
+}
+
+// logResponse logs the outcome of a query sent upstream. Failures are logged
+// as warnings, since they are likely to be passed on to the client.
+func (r *Resolver) logResponse(ctx context.Context, query, resp []byte, err error, upstream string, shared bool, latency time.Duration) {
+	level := slog.LevelDebug
+	if err != nil {
+		level = slog.LevelWarn
+	}
+	if !r.logEnabled(ctx, level) {
+		return
+	}
+
+	attrs := []slog.Attr{slog.Duration("latency", latency)}
+	if upstream != "" {
+		attrs = append(attrs, slog.String("upstream", upstream))
+	}
+	if shared {
+		attrs = append(attrs, slog.Bool("shared", true))
+	}
+
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+		r.logger.LogAttrs(ctx, level, "query failed", append(r.queryAttrs(query), attrs...)...)
+		return
+	}
+
+	r.logger.LogAttrs(ctx, level, "response received", append(r.responseAttrs(resp), attrs...)...)
+}
+
+// responseAttrs returns the attributes describing a response, along with a
+// dump of the message if the resolver was created with WithDebug.
+func (r *Resolver) responseAttrs(resp []byte) []slog.Attr {
+	attrs := r.queryAttrs(resp)
+	if len(resp) >= headerLen {
+		attrs = append(attrs,
+			slog.String("rcode", RCode(resp[3]&0x0F).String()),
+			slog.Int("answers", int(binary.BigEndian.Uint16(resp[6:8]))))
+	}
+	return attrs
+}
+
+// logCacheHit logs a query answered from the cache, with the status of the
+// cached response: hit, prefetch or stale.
+func (r *Resolver) logCacheHit(ctx context.Context, resp []byte, status string) {
+	if !r.logEnabled(ctx, slog.LevelDebug) {
+		return
+	}
+	attrs := append(r.responseAttrs(resp), slog.String("status", status))
+	r.logger.LogAttrs(ctx, slog.LevelDebug, "cache hit", attrs...)
+}
+
+// logHostsHit logs a query answered from the hosts file or static records.
+func (r *Resolver) logHostsHit(ctx context.Context, resp []byte) {
+	if !r.logEnabled(ctx, slog.LevelDebug) {
+		return
+	}
+	r.logger.LogAttrs(ctx, slog.LevelDebug, "hosts hit", r.responseAttrs(resp)...)
+}
+
+// dumpMessage decodes a message into the text dig shows for it, or describes
+// why it could not be decoded.
+func dumpMessage(b []byte) string {
+	m := message{b}
+	msg, err := m.unpack()
+	if err != nil {
+		return fmt.Sprintf(";; malformed message of %d bytes: %v", len(b), err)
+	}
+	return formatMessage(msg)
+}
+
+// formatMessage returns the message in the format dig shows it in.
+func formatMessage(msg *Message) string {
+	var b strings.Builder
+
+	opcode := "QUERY"
+	if msg.Opcode != 0 {
+		opcode = fmt.Sprintf("OPCODE%d", msg.Opcode)
+	}
+	fmt.Fprintf(&b, ";; ->>HEADER<<- opcode: %s, status: %s, id: %d\n", opcode, msg.RCode, msg.ID)
+
+	var flags []string
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"qr", msg.Response},
+		{"aa", msg.Authoritative},
+		{"tc", msg.Truncated},
+		{"rd", msg.RecursionDesired},
+		{"ra", msg.RecursionAvailable},
+		{"ad", msg.AuthenticData},
+		{"cd", msg.CheckingDisabled},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	fmt.Fprintf(&b, ";; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
+		strings.Join(flags, " "), len(msg.Questions), len(msg.Answers), len(msg.Authority), len(msg.Additional))
+
+	var additional []Record
+	for _, rr := range msg.Additional {
+		if rr.Type == OPT {
+			fmt.Fprintf(&b, "\n;; OPT PSEUDOSECTION:\n; EDNS: version: %d, flags:", byte(rr.TTL>>16))
+			if rr.TTL&ednsDNSSECOK != 0 {
+				b.WriteString(" do")
+			}
+			fmt.Fprintf(&b, "; udp: %d\n", rr.Class)
+			if msg.Comment != "" {
+				fmt.Fprintf(&b, "; EDE: %q\n", msg.Comment)
+			}
+			continue
+		}
+		additional = append(additional, rr)
+	}
+
+	if len(msg.Questions) > 0 {
+		b.WriteString("\n;; QUESTION SECTION:\n")
+		for _, q := range msg.Questions {
+			fmt.Fprintf(&b, ";%s\t\t%s\t%s\n", q.FQDN, q.Class, q.Type)
+		}
+	}
+
+	for _, section := range []struct {
+		name    string
+		records []Record
+	}{
+		{"ANSWER", msg.Answers},
+		{"AUTHORITY", msg.Authority},
+		{"ADDITIONAL", additional},
+	} {
+		if len(section.records) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n;; %s SECTION:\n", section.name)
+		for _, rr := range section.records {
+			data, ok := rr.Data.([]byte)
+			if !ok {
+				fmt.Fprintf(&b, "%s\t%d\t%s\t%s\t%v\n", rr.Name, rr.TTL, rr.Class, rr.Type, rr.Data)
+				continue
+			}
+			fmt.Fprintf(&b, "%s\t%d\t%s\t%s\t%s\n", rr.Name, rr.TTL, rr.Class, rr.Type, formatRData(rr.Type, data))
+		}
+	}
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
@@ -0,0 +1,138 @@
+package donut_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/tomasbasham/donut"
+)
+
+func TestResolver_Logger(t *testing.T) {
+	s := newPlainServer(t)
+
+	failing := transportFunc(func(ctx context.Context, query []byte) ([]byte, error) {
+		return nil, errors.New("upstream failed")
+	})
+
+	type event struct {
+		msg   string
+		attrs map[string]any
+	}
+
+	tests := map[string]struct {
+		resolver func(logger *slog.Logger) *donut.Resolver
+		lookups  int
+		events   []event
+	}{
+		"response": {
+			resolver: func(logger *slog.Logger) *donut.Resolver {
+				return donut.New(donut.GoogleHost, donut.WithTransport(upstream), donut.WithLogger(logger))
+			},
+			lookups: 1,
+			events: []event{
+				{msg: "query sent", attrs: map[string]any{"level": "DEBUG", "name": "host.example.", "type": "A"}},
+				{msg: "response received", attrs: map[string]any{"name": "host.example.", "rcode": "NOERROR", "answers": 1.0, "upstream": donut.GoogleHost}},
+			},
+		},
+		"cache hit": {
+			resolver: func(logger *slog.Logger) *donut.Resolver {
+				return donut.New(donut.GoogleHost, donut.WithTransport(upstream), donut.WithCache(donut.NewCache(10)), donut.WithLogger(logger))
+			},
+			lookups: 2,
+			events: []event{
+				{msg: "query sent"},
+				{msg: "response received"},
+				{msg: "cache hit", attrs: map[string]any{"name": "host.example.", "status": "hit"}},
+			},
+		},
+		"failure": {
+			resolver: func(logger *slog.Logger) *donut.Resolver {
+				return donut.New(donut.GoogleHost, donut.WithTransport(failing), donut.WithLogger(logger))
+			},
+			lookups: 1,
+			events: []event{
+				{msg: "query sent"},
+				{msg: "query failed", attrs: map[string]any{"level": "WARN", "name": "host.example.", "error": "upstream failed"}},
+			},
+		},
+		"hosts": {
+			resolver: func(logger *slog.Logger) *donut.Resolver {
+				return donut.New(donut.GoogleHost, donut.WithTransport(upstream), donut.WithLogger(logger),
+					donut.WithHosts(donut.HostsConfig{Static: map[string][]string{"host.example": {"192.0.2.1"}}}))
+			},
+			lookups: 1,
+			events: []event{
+				{msg: "hosts hit", attrs: map[string]any{"name": "host.example.", "answers": 1.0}},
+			},
+		},
+		"upstream that answered": {
+			resolver: func(logger *slog.Logger) *donut.Resolver {
+				return donut.New("udp://127.0.0.1:1", donut.WithUpstreams("udp://"+s.addr), donut.WithLogger(logger))
+			},
+			lookups: 1,
+			events: []event{
+				{msg: "query sent"},
+				{msg: "response received", attrs: map[string]any{"upstream": "udp://" + s.addr}},
+			},
+		},
+		"dump": {
+			resolver: func(logger *slog.Logger) *donut.Resolver {
+				return donut.New(donut.GoogleHost, donut.WithTransport(upstream), donut.WithLogger(logger), donut.WithDebug())
+			},
+			lookups: 1,
+			events: []event{
+				{msg: "query sent", attrs: map[string]any{"message": ";; ->>HEADER<<- opcode: QUERY, status: NOERROR, id: 0\n" +
+					";; flags: rd; QUERY: 1, ANSWER: 0, AUTHORITY: 0, ADDITIONAL: 0\n\n" +
+					";; QUESTION SECTION:\n" +
+					";host.example.\t\tIN\tA"}},
+				{msg: "response received", attrs: map[string]any{"message": ";; ->>HEADER<<- opcode: QUERY, status: NOERROR, id: 0\n" +
+					";; flags: qr rd ra; QUERY: 1, ANSWER: 1, AUTHORITY: 0, ADDITIONAL: 0\n\n" +
+					";; QUESTION SECTION:\n" +
+					";host.example.\t\tIN\tA\n\n" +
+					";; ANSWER SECTION:\n" +
+					"host.example.\t300\tIN\tA\t203.0.113.1"}},
+			},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+			r := tt.resolver(logger)
+			defer r.Close()
+
+			for range tt.lookups {
+				r.Lookup(donut.Question{FQDN: "host.example.", Type: donut.A, Class: donut.IN})
+			}
+
+			var events []map[string]any
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				var e map[string]any
+				if err := json.Unmarshal([]byte(line), &e); err != nil {
+					t.Fatalf("invalid log line %q: %v", line, err)
+				}
+				events = append(events, e)
+			}
+
+			if len(events) != len(tt.events) {
+				t.Fatalf("expected %d events, got %d:\n%s", len(tt.events), len(events), buf.String())
+			}
+			for i, expected := range tt.events {
+				if events[i]["msg"] != expected.msg {
+					t.Errorf("event %d: expected %q, got %q", i, expected.msg, events[i]["msg"])
+				}
+				for key, value := range expected.attrs {
+					if events[i][key] != value {
+						t.Errorf("event %d: expected %s to be %q, got %q", i, key, value, events[i][key])
+					}
+				}
+			}
+		})
+	}
+}
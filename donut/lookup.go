@@ -0,0 +1,397 @@
+package donut
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The errors reported by the helpers below match those of the net package, so
+// that callers can treat the two alike.
+const (
+	errNoSuchHost       = "no such host"
+	errServerMisbehaves = "server misbehaving"
+	errInvalidRecord    = "invalid record data"
+)
+
+// LookupIP looks up the IP addresses of host. The network must be "ip" for
+// both IPv4 and IPv6 addresses, "ip4" for IPv4 only or "ip6" for IPv6 only.
+func (r *Resolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	var types []RecordType
+	switch network {
+	case "ip":
+		types = []RecordType{A, AAAA}
+	case "ip4":
+		types = []RecordType{A}
+	case "ip6":
+		types = []RecordType{AAAA}
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+
+	// Both families are looked up at once, as the net package does.
+	results := make([][]Record, len(types))
+	errs := make([]error, len(types))
+
+	var wg sync.WaitGroup
+	for i, t := range types {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = r.lookupRecords(ctx, host, t)
+		}()
+	}
+	wg.Wait()
+
+	var ips []net.IP
+	for _, records := range results {
+		for _, rr := range records {
+			ips = append(ips, net.IP(rr.Data.([]byte)))
+		}
+	}
+
+	if len(ips) > 0 {
+		return ips, nil
+	}
+
+	// A failure is more interesting than the name having no addresses of one
+	// of the families.
+	for _, err := range errs {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && !dnsErr.IsNotFound {
+			return nil, err
+		}
+	}
+
+	return nil, errs[0]
+}
+
+// LookupHost looks up the IP addresses of host, returned as strings.
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	ips, err := r.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.String()
+	}
+
+	return addrs, nil
+}
+
+// LookupMX looks up the mail exchangers of name, sorted by preference. Those
+// with the same preference are in a random order.
+func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	records, err := r.lookupRecords(ctx, name, MX)
+	if err != nil {
+		return nil, err
+	}
+
+	mxs := make([]*net.MX, 0, len(records))
+	for _, rr := range records {
+		rdata := rr.Data.([]byte)
+		if len(rdata) < 3 {
+			return nil, r.dnsError(name, errInvalidRecord)
+		}
+
+		host, err := rdataName(rdata, 2)
+		if err != nil {
+			return nil, r.dnsError(name, errInvalidRecord)
+		}
+
+		mxs = append(mxs, &net.MX{Host: host, Pref: binary.BigEndian.Uint16(rdata)})
+	}
+
+	rand.Shuffle(len(mxs), func(i, j int) {
+		mxs[i], mxs[j] = mxs[j], mxs[i]
+	})
+	slices.SortStableFunc(mxs, func(a, b *net.MX) int {
+		return cmp.Compare(a.Pref, b.Pref)
+	})
+
+	return mxs, nil
+}
+
+// LookupTXT looks up the TXT records of name. The character strings of each
+// record are joined together.
+func (r *Resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, err := r.lookupRecords(ctx, name, TXT)
+	if err != nil {
+		return nil, err
+	}
+
+	txts := make([]string, 0, len(records))
+	for _, rr := range records {
+		var b strings.Builder
+		for rdata := rr.Data.([]byte); len(rdata) > 0; {
+			n := int(rdata[0])
+			if 1+n > len(rdata) {
+				return nil, r.dnsError(name, errInvalidRecord)
+			}
+			b.Write(rdata[1 : 1+n])
+			rdata = rdata[1+n:]
+		}
+		txts = append(txts, b.String())
+	}
+
+	return txts, nil
+}
+
+// LookupSRV looks up the SRV records of the service and protocol at name, or
+// of name itself if both are empty. The canonical name is returned along with
+// the records, which are sorted by priority and, within each priority,
+// ordered randomly by weight as described in
+// https://datatracker.ietf.org/doc/html/rfc2782
+func (r *Resolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	target := name
+	if service != "" || proto != "" {
+		target = "_" + service + "._" + proto + "." + name
+	}
+
+	records, err := r.lookupRecords(ctx, target, SRV)
+	if err != nil {
+		return "", nil, err
+	}
+
+	srvs := make([]*net.SRV, 0, len(records))
+	for _, rr := range records {
+		rdata := rr.Data.([]byte)
+		if len(rdata) < 7 {
+			return "", nil, r.dnsError(target, errInvalidRecord)
+		}
+
+		host, err := rdataName(rdata, 6)
+		if err != nil {
+			return "", nil, r.dnsError(target, errInvalidRecord)
+		}
+
+		srvs = append(srvs, &net.SRV{
+			Target:   host,
+			Priority: binary.BigEndian.Uint16(rdata[0:2]),
+			Weight:   binary.BigEndian.Uint16(rdata[2:4]),
+			Port:     binary.BigEndian.Uint16(rdata[4:6]),
+		})
+	}
+
+	sortSRV(srvs)
+
+	return records[0].Name, srvs, nil
+}
+
+// LookupNS looks up the name servers of name.
+func (r *Resolver) LookupNS(ctx context.Context, name string) ([]*net.NS, error) {
+	records, err := r.lookupRecords(ctx, name, NS)
+	if err != nil {
+		return nil, err
+	}
+
+	nss := make([]*net.NS, 0, len(records))
+	for _, rr := range records {
+		host, err := rdataName(rr.Data.([]byte), 0)
+		if err != nil {
+			return nil, r.dnsError(name, errInvalidRecord)
+		}
+		nss = append(nss, &net.NS{Host: host})
+	}
+
+	return nss, nil
+}
+
+// LookupCNAME returns the canonical name of host, following any CNAME records
+// in the answer to a query for its IPv4 addresses. A host without a CNAME
+// record is its own canonical name.
+func (r *Resolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	msg, err := r.lookupMessage(ctx, host, A)
+	if err != nil {
+		return "", err
+	}
+
+	cname := host
+	if !strings.HasSuffix(cname, ".") {
+		cname += "."
+	}
+
+	// Each record in the chain leads to the next, and the length of the answer
+	// bounds the chain should it loop.
+	for range msg.Answers {
+		next := ""
+		for _, rr := range msg.Answers {
+			if rr.Type == CNAME && strings.EqualFold(rr.Name, cname) {
+				if next, err = rdataName(rr.Data.([]byte), 0); err != nil {
+					return "", r.dnsError(host, errInvalidRecord)
+				}
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		cname = next
+	}
+
+	return cname, nil
+}
+
+// LookupAddr looks up the names of an IP address.
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	name, err := reverseName(addr)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: addr}
+	}
+
+	records, err := r.lookupRecords(ctx, name, PTR)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(records))
+	for _, rr := range records {
+		ptr, err := rdataName(rr.Data.([]byte), 0)
+		if err != nil {
+			return nil, r.dnsError(name, errInvalidRecord)
+		}
+		names = append(names, ptr)
+	}
+
+	return names, nil
+}
+
+// lookupRecords returns the records of the given type at name in the answer,
+// or an error if there are none.
+func (r *Resolver) lookupRecords(ctx context.Context, name string, t RecordType) ([]Record, error) {
+	msg, err := r.lookupMessage(ctx, name, t)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	for _, rr := range msg.Answers {
+		if rr.Type == t && rr.Class == IN {
+			records = append(records, rr)
+		}
+	}
+
+	if len(records) == 0 {
+		return nil, &net.DNSError{Err: errNoSuchHost, Name: name, Server: r.Host, IsNotFound: true}
+	}
+
+	return records, nil
+}
+
+// lookupMessage looks up the records of the given type at name, turning
+// errors and unsuccessful responses into a *net.DNSError.
+func (r *Resolver) lookupMessage(ctx context.Context, name string, t RecordType) (*Message, error) {
+	msg, err := r.LookupMessage(ctx, Question{FQDN: name, Type: t, Class: IN})
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			return nil, err
+		}
+
+		var netErr net.Error
+		timeout := errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+
+		return nil, &net.DNSError{
+			Err:         err.Error(),
+			Name:        name,
+			Server:      r.Host,
+			IsTimeout:   timeout,
+			IsTemporary: timeout || isNetworkError(err),
+		}
+	}
+
+	switch msg.RCode {
+	case NoError:
+		return msg, nil
+	case NXDomain:
+		return nil, &net.DNSError{Err: errNoSuchHost, Name: name, Server: r.Host, IsNotFound: true}
+	case ServFail:
+		return nil, &net.DNSError{Err: errServerMisbehaves, Name: name, Server: r.Host, IsTemporary: true}
+	default:
+		return nil, r.dnsError(name, errServerMisbehaves)
+	}
+}
+
+func (r *Resolver) dnsError(name, err string) *net.DNSError {
+	return &net.DNSError{Err: err, Name: name, Server: r.Host}
+}
+
+// rdataName returns the domain name at offset in RDATA whose names have been
+// decompressed.
+func rdataName(rdata []byte, offset int) (string, error) {
+	m := message{rdata}
+	name, _, err := m.parseName(offset)
+	return name, err
+}
+
+// reverseName returns the name under in-addr.arpa or ip6.arpa used to look up
+// the names of an IP address.
+func reverseName(addr string) (string, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", errors.New("unrecognized address")
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return strconv.Itoa(int(ip4[3])) + "." + strconv.Itoa(int(ip4[2])) + "." +
+			strconv.Itoa(int(ip4[1])) + "." + strconv.Itoa(int(ip4[0])) + ".in-addr.arpa.", nil
+	}
+
+	const hex = "0123456789abcdef"
+
+	b := make([]byte, 0, len(ip)*4+len("ip6.arpa."))
+	for i := len(ip) - 1; i >= 0; i-- {
+		b = append(b, hex[ip[i]&0x0F], '.', hex[ip[i]>>4], '.')
+	}
+
+	return string(append(b, "ip6.arpa."...)), nil
+}
+
+// sortSRV sorts the records by priority, then orders those with the same
+// priority randomly, with the chance of a record coming first proportional to
+// its weight.
+func sortSRV(srvs []*net.SRV) {
+	slices.SortFunc(srvs, func(a, b *net.SRV) int {
+		return cmp.Compare(a.Priority, b.Priority)
+	})
+
+	start := 0
+	for i := 1; i <= len(srvs); i++ {
+		if i == len(srvs) || srvs[i].Priority != srvs[start].Priority {
+			shuffleByWeight(srvs[start:i])
+			start = i
+		}
+	}
+}
+
+func shuffleByWeight(srvs []*net.SRV) {
+	sum := 0
+	for _, srv := range srvs {
+		sum += int(srv.Weight)
+	}
+
+	// Records with a weight of 0 are only chosen once every other record has
+	// been, in the order they were given.
+	for sum > 0 && len(srvs) > 1 {
+		n := rand.IntN(sum)
+		s := 0
+		for i := range srvs {
+			s += int(srvs[i].Weight)
+			if s > n {
+				srvs[0], srvs[i] = srvs[i], srvs[0]
+				break
+			}
+		}
+		sum -= int(srvs[0].Weight)
+		srvs = srvs[1:]
+	}
+}
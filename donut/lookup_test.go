@@ -0,0 +1,348 @@
+package donut_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/tomasbasham/donut"
+)
+
+// zoneTransport answers queries from a fixed set of records, following CNAME
+// records as a recursive server would. Names without records do not exist.
+type zoneTransport []donut.Record
+
+func (z zoneTransport) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	msg, err := donut.ParseMessage(query)
+	if err != nil {
+		return nil, err
+	}
+
+	msg.Response = true
+	msg.Additional = nil
+
+	// Names are compared in wire format, which is how the target of a CNAME
+	// record is held.
+	q := msg.Questions[0]
+	name := wireName(q.FQDN)
+
+	found := false
+	for range z {
+		var cname []byte
+		for _, rr := range z {
+			if !bytes.EqualFold(wireName(rr.Name), name) {
+				continue
+			}
+			found = true
+			if rr.Type == q.Type {
+				msg.Answers = append(msg.Answers, rr)
+			} else if rr.Type == donut.CNAME {
+				msg.Answers = append(msg.Answers, rr)
+				cname = rr.Data.([]byte)
+			}
+		}
+		if cname == nil {
+			break
+		}
+		name = cname
+	}
+
+	if !found {
+		msg.RCode = donut.NXDomain
+	}
+
+	return msg.Pack()
+}
+
+func mx(pref uint16, host string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, pref), wireName(host)...)
+}
+
+func srv(priority, weight, port uint16, target string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, priority)
+	b = binary.BigEndian.AppendUint16(b, weight)
+	b = binary.BigEndian.AppendUint16(b, port)
+	return append(b, wireName(target)...)
+}
+
+var zone = zoneTransport{
+	{Name: "example.com.", Type: donut.A, Class: donut.IN, TTL: 300, Data: []byte{192, 0, 2, 1}},
+	{Name: "example.com.", Type: donut.AAAA, Class: donut.IN, TTL: 300, Data: []byte(net.ParseIP("2001:db8::1"))},
+	{Name: "example.com.", Type: donut.MX, Class: donut.IN, TTL: 300, Data: mx(20, "mx2.example.com.")},
+	{Name: "example.com.", Type: donut.MX, Class: donut.IN, TTL: 300, Data: mx(10, "mx1.example.com.")},
+	{Name: "example.com.", Type: donut.TXT, Class: donut.IN, TTL: 300, Data: []byte("\x05hello\x06 world")},
+	{Name: "example.com.", Type: donut.TXT, Class: donut.IN, TTL: 300, Data: []byte("\x0bv=spf1 -all")},
+	{Name: "example.com.", Type: donut.NS, Class: donut.IN, TTL: 300, Data: wireName("ns1.example.com.")},
+	{Name: "v4.example.com.", Type: donut.A, Class: donut.IN, TTL: 300, Data: []byte{192, 0, 2, 2}},
+	{Name: "www.example.com.", Type: donut.CNAME, Class: donut.IN, TTL: 300, Data: wireName("web.example.com.")},
+	{Name: "web.example.com.", Type: donut.CNAME, Class: donut.IN, TTL: 300, Data: wireName("example.com.")},
+	{Name: "_sip._udp.example.com.", Type: donut.SRV, Class: donut.IN, TTL: 300, Data: srv(20, 0, 5060, "sip3.example.com.")},
+	{Name: "_sip._udp.example.com.", Type: donut.SRV, Class: donut.IN, TTL: 300, Data: srv(10, 80, 5060, "sip1.example.com.")},
+	{Name: "_sip._udp.example.com.", Type: donut.SRV, Class: donut.IN, TTL: 300, Data: srv(10, 20, 5060, "sip2.example.com.")},
+	{Name: "1.2.0.192.in-addr.arpa.", Type: donut.PTR, Class: donut.IN, TTL: 300, Data: wireName("example.com.")},
+	{Name: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", Type: donut.PTR, Class: donut.IN, TTL: 300, Data: wireName("example.com.")},
+}
+
+func TestResolver_LookupIP(t *testing.T) {
+	tests := map[string]struct {
+		network  string
+		host     string
+		expected []string
+		notFound bool
+	}{
+		"both families": {
+			network:  "ip",
+			host:     "example.com",
+			expected: []string{"192.0.2.1", "2001:db8::1"},
+		},
+		"ipv4": {
+			network:  "ip4",
+			host:     "example.com",
+			expected: []string{"192.0.2.1"},
+		},
+		"ipv6": {
+			network:  "ip6",
+			host:     "example.com",
+			expected: []string{"2001:db8::1"},
+		},
+		"one family": {
+			network:  "ip",
+			host:     "v4.example.com",
+			expected: []string{"192.0.2.2"},
+		},
+		"through cname": {
+			network:  "ip4",
+			host:     "www.example.com",
+			expected: []string{"192.0.2.1"},
+		},
+		"no records": {
+			network:  "ip6",
+			host:     "v4.example.com",
+			notFound: true,
+		},
+		"no such host": {
+			network:  "ip",
+			host:     "missing.example.com",
+			notFound: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := donut.New("", donut.WithTransport(zone))
+
+			ips, err := r.LookupIP(context.Background(), tt.network, tt.host)
+			if tt.notFound {
+				var dnsErr *net.DNSError
+				if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+					t.Fatalf("expected a not found error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, ip := range ips {
+				got = append(got, ip.String())
+			}
+			if !slices.Equal(got, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestResolver_LookupHost(t *testing.T) {
+	r := donut.New("", donut.WithTransport(zone))
+
+	addrs, err := r.LookupHost(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"192.0.2.1", "2001:db8::1"}
+	if !slices.Equal(addrs, expected) {
+		t.Errorf("expected %v, got %v", expected, addrs)
+	}
+}
+
+func TestResolver_LookupMX(t *testing.T) {
+	r := donut.New("", donut.WithTransport(zone))
+
+	mxs, err := r.LookupMX(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []net.MX{{Host: "mx1.example.com.", Pref: 10}, {Host: "mx2.example.com.", Pref: 20}}
+	if len(mxs) != len(expected) {
+		t.Fatalf("expected %d records, got %d", len(expected), len(mxs))
+	}
+	for i, mx := range mxs {
+		if *mx != expected[i] {
+			t.Errorf("expected %v at %d, got %v", expected[i], i, *mx)
+		}
+	}
+}
+
+func TestResolver_LookupTXT(t *testing.T) {
+	r := donut.New("", donut.WithTransport(zone))
+
+	txts, err := r.LookupTXT(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"hello world", "v=spf1 -all"}
+	if !slices.Equal(txts, expected) {
+		t.Errorf("expected %q, got %q", expected, txts)
+	}
+}
+
+func TestResolver_LookupSRV(t *testing.T) {
+	r := donut.New("", donut.WithTransport(zone))
+
+	// The records of the same priority come in a random order, with the one
+	// of greater weight first more often than not.
+	first := map[string]int{}
+	for i := 0; i < 200; i++ {
+		cname, srvs, err := r.LookupSRV(context.Background(), "sip", "udp", "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cname != "_sip._udp.example.com." {
+			t.Fatalf("unexpected canonical name %q", cname)
+		}
+		if len(srvs) != 3 {
+			t.Fatalf("expected 3 records, got %d", len(srvs))
+		}
+		if srvs[0].Priority != 10 || srvs[1].Priority != 10 || srvs[2].Target != "sip3.example.com." {
+			t.Fatalf("records not sorted by priority: %v %v %v", *srvs[0], *srvs[1], *srvs[2])
+		}
+		first[srvs[0].Target]++
+	}
+
+	if first["sip1.example.com."] == 0 || first["sip2.example.com."] == 0 {
+		t.Errorf("expected both records of the first priority to come first, got %v", first)
+	}
+	if first["sip1.example.com."] < first["sip2.example.com."] {
+		t.Errorf("expected the record of greater weight to come first more often, got %v", first)
+	}
+}
+
+func TestResolver_LookupNS(t *testing.T) {
+	r := donut.New("", donut.WithTransport(zone))
+
+	nss, err := r.LookupNS(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(nss) != 1 || nss[0].Host != "ns1.example.com." {
+		t.Errorf("unexpected name servers %v", nss)
+	}
+}
+
+func TestResolver_LookupCNAME(t *testing.T) {
+	tests := map[string]struct {
+		host     string
+		expected string
+		notFound bool
+	}{
+		"chain": {
+			host:     "www.example.com",
+			expected: "example.com.",
+		},
+		"canonical": {
+			host:     "example.com.",
+			expected: "example.com.",
+		},
+		"no such host": {
+			host:     "missing.example.com",
+			notFound: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := donut.New("", donut.WithTransport(zone))
+
+			cname, err := r.LookupCNAME(context.Background(), tt.host)
+			if tt.notFound {
+				var dnsErr *net.DNSError
+				if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+					t.Fatalf("expected a not found error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cname != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, cname)
+			}
+		})
+	}
+}
+
+func TestResolver_LookupAddr(t *testing.T) {
+	tests := map[string]struct {
+		addr     string
+		expected []string
+		err      bool
+	}{
+		"ipv4": {
+			addr:     "192.0.2.1",
+			expected: []string{"example.com."},
+		},
+		"ipv6": {
+			addr:     "2001:db8::1",
+			expected: []string{"example.com."},
+		},
+		"no such address": {
+			addr: "192.0.2.2",
+			err:  true,
+		},
+		"invalid address": {
+			addr: "example.com",
+			err:  true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := donut.New("", donut.WithTransport(zone))
+
+			names, err := r.LookupAddr(context.Background(), tt.addr)
+			if tt.err {
+				var dnsErr *net.DNSError
+				if !errors.As(err, &dnsErr) {
+					t.Fatalf("expected a *net.DNSError, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(names, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, names)
+			}
+		})
+	}
+}
+
+func TestResolver_LookupServFail(t *testing.T) {
+	r := donut.New("", donut.WithTransport(transportFunc(func(ctx context.Context, query []byte) ([]byte, error) {
+		return servFail(query), nil
+	})))
+
+	_, err := r.LookupHost(context.Background(), "example.com")
+
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsTemporary || dnsErr.IsNotFound {
+		t.Fatalf("expected a temporary error, got %v", err)
+	}
+}
@@ -7,6 +7,8 @@ package donut
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"strings"
 )
 
@@ -26,6 +28,173 @@ type Record struct {
 	Data  RData       `json:"data"`
 }
 
+// Message is a decoded DNS message.
+type Message struct {
+	ID                 uint16     `json:"id"`
+	Response           bool       `json:"response"`
+	Opcode             uint8      `json:"opcode"`
+	Authoritative      bool       `json:"authoritative"`
+	Truncated          bool       `json:"truncated"`
+	RecursionDesired   bool       `json:"recursion_desired"`
+	RecursionAvailable bool       `json:"recursion_available"`
+	AuthenticData      bool       `json:"authentic_data"`
+	CheckingDisabled   bool       `json:"checking_disabled"`
+	RCode              RCode      `json:"rcode"`
+	Questions          []Question `json:"questions"`
+	Answers            []Record   `json:"answers"`
+	Authority          []Record   `json:"authority,omitempty"`
+	Additional         []Record   `json:"additional,omitempty"`
+
+	// Comment is free form text attached to the response by the server, carried
+	// in the EXTRA-TEXT of an extended DNS error as described in
+	// https://datatracker.ietf.org/doc/html/rfc8914
+	Comment string `json:"comment,omitempty"`
+}
+
+// ParseMessage decodes a wire format DNS message.
+func ParseMessage(b []byte) (*Message, error) {
+	m := message{b}
+	return m.unpack()
+}
+
+// Pack encodes the message into wire format. The Data of every record must
+// hold its RDATA as a byte slice. Names are written without compression.
+func (m *Message) Pack() ([]byte, error) {
+	b := make([]byte, headerLen, 512)
+	binary.BigEndian.PutUint16(b[0:2], m.ID)
+
+	b[2] = (m.Opcode & 0x0F) << 3
+	if m.Response {
+		b[2] |= 0x80
+	}
+	if m.Authoritative {
+		b[2] |= 0x04
+	}
+	if m.Truncated {
+		b[2] |= 0x02
+	}
+	if m.RecursionDesired {
+		b[2] |= 0x01
+	}
+
+	b[3] = byte(m.RCode) & 0x0F
+	if m.RecursionAvailable {
+		b[3] |= 0x80
+	}
+	if m.AuthenticData {
+		b[3] |= 0x20
+	}
+	if m.CheckingDisabled {
+		b[3] |= 0x10
+	}
+
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(b[6:8], uint16(len(m.Answers)))
+	binary.BigEndian.PutUint16(b[8:10], uint16(len(m.Authority)))
+	binary.BigEndian.PutUint16(b[10:12], uint16(len(m.Additional)))
+
+	for _, q := range m.Questions {
+		b = append(b, encodeQuestion(q)...)
+	}
+
+	for _, section := range [][]Record{m.Answers, m.Authority, m.Additional} {
+		for _, rr := range section {
+			rdata, ok := rr.Data.([]byte)
+			if !ok {
+				return nil, fmt.Errorf("record %s has data of type %T, expected []byte", rr.Name, rr.Data)
+			}
+
+			if len(rdata) > 0xFFFF {
+				return nil, fmt.Errorf("record %s has data of %d octets", rr.Name, len(rdata))
+			}
+
+			b = appendName(b, rr.Name)
+			b = binary.BigEndian.AppendUint16(b, uint16(rr.Type))
+			b = binary.BigEndian.AppendUint16(b, uint16(rr.Class))
+			b = binary.BigEndian.AppendUint32(b, rr.TTL)
+			b = binary.BigEndian.AppendUint16(b, uint16(len(rdata)))
+			b = append(b, rdata...)
+		}
+	}
+
+	return b, nil
+}
+
+// NXDomain reports whether the message is a response saying that the name in
+// the question does not exist, as described in
+// https://datatracker.ietf.org/doc/html/rfc2308#section-2.1
+func (m *Message) NXDomain() bool {
+	return m.Response && m.RCode == NXDomain
+}
+
+// NoData reports whether the message is a response saying that the name in
+// the question exists but has no records of the requested type, as described
+// in https://datatracker.ietf.org/doc/html/rfc2308#section-2.2
+//
+// A response with NS records but no SOA record in the authority section is a
+// referral rather than a NODATA response.
+func (m *Message) NoData() bool {
+	if !m.Response || m.RCode != NoError || len(m.Questions) != 1 {
+		return false
+	}
+
+	for _, rr := range m.Answers {
+		if rr.Type == m.Questions[0].Type {
+			return false
+		}
+	}
+
+	var ns, soa bool
+	for _, rr := range m.Authority {
+		switch rr.Type {
+		case NS:
+			ns = true
+		case SOA:
+			soa = true
+		}
+	}
+
+	return soa || !ns
+}
+
+// NegativeTTL returns how long a negative response may be cached for, which is
+// the lower of the TTL of the SOA record in the authority section and its
+// MINIMUM field, as described in
+// https://datatracker.ietf.org/doc/html/rfc2308#section-5
+//
+// It reports false if the message has no SOA record, in which case the
+// response should not be cached.
+func (m *Message) NegativeTTL() (uint32, bool) {
+	for _, rr := range m.Authority {
+		if rr.Type != SOA {
+			continue
+		}
+
+		// The MINIMUM field is the last of the five 32 bit fields that follow
+		// the MNAME and RNAME of the SOA record.
+		rdata, ok := rr.Data.([]byte)
+		if !ok || len(rdata) < 22 {
+			return 0, false
+		}
+
+		return min(rr.TTL, binary.BigEndian.Uint32(rdata[len(rdata)-4:])), true
+	}
+
+	return 0, false
+}
+
+// echoOPT answers the OPT pseudo-record of the query req, if it has one, with
+// an OPT record advertising size and echoing the DO bit, carrying text as an
+// extended DNS error unless it is empty. An OPT record is only sent back to a
+// client that sent one, as required by
+// https://datatracker.ietf.org/doc/html/rfc6891#section-7
+func (m *Message) echoOPT(req *Message, size uint16, text string) {
+	if _, ok := findOPT(req.Additional); !ok {
+		return
+	}
+	m.Additional = []Record{newOPT(size, dnssecOK(req.Additional), text)}
+}
+
 func encodeMessage(q []Question) []byte {
 	message := bytes.NewBuffer(nil)
 
@@ -79,8 +248,9 @@ func encodeMessage(q []Question) []byte {
 	message.WriteByte((0 << 7) | (0 << 3) | (0 << 1) | 1)
 
 	// Opcode is a 4 bit field that specifies kind of query in this message. This
-	// is 0 for a standard query.
-	message.WriteByte(1 << 4)
+	// is 0 for a standard query. The remaining flags, including CD which would
+	// ask the server not to validate DNSSEC, and the RCODE are all 0 in a query.
+	message.WriteByte(0)
 
 	// QDCOUNT is a 16 bit field that specifies the number of entries in the
 	// question section. We're sending a single question so this is 1.
@@ -132,10 +302,11 @@ func encodeQuestion(q Question) []byte {
 	// domain name terminates with the zero length octet for the null label of the
 	// root. We need to convert the FQDN into this format.
 
-	labels := strings.Split(q.FQDN, ".")
-	for _, label := range labels {
-		question.WriteByte(byte(len(label)))
-		question.WriteString(label)
+	if name := strings.TrimSuffix(q.FQDN, "."); name != "" {
+		for _, label := range strings.Split(name, ".") {
+			question.WriteByte(byte(len(label)))
+			question.WriteString(label)
+		}
 	}
 	question.WriteByte(0)
 
@@ -159,30 +330,75 @@ type message struct {
 }
 
 func (m *message) parseMessage() ([]Record, error) {
+	msg, err := m.unpack()
+	if err != nil {
+		return nil, err
+	}
+	return msg.Answers, nil
+}
+
+func (m *message) unpack() (*Message, error) {
+	if len(m.buf) < headerLen {
+		return nil, errShortMessage
+	}
+
+	msg := &Message{
+		ID:                 binary.BigEndian.Uint16(m.buf[0:2]),
+		Response:           m.buf[2]&0x80 != 0,
+		Opcode:             (m.buf[2] >> 3) & 0x0F,
+		Authoritative:      m.buf[2]&0x04 != 0,
+		Truncated:          m.buf[2]&0x02 != 0,
+		RecursionDesired:   m.buf[2]&0x01 != 0,
+		RecursionAvailable: m.buf[3]&0x80 != 0,
+		AuthenticData:      m.buf[3]&0x20 != 0,
+		CheckingDisabled:   m.buf[3]&0x10 != 0,
+		RCode:              RCode(m.buf[3] & 0x0F),
+	}
+
 	qdcount := binary.BigEndian.Uint16(m.buf[4:6])
 	ancount := binary.BigEndian.Uint16(m.buf[6:8])
+	nscount := binary.BigEndian.Uint16(m.buf[8:10])
+	arcount := binary.BigEndian.Uint16(m.buf[10:12])
 
 	// Skip the header section and move to the question section.
-	buf := m.buf[12:]
+	offset := headerLen
+
+	var err error
+	for i := 0; i < int(qdcount); i++ {
+		var q Question
+		q, offset, err = m.decodeQuestion(offset)
+		if err != nil {
+			return nil, err
+		}
+		msg.Questions = append(msg.Questions, q)
+	}
 
-	// Loop through the number of questions, we're only interested in the answers.
-	var i uint16
-	for i = 0; i < qdcount; i++ {
-		_, offset := m.decodeQuestion(buf)
-		buf = buf[offset:]
+	sections := []struct {
+		count   uint16
+		records *[]Record
+	}{
+		{ancount, &msg.Answers},
+		{nscount, &msg.Authority},
+		{arcount, &msg.Additional},
 	}
 
-	answers := make([]Record, ancount)
-	for i = 0; i < ancount; i++ {
-		answer, offset := m.decodeAnswer(buf)
-		answers[i] = answer
-		buf = buf[offset:]
+	for _, section := range sections {
+		for i := 0; i < int(section.count); i++ {
+			var rr Record
+			rr, offset, err = m.decodeAnswer(offset)
+			if err != nil {
+				return nil, err
+			}
+			*section.records = append(*section.records, rr)
+		}
 	}
 
-	return answers, nil
+	msg.Comment = extendedErrorText(msg.Additional)
+
+	return msg, nil
 }
 
-func (m *message) decodeQuestion(q []byte) (Question, int) {
+func (m *message) decodeQuestion(offset int) (Question, int, error) {
 	// The question section is used to carry the "question" in most queries, i.e.,
 	// the parameters that define what is being asked. The section contains the
 	// following fields:
@@ -203,22 +419,29 @@ func (m *message) decodeQuestion(q []byte) (Question, int) {
 	// label consists of a length octet followed by that number of octets. The
 	// domain name terminates with the zero length octet for the null label of the
 	// root. We need to convert the FQDN into this format.
-	name, offset := m.parseName(q)
+	name, offset, err := m.parseName(offset)
+	if err != nil {
+		return Question{}, 0, err
+	}
+
+	if len(m.buf) < offset+4 {
+		return Question{}, 0, errShortMessage
+	}
 
 	// The QTYPE field specifies the type of the query.
-	qtype := binary.BigEndian.Uint16(q[offset : offset+2])
+	qtype := binary.BigEndian.Uint16(m.buf[offset : offset+2])
 
 	// The QCLASS field specifies the class of the query.
-	qclass := binary.BigEndian.Uint16(q[offset+2 : offset+4])
+	qclass := binary.BigEndian.Uint16(m.buf[offset+2 : offset+4])
 
 	return Question{
 		FQDN:  name,
 		Type:  RecordType(qtype),
 		Class: RecordClass(qclass),
-	}, offset + 4
+	}, offset + 4, nil
 }
 
-func (m *message) decodeAnswer(a []byte) (Record, int) {
+func (m *message) decodeAnswer(offset int) (Record, int, error) {
 	// The answer section is used to carry the "answer" in response to a
 	// query. The answer section contains the following fields:
 	//
@@ -244,29 +467,45 @@ func (m *message) decodeAnswer(a []byte) (Record, int) {
 	//  +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
 
 	// NAME is a domain name to which this resource record pertains.
-	name, offset := m.parseName(a)
+	name, offset, err := m.parseName(offset)
+	if err != nil {
+		return Record{}, 0, err
+	}
+
+	if len(m.buf) < offset+10 {
+		return Record{}, 0, errShortMessage
+	}
 
 	// TYPE is two octets containing one of the RR type codes. This field
 	// specifies the meaning of the data in the RDATA field.
-	qtype := binary.BigEndian.Uint16(a[offset : offset+2])
+	qtype := binary.BigEndian.Uint16(m.buf[offset : offset+2])
 
 	// CLASS is two octets which specify the class of the data in the RDATA field.
-	qclass := binary.BigEndian.Uint16(a[offset+2 : offset+4])
+	qclass := binary.BigEndian.Uint16(m.buf[offset+2 : offset+4])
 
 	// TTL is a 32 bit unsigned integer that specifies the time interval that the
 	// resource record may be cached before it should be discarded. Zero values
 	// are interpreted to mean that the RR can only be used for the transaction
 	// in progress, and should not be cached.
-	ttl := binary.BigEndian.Uint32(a[offset+4 : offset+8])
+	ttl := binary.BigEndian.Uint32(m.buf[offset+4 : offset+8])
 
 	// RDLENGTH is an unsigned 16 bit integer that specifies the length in octets
 	// of the RDATA field.
-	rdlength := binary.BigEndian.Uint16(a[offset+8 : offset+10])
+	rdlength := binary.BigEndian.Uint16(m.buf[offset+8 : offset+10])
+
+	start := offset + 10
+	end := start + int(rdlength)
+	if len(m.buf) < end {
+		return Record{}, 0, errShortMessage
+	}
 
 	// RDATA is a variable length string of octets that describes the resource.
 	// The format of this information varies according to the TYPE and CLASS of
 	// the resource record.
-	rdata := a[offset+10 : offset+10+int(rdlength)]
+	rdata, err := m.decompressRData(RecordType(qtype), start, end)
+	if err != nil {
+		return Record{}, 0, err
+	}
 
 	return Record{
 		Name:  name,
@@ -274,15 +513,71 @@ func (m *message) decodeAnswer(a []byte) (Record, int) {
 		Class: RecordClass(qclass),
 		TTL:   ttl,
 		Data:  rdata,
-	}, offset + 10 + int(rdlength)
+	}, end, nil
 }
 
-func (m *message) parseName(b []byte) (string, int) {
-	var name string
-	var offset int
+// decompressRData returns a copy of the RDATA between start and end with any
+// compressed domain names expanded, so that the RDATA can be understood
+// without the rest of the message. Only the types defined in RFC 1035 and SRV
+// may use compression.
+func (m *message) decompressRData(t RecordType, start, end int) ([]byte, error) {
+	var names, fixed int
+	switch t {
+	case NS, CNAME, PTR:
+		names = 1
+	case MX:
+		fixed = 2
+		names = 1
+	case SRV:
+		fixed = 6
+		names = 1
+	case SOA:
+		names = 2
+	default:
+		return append([]byte(nil), m.buf[start:end]...), nil
+	}
+
+	if end-start < fixed {
+		return nil, errShortMessage
+	}
+
+	rdata := append([]byte(nil), m.buf[start:start+fixed]...)
+	offset := start + fixed
+
+	for i := 0; i < names; i++ {
+		name, next, err := m.parseName(offset)
+		if err != nil {
+			return nil, err
+		}
+		if next > end {
+			return nil, errShortMessage
+		}
+		rdata = appendName(rdata, name)
+		offset = next
+	}
+
+	return append(rdata, m.buf[offset:end]...), nil
+}
+
+// parseName reads the domain name starting at offset in the message and
+// returns it along with the offset of the first octet following it.
+func (m *message) parseName(offset int) (string, int, error) {
+	var name []byte
+
+	// The offset following the name is the one immediately after the first
+	// pointer, if any, since the rest of the name is stored elsewhere.
+	next := -1
+
+	// Each pointer must move backwards through the message, which stops a
+	// malicious message from sending us round in circles.
+	limit := offset
 
 	for {
-		length := int(b[offset])
+		if offset >= len(m.buf) {
+			return "", 0, errShortMessage
+		}
+
+		length := int(m.buf[offset])
 		if length == 0 {
 			offset++
 			break
@@ -293,15 +588,99 @@ func (m *message) parseName(b []byte) (string, int) {
 		// represent the offset from the start of the message where the domain
 		// name is stored.
 		if length&0xC0 == 0xC0 {
-			ptr := binary.BigEndian.Uint16([]byte{b[offset], b[offset+1]}) & 0x3FFF
-			name, _ = m.parseName(m.buf[ptr:])
-			return name, 2
-		} else {
-			offset++
-			name += string(b[offset:offset+length]) + "."
-			offset += length
+			if offset+1 >= len(m.buf) {
+				return "", 0, errShortMessage
+			}
+
+			ptr := int(binary.BigEndian.Uint16(m.buf[offset:offset+2]) & 0x3FFF)
+			if ptr >= limit {
+				return "", 0, errors.New("invalid compression pointer")
+			}
+
+			if next < 0 {
+				next = offset + 2
+			}
+
+			offset, limit = ptr, ptr
+			continue
+		}
+
+		if length&0xC0 != 0 {
+			return "", 0, errors.New("invalid label length")
+		}
+
+		offset++
+		if offset+length > len(m.buf) {
+			return "", 0, errShortMessage
+		}
+
+		name = append(name, m.buf[offset:offset+length]...)
+		name = append(name, '.')
+		offset += length
+	}
+
+	if next < 0 {
+		next = offset
+	}
+
+	if len(name) == 0 {
+		return ".", next, nil
+	}
+
+	return string(name), next, nil
+}
+
+// appendName appends the uncompressed wire format of name to b.
+func appendName(b []byte, name string) []byte {
+	if name = strings.TrimSuffix(name, "."); name != "" {
+		for _, label := range strings.Split(name, ".") {
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0)
+}
+
+// ttlOffsets returns the offsets of the TTL field of every record in the
+// message, other than the OPT pseudo-record whose TTL field holds flags.
+func (m *message) ttlOffsets() ([]int, error) {
+	if len(m.buf) < headerLen {
+		return nil, errShortMessage
+	}
+
+	qdcount := binary.BigEndian.Uint16(m.buf[4:6])
+	rrcount := int(binary.BigEndian.Uint16(m.buf[6:8])) +
+		int(binary.BigEndian.Uint16(m.buf[8:10])) +
+		int(binary.BigEndian.Uint16(m.buf[10:12]))
+
+	offset := headerLen
+
+	var err error
+	for i := 0; i < int(qdcount); i++ {
+		if _, offset, err = m.decodeQuestion(offset); err != nil {
+			return nil, err
+		}
+	}
+
+	var offsets []int
+	for i := 0; i < rrcount; i++ {
+		if _, offset, err = m.parseName(offset); err != nil {
+			return nil, err
+		}
+
+		if len(m.buf) < offset+10 {
+			return nil, errShortMessage
+		}
+
+		if RecordType(binary.BigEndian.Uint16(m.buf[offset:])) != OPT {
+			offsets = append(offsets, offset+4)
+		}
+
+		offset += 10 + int(binary.BigEndian.Uint16(m.buf[offset+8:]))
+		if len(m.buf) < offset {
+			return nil, errShortMessage
 		}
 	}
 
-	return name, offset
+	return offsets, nil
 }
@@ -0,0 +1,215 @@
+package donut_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/tomasbasham/donut"
+)
+
+func TestParseMessage(t *testing.T) {
+	tests := map[string]struct {
+		msg      []byte
+		expected []donut.Record
+		err      bool
+	}{
+		"compressed names": {
+			msg: []byte{
+				0x12, 0x34, 0x81, 0x80, 0x00, 0x01, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00,
+				// www.example.com. A IN
+				0x03, 'w', 'w', 'w', 0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+				0x00, 0x01, 0x00, 0x01,
+				// www.example.com. CNAME cdn.example.com.
+				0xC0, 0x0C, 0x00, 0x05, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3C, 0x00, 0x06,
+				0x03, 'c', 'd', 'n', 0xC0, 0x10,
+				// cdn.example.com. A 192.0.2.1
+				0xC0, 0x2D, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3C, 0x00, 0x04,
+				192, 0, 2, 1,
+			},
+			expected: []donut.Record{
+				{Name: "www.example.com.", Type: donut.CNAME, Class: donut.IN, TTL: 60, Data: []byte("\x03cdn\x07example\x03com\x00")},
+				{Name: "cdn.example.com.", Type: donut.A, Class: donut.IN, TTL: 60, Data: []byte{192, 0, 2, 1}},
+			},
+		},
+		"pointer loop": {
+			msg: []byte{
+				0x12, 0x34, 0x81, 0x80, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0xC0, 0x0C, 0x00, 0x01, 0x00, 0x01,
+			},
+			err: true,
+		},
+		"truncated record": {
+			msg: []byte{
+				0x12, 0x34, 0x81, 0x80, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3C, 0x00, 0x04, 192,
+			},
+			err: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			msg, err := donut.ParseMessage(tt.msg)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(msg.Answers) != len(tt.expected) {
+				t.Fatalf("expected %d answers, got %d", len(tt.expected), len(msg.Answers))
+			}
+			for i, want := range tt.expected {
+				got := msg.Answers[i]
+				if got.Name != want.Name || got.Type != want.Type || got.TTL != want.TTL {
+					t.Errorf("expected %+v, got %+v", want, got)
+				}
+				if !bytes.Equal(got.Data.([]byte), want.Data.([]byte)) {
+					t.Errorf("expected data %q, got %q", want.Data, got.Data)
+				}
+			}
+		})
+	}
+}
+
+func TestMessage_Pack(t *testing.T) {
+	msg := &donut.Message{
+		ID:               0xBEEF,
+		Response:         true,
+		RecursionDesired: true,
+		RCode:            donut.NXDomain,
+		Questions:        []donut.Question{{FQDN: "example.com.", Type: donut.A, Class: donut.IN}},
+		Authority: []donut.Record{
+			{Name: "example.com.", Type: donut.SOA, Class: donut.IN, TTL: 300, Data: []byte("\x00\x00\x00\x00\x00\x01\x00\x00\x00\x02\x00\x00\x00\x03\x00\x00\x00\x04\x00\x00\x00\x05")},
+		},
+	}
+
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := donut.ParseMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.ID != msg.ID || !got.Response || !got.RecursionDesired || got.RCode != msg.RCode {
+		t.Errorf("unexpected header %+v", got)
+	}
+	if len(got.Questions) != 1 || got.Questions[0] != msg.Questions[0] {
+		t.Errorf("unexpected questions %+v", got.Questions)
+	}
+	if len(got.Authority) != 1 || got.Authority[0].Name != "example.com." || got.Authority[0].TTL != 300 {
+		t.Errorf("unexpected authority %+v", got.Authority)
+	}
+}
+
+// flagsTransport records the flags of the queries it is sent, answering each
+// with no records.
+type flagsTransport struct {
+	flags []byte
+}
+
+func (t *flagsTransport) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	t.flags = append([]byte(nil), query[2:4]...)
+
+	resp := append([]byte(nil), query...)
+	resp[2] |= 0x80
+	return resp, nil
+}
+
+func TestResolver_LookupQueryFlags(t *testing.T) {
+	transport := &flagsTransport{}
+	r := donut.New(donut.GoogleHost, donut.WithTransport(transport))
+
+	if _, err := r.LookupMessage(context.Background(), donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only RD is set. In particular CD is clear, so that the upstream
+	// validates DNSSEC.
+	if !bytes.Equal(transport.flags, []byte{0x01, 0x00}) {
+		t.Errorf("expected flags 0100, got %x", transport.flags)
+	}
+}
+
+func TestMessage_Negative(t *testing.T) {
+	question := []donut.Question{{FQDN: "www.example.com.", Type: donut.AAAA, Class: donut.IN}}
+
+	// example.com. SOA ns.example.com. admin.example.com. 1 7200 3600 1209600 60
+	soa := donut.Record{
+		Name:  "example.com.",
+		Type:  donut.SOA,
+		Class: donut.IN,
+		TTL:   300,
+		Data: []byte("\x02ns\x07example\x03com\x00\x05admin\x07example\x03com\x00" +
+			"\x00\x00\x00\x01\x00\x00\x1c\x20\x00\x00\x0e\x10\x00\x12\x75\x00\x00\x00\x00\x3c"),
+	}
+	ns := donut.Record{Name: "example.com.", Type: donut.NS, Class: donut.IN, TTL: 300, Data: []byte("\x02ns\x07example\x03com\x00")}
+	cname := donut.Record{Name: "www.example.com.", Type: donut.CNAME, Class: donut.IN, TTL: 300, Data: []byte("\x03cdn\x07example\x03com\x00")}
+	aaaa := donut.Record{Name: "www.example.com.", Type: donut.AAAA, Class: donut.IN, TTL: 300, Data: make([]byte, 16)}
+
+	tests := map[string]struct {
+		msg      donut.Message
+		nxdomain bool
+		nodata   bool
+		ttl      uint32
+		cache    bool
+	}{
+		"answer": {
+			msg: donut.Message{Response: true, Questions: question, Answers: []donut.Record{aaaa}},
+		},
+		"nxdomain": {
+			msg:      donut.Message{Response: true, RCode: donut.NXDomain, Questions: question, Authority: []donut.Record{soa}},
+			nxdomain: true,
+			ttl:      60,
+			cache:    true,
+		},
+		"nxdomain without soa": {
+			msg:      donut.Message{Response: true, RCode: donut.NXDomain, Questions: question},
+			nxdomain: true,
+		},
+		"nodata": {
+			msg:    donut.Message{Response: true, Questions: question, Authority: []donut.Record{soa}},
+			nodata: true,
+			ttl:    60,
+			cache:  true,
+		},
+		"nodata after cname": {
+			msg:    donut.Message{Response: true, Questions: question, Answers: []donut.Record{cname}, Authority: []donut.Record{soa}},
+			nodata: true,
+			ttl:    60,
+			cache:  true,
+		},
+		"nodata without authority": {
+			msg:    donut.Message{Response: true, Questions: question},
+			nodata: true,
+		},
+		"referral": {
+			msg: donut.Message{Response: true, Questions: question, Authority: []donut.Record{ns}},
+		},
+		"servfail": {
+			msg: donut.Message{Response: true, RCode: donut.ServFail, Questions: question},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tt.msg.NXDomain(); got != tt.nxdomain {
+				t.Errorf("expected NXDomain to be %v, got %v", tt.nxdomain, got)
+			}
+			if got := tt.msg.NoData(); got != tt.nodata {
+				t.Errorf("expected NoData to be %v, got %v", tt.nodata, got)
+			}
+
+			ttl, ok := tt.msg.NegativeTTL()
+			if ok != tt.cache || ttl != tt.ttl {
+				t.Errorf("expected negative TTL %d (%v), got %d (%v)", tt.ttl, tt.cache, ttl, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package donut
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Metrics records measurements of the queries looked up by a resolver, set
+// with WithMetrics. Its methods are called concurrently, with QueryStarted
+// and QueryDone called once each for every query, including those answered
+// from the cache.
+type Metrics interface {
+	// QueryStarted is called as a query starts to be looked up.
+	QueryStarted()
+
+	// QueryDone is called once the query has been answered or has failed.
+	QueryDone(o QueryObservation)
+
+	// RefreshDone is called once a query has been sent upstream in the
+	// background to refresh a response in the cache, with Cache being
+	// "prefetch" or "stale". The query that led to the refresh has been
+	// observed on its own already.
+	RefreshDone(o QueryObservation)
+}
+
+// QueryObservation describes a query looked up by a resolver.
+type QueryObservation struct {
+	// Type is the record type asked for.
+	Type RecordType
+
+	// RCode is the response code of the response, which is only meaningful
+	// if Err is nil.
+	RCode RCode
+
+	// Upstream is the server that answered the query, or empty if the query
+	// was answered without going upstream.
+	Upstream string
+
+	// Cache is the status of the response in the cache: "hit" if it was
+	// fresh, "prefetch" if it was fresh but refreshed as it neared expiry,
+	// "stale" if it had expired but the upstream server could not answer,
+	// and "miss" if the query was sent upstream. It is empty if the resolver
+	// has no cache or the query could not be cached.
+	Cache string
+
+	// Hosts is set if the query was answered from the hosts file or static
+	// records set with WithHosts.
+	Hosts bool
+
+	// Latency is how long it took to answer the query.
+	Latency time.Duration
+
+	// Err is the error looking up the query, if it failed.
+	Err error
+}
+
+func newQueryObservation(query []byte, msg message, src source, err error, latency time.Duration) QueryObservation {
+	o := QueryObservation{
+		Upstream: src.upstream,
+		Cache:    src.cache,
+		Hosts:    src.hosts,
+		Latency:  latency,
+		Err:      err,
+	}
+
+	m := message{query}
+	if len(query) > headerLen && binary.BigEndian.Uint16(query[4:6]) > 0 {
+		if q, _, err := m.decodeQuestion(headerLen); err == nil {
+			o.Type = q.Type
+		}
+	}
+
+	if err == nil && len(msg.buf) >= headerLen {
+		o.RCode = RCode(msg.buf[3] & 0x0F)
+	}
+
+	return o
+}
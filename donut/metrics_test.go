@@ -0,0 +1,130 @@
+package donut_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/tomasbasham/donut"
+)
+
+// metricsRecorder records the queries observed by a resolver.
+type metricsRecorder struct {
+	mu           sync.Mutex
+	started      int
+	observations []donut.QueryObservation
+	refreshes    []donut.QueryObservation
+}
+
+func (m *metricsRecorder) QueryStarted() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.started++
+}
+
+func (m *metricsRecorder) QueryDone(o donut.QueryObservation) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observations = append(m.observations, o)
+}
+
+func (m *metricsRecorder) RefreshDone(o donut.QueryObservation) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refreshes = append(m.refreshes, o)
+}
+
+func TestResolver_Metrics(t *testing.T) {
+	s := newPlainServer(t)
+
+	failing := transportFunc(func(ctx context.Context, query []byte) ([]byte, error) {
+		return nil, errors.New("upstream failed")
+	})
+
+	tests := map[string]struct {
+		resolver     func(m donut.Metrics) *donut.Resolver
+		lookups      int
+		observations []donut.QueryObservation
+	}{
+		"upstream": {
+			resolver: func(m donut.Metrics) *donut.Resolver {
+				return donut.New(donut.GoogleHost, donut.WithTransport(upstream), donut.WithMetrics(m))
+			},
+			lookups: 1,
+			observations: []donut.QueryObservation{
+				{Type: donut.A, RCode: donut.NoError, Upstream: donut.GoogleHost},
+			},
+		},
+		"cache": {
+			resolver: func(m donut.Metrics) *donut.Resolver {
+				return donut.New(donut.GoogleHost, donut.WithTransport(upstream), donut.WithCache(donut.NewCache(10)), donut.WithMetrics(m))
+			},
+			lookups: 2,
+			observations: []donut.QueryObservation{
+				{Type: donut.A, RCode: donut.NoError, Upstream: donut.GoogleHost, Cache: "miss"},
+				{Type: donut.A, RCode: donut.NoError, Cache: "hit"},
+			},
+		},
+		"failure": {
+			resolver: func(m donut.Metrics) *donut.Resolver {
+				return donut.New(donut.GoogleHost, donut.WithTransport(failing), donut.WithMetrics(m))
+			},
+			lookups: 1,
+			observations: []donut.QueryObservation{
+				{Type: donut.A, Upstream: donut.GoogleHost, Err: errors.New("upstream failed")},
+			},
+		},
+		"hosts": {
+			resolver: func(m donut.Metrics) *donut.Resolver {
+				return donut.New(donut.GoogleHost, donut.WithTransport(upstream), donut.WithMetrics(m),
+					donut.WithHosts(donut.HostsConfig{Static: map[string][]string{"host.example": {"192.0.2.1"}}}))
+			},
+			lookups: 1,
+			observations: []donut.QueryObservation{
+				{Type: donut.A, RCode: donut.NoError, Hosts: true},
+			},
+		},
+		"upstream that answered": {
+			resolver: func(m donut.Metrics) *donut.Resolver {
+				return donut.New("udp://127.0.0.1:1", donut.WithUpstreams("udp://"+s.addr), donut.WithMetrics(m))
+			},
+			lookups: 1,
+			observations: []donut.QueryObservation{
+				{Type: donut.A, RCode: donut.NoError, Upstream: "udp://" + s.addr},
+			},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			m := &metricsRecorder{}
+
+			r := tt.resolver(m)
+			defer r.Close()
+
+			for range tt.lookups {
+				r.Lookup(donut.Question{FQDN: "host.example.", Type: donut.A, Class: donut.IN})
+			}
+
+			if m.started != tt.lookups {
+				t.Errorf("expected %d queries started, got %d", tt.lookups, m.started)
+			}
+			if len(m.observations) != len(tt.observations) {
+				t.Fatalf("expected %d observations, got %d: %+v", len(tt.observations), len(m.observations), m.observations)
+			}
+			for i, expected := range tt.observations {
+				o := m.observations[i]
+				if o.Latency <= 0 {
+					t.Errorf("observation %d: expected a latency, got %v", i, o.Latency)
+				}
+				if (o.Err == nil) != (expected.Err == nil) || (o.Err != nil && o.Err.Error() != expected.Err.Error()) {
+					t.Errorf("observation %d: expected error %v, got %v", i, expected.Err, o.Err)
+				}
+				o.Latency, o.Err, expected.Err = 0, nil, nil
+				if o != expected {
+					t.Errorf("observation %d: expected %+v, got %+v", i, expected, o)
+				}
+			}
+		})
+	}
+}
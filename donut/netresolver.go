@@ -0,0 +1,209 @@
+package donut
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+// minUDPSize is the largest response a client that does not advertise a UDP
+// payload size with EDNS(0) is able to receive, as described in
+// https://datatracker.ietf.org/doc/html/rfc1035#section-4.2.1
+const minUDPSize = 512
+
+// NetResolver returns a *net.Resolver that answers every query made through it
+// with the resolver, so that code using the net package, such as net.Dial and
+// http.Client, resolves names over DoH or any other transport of the resolver
+// without changing call sites:
+//
+//	net.DefaultResolver = r.NetResolver()
+//
+// The net package still builds the queries itself, which means the hosts file,
+// search domains and other options of the system configuration are honoured
+// as they would otherwise be. Only the name servers it sends queries to are
+// replaced, by connections that never leave the process.
+func (r *Resolver) NetResolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial:     r.dialNet,
+	}
+}
+
+// dialNet returns one end of an in-memory connection whose other end answers
+// the DNS messages written to it. The address of the name server is ignored.
+func (r *Resolver) dialNet(ctx context.Context, network, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+
+	switch network {
+	case "udp", "udp4", "udp6":
+		go r.servePacket(server)
+
+		// The net package frames messages over connections that are not a
+		// net.PacketConn as it would over TCP.
+		return &packetConn{client}, nil
+	case "tcp", "tcp4", "tcp6":
+		go r.serveStream(server)
+		return client, nil
+	default:
+		client.Close()
+		server.Close()
+		return nil, net.UnknownNetworkError(network)
+	}
+}
+
+// servePacket answers queries written to the connection as datagrams, each
+// read in a single call. Responses larger than the query allows for are
+// truncated so that the client retries over TCP.
+func (r *Resolver) servePacket(conn net.Conn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer conn.Close()
+
+	buf := make([]byte, 0xFFFF)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			resp := r.answer(ctx, query)
+			if resp == nil {
+				return
+			}
+			conn.Write(truncate(query, resp))
+		}()
+	}
+}
+
+// serveStream answers queries written to the connection, each prefixed with
+// its two octet length.
+func (r *Resolver) serveStream(conn net.Conn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer conn.Close()
+
+	for {
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		go func() {
+			resp := r.answer(ctx, query)
+			if resp == nil {
+				return
+			}
+
+			// Writes to a pipe are atomic, so the length and message are
+			// written together to keep concurrent responses apart.
+			conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+		}()
+	}
+}
+
+// answer looks up the query, answering with a server failure if the lookup
+// fails so that the client gives up on it straight away rather than waiting
+// for a timeout. Nothing is returned for a query that cannot be parsed.
+func (r *Resolver) answer(ctx context.Context, query []byte) []byte {
+	if len(query) < headerLen {
+		return nil
+	}
+
+	resp, err := r.LookupRawContext(ctx, query)
+	if err != nil {
+		return failure(query)
+	}
+
+	return resp
+}
+
+// failure returns a SERVFAIL response to the query, holding only its
+// question.
+func failure(query []byte) []byte {
+	resp := headerAndQuestion(query)
+	if resp == nil {
+		return nil
+	}
+
+	resp[2] = resp[2]&0x79 | 0x80
+	resp[3] = resp[3]&0xF0 | byte(ServFail)
+
+	return resp
+}
+
+// truncate returns the response cut down to its header and question with the
+// TC bit set if it is larger than the UDP payload size advertised by the
+// query, as described in
+// https://datatracker.ietf.org/doc/html/rfc6891#section-6.2.3
+func truncate(query, resp []byte) []byte {
+	size := minUDPSize
+
+	m := message{query}
+	if msg, err := m.unpack(); err == nil {
+		if opt, ok := findOPT(msg.Additional); ok {
+			size = max(size, int(opt.Class))
+		}
+	}
+
+	if len(resp) <= size {
+		return resp
+	}
+
+	truncated := headerAndQuestion(resp)
+	if truncated == nil {
+		return resp
+	}
+	truncated[2] |= 0x02
+
+	return truncated
+}
+
+// headerAndQuestion returns a copy of the header and question of a message,
+// with the counts of the other sections set to zero.
+func headerAndQuestion(b []byte) []byte {
+	if len(b) < headerLen {
+		return nil
+	}
+
+	end := headerLen
+	if binary.BigEndian.Uint16(b[4:6]) > 0 {
+		m := message{b}
+
+		var err error
+		if _, end, err = m.decodeQuestion(headerLen); err != nil {
+			return nil
+		}
+	}
+
+	msg := append([]byte(nil), b[:end]...)
+	if end > headerLen {
+		binary.BigEndian.PutUint16(msg[4:6], 1)
+	}
+	clear(msg[6:12])
+
+	return msg
+}
+
+// packetConn is the client end of an in-memory connection on which every
+// message is a datagram, which the net package needs it to be a
+// net.PacketConn to recognise.
+type packetConn struct {
+	net.Conn
+}
+
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.RemoteAddr(), err
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.Write(b)
+}
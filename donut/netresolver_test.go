@@ -0,0 +1,123 @@
+package donut_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tomasbasham/donut"
+)
+
+func TestResolver_NetResolver(t *testing.T) {
+	// A response with these records is too large for the UDP payload size the
+	// net package advertises, so it must retry over TCP.
+	big := slices.Clone(zone)
+	for i := 0; i < 8; i++ {
+		txt := strings.Repeat(string(rune('a'+i)), 200)
+		big = append(big, donut.Record{Name: "big.example.com.", Type: donut.TXT, Class: donut.IN, TTL: 300, Data: append([]byte{200}, txt...)})
+	}
+
+	r := donut.New("", donut.WithTransport(big))
+	defer r.Close()
+
+	resolver := r.NetResolver()
+	ctx := context.Background()
+
+	t.Run("host", func(t *testing.T) {
+		addrs, err := resolver.LookupHost(ctx, "example.com.")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		slices.Sort(addrs)
+		expected := []string{"192.0.2.1", "2001:db8::1"}
+		if !slices.Equal(addrs, expected) {
+			t.Errorf("expected %v, got %v", expected, addrs)
+		}
+	})
+
+	t.Run("cname", func(t *testing.T) {
+		cname, err := resolver.LookupCNAME(ctx, "web.example.com.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cname != "example.com." {
+			t.Errorf("expected example.com., got %q", cname)
+		}
+	})
+
+	t.Run("mx", func(t *testing.T) {
+		mxs, err := resolver.LookupMX(ctx, "example.com.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(mxs) != 2 || mxs[0].Host != "mx1.example.com." {
+			t.Errorf("unexpected mail exchangers %v", mxs)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		txts, err := resolver.LookupTXT(ctx, "big.example.com.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(txts) != 8 {
+			t.Errorf("expected 8 records, got %d", len(txts))
+		}
+	})
+
+	t.Run("no such host", func(t *testing.T) {
+		_, err := resolver.LookupHost(ctx, "missing.example.com.")
+
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Fatalf("expected a not found error, got %v", err)
+		}
+	})
+}
+
+func TestResolver_NetResolverFailure(t *testing.T) {
+	var calls atomic.Int32
+	r := donut.New("", donut.WithTransport(transportFunc(func(ctx context.Context, query []byte) ([]byte, error) {
+		calls.Add(1)
+		return nil, errRefused
+	})))
+	defer r.Close()
+
+	_, err := r.NetResolver().LookupHost(context.Background(), "example.com.")
+
+	// A failed lookup is answered straight away rather than left to time
+	// out, which the net package reports as a temporary failure.
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || dnsErr.IsNotFound || dnsErr.IsTimeout {
+		t.Fatalf("expected a server failure, got %v", err)
+	}
+	if calls.Load() == 0 {
+		t.Error("expected the transport to be used")
+	}
+}
+
+func TestResolver_NetResolverDial(t *testing.T) {
+	r := donut.New("", donut.WithTransport(zone))
+	defer r.Close()
+
+	dial := r.NetResolver().Dial
+
+	conn, err := dial(context.Background(), "udp", "127.0.0.53:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, ok := conn.(net.PacketConn); !ok {
+		t.Error("expected a net.PacketConn for udp")
+	}
+
+	if _, err := dial(context.Background(), "unix", "/run/dns"); err == nil {
+		t.Error("expected an error for an unknown network")
+	}
+}
@@ -0,0 +1,182 @@
+package donut
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/tomasbasham/donut/internal/odoh"
+)
+
+// errODoHKeyMismatch is returned when the target no longer recognises the key
+// a query was encrypted with.
+var errODoHKeyMismatch = errors.New("odoh: target rejected key")
+
+// odohTransport sends queries to an Oblivious DNS over HTTPS target through a
+// relay, as described in https://datatracker.ietf.org/doc/html/rfc9230
+//
+// Queries are encrypted to the target's public key so that the relay, which
+// knows who is asking, cannot see the question, while the target, which sees
+// the question, does not know who is asking.
+type odohTransport struct {
+	configURL string
+	relayURL  string
+
+	// client fetches the configuration from the target, while relayClient
+	// sends queries to the relay.
+	client      *http.Client
+	relayClient *http.Client
+
+	mu     sync.Mutex
+	config *odoh.Config
+}
+
+func (r *Resolver) newODoHTransport(e endpoint) (*odohTransport, error) {
+	if r.relay == "" {
+		return nil, errors.New("oblivious DNS over HTTPS requires a relay, see WithRelay")
+	}
+
+	relay, err := url.Parse(r.relay)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay %q: %w", r.relay, err)
+	}
+
+	path := e.path
+	if path == "" {
+		path = "/dns-query"
+	}
+
+	// The relay learns where to forward the query from the query parameters
+	// described in https://datatracker.ietf.org/doc/html/rfc9230#section-4.1
+	params := relay.Query()
+	params.Set("targethost", e.authority())
+	params.Set("targetpath", path)
+	relay.RawQuery = params.Encode()
+
+	client, err := r.newHTTPClient(e)
+	if err != nil {
+		return nil, err
+	}
+
+	// The relay is a server of its own, so it is not authenticated by the
+	// name, pins or certificate hashes of the target, nor dialled at its
+	// address.
+	port := relay.Port()
+	if port == "" {
+		port = "443"
+	}
+	relayClient, err := r.newHTTPClient(endpoint{scheme: "https", host: relay.Hostname(), port: port, relay: true})
+	if err != nil {
+		return nil, err
+	}
+
+	return &odohTransport{
+		configURL:   "https://" + e.authority() + "/.well-known/odohconfigs",
+		relayURL:    relay.String(),
+		client:      client,
+		relayClient: relayClient,
+	}, nil
+}
+
+func (t *odohTransport) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	resp, err := t.exchange(ctx, query)
+
+	// The target may have rotated its key since we fetched its configuration,
+	// in which case we fetch it again and retry once with the new key.
+	if errors.Is(err, errODoHKeyMismatch) {
+		t.mu.Lock()
+		t.config = nil
+		t.mu.Unlock()
+
+		resp, err = t.exchange(ctx, query)
+	}
+
+	return resp, err
+}
+
+func (t *odohTransport) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	config, err := t.getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, qctx, err := config.EncryptQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.relayURL, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", odoh.ContentType)
+	req.Header.Set("Content-Type", odoh.ContentType)
+
+	resp, err := t.relayClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, errODoHKeyMismatch
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{StatusCode: resp.StatusCode}
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return qctx.DecryptResponse(body)
+}
+
+// getConfig returns the target's configuration, fetching it from the target
+// the first time it is needed.
+func (t *odohTransport) getConfig(ctx context.Context) (*odoh.Config, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.config != nil {
+		return t.config, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", t.configURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching odoh configs: %w", &StatusError{StatusCode: resp.StatusCode})
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	configs, err := odoh.ParseConfigs(body)
+	if err != nil {
+		return nil, err
+	}
+
+	t.config = &configs[0]
+	return t.config, nil
+}
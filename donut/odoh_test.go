@@ -0,0 +1,234 @@
+package donut_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/tomasbasham/donut"
+	"github.com/tomasbasham/donut/internal/odoh"
+)
+
+// odohTarget is an Oblivious DoH target answering every query with an A
+// record. Its key can be rotated to simulate a target changing keys between
+// a client fetching its configuration and sending a query.
+type odohTarget struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	key     *odoh.KeyPair
+	fetches int
+}
+
+func newODoHTarget(t *testing.T) *odohTarget {
+	t.Helper()
+
+	target := &odohTarget{}
+	target.rotate(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/odohconfigs", func(w http.ResponseWriter, r *http.Request) {
+		target.mu.Lock()
+		defer target.mu.Unlock()
+
+		target.fetches++
+		w.Write(odoh.MarshalConfigs(target.key.Config))
+	})
+	mux.HandleFunc("/dns-query", func(w http.ResponseWriter, r *http.Request) {
+		target.mu.Lock()
+		key := target.key
+		target.mu.Unlock()
+
+		body, _ := io.ReadAll(r.Body)
+		query, qctx, err := key.DecryptQuery(body)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		resp, err := qctx.EncryptResponse(answerA(query, net.IPv4(192, 0, 2, 1), 300))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", odoh.ContentType)
+		w.Write(resp)
+	})
+
+	target.Server = httptest.NewTLSServer(mux)
+	t.Cleanup(target.Close)
+
+	return target
+}
+
+func (target *odohTarget) rotate(t *testing.T) {
+	key, err := odoh.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	target.key = key
+}
+
+// newODoHRelay returns a relay that forwards queries to the target named in
+// the request, recording the bodies it sees. The relay serves cert if given,
+// and the certificate of httptest servers otherwise.
+func newODoHRelay(t *testing.T, client *http.Client, cert *tls.Certificate, seen *[][]byte) *httptest.Server {
+	t.Helper()
+
+	relay := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		*seen = append(*seen, body)
+
+		target := "https://" + r.URL.Query().Get("targethost") + r.URL.Query().Get("targetpath")
+		resp, err := client.Post(target, r.Header.Get("Content-Type"), bytes.NewReader(body))
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	if cert != nil {
+		relay.TLS = &tls.Config{Certificates: []tls.Certificate{*cert}}
+	}
+	relay.StartTLS()
+	t.Cleanup(relay.Close)
+
+	return relay
+}
+
+func TestResolver_LookupODoH(t *testing.T) {
+	target := newODoHTarget(t)
+
+	var seen [][]byte
+	relay := newODoHRelay(t, target.Client(), nil, &seen)
+
+	r := donut.New("odoh://"+target.Listener.Addr().String(), donut.WithRelay(relay.URL+"/proxy"), donut.WithClient(target.Client()))
+
+	question := donut.Question{FQDN: "secret.example", Type: donut.A, Class: donut.IN}
+
+	// The steps depend on one another so they run in order.
+	tests := []struct {
+		name    string
+		rotate  bool
+		fetches int
+	}{
+		{name: "first query", fetches: 1},
+		{name: "cached config", fetches: 1},
+		{name: "rotated key", rotate: true, fetches: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.rotate {
+				target.rotate(t)
+			}
+
+			answer, err := r.Lookup(question)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(answer) != 1 || answer[0].Name != "secret.example." {
+				t.Fatalf("unexpected answer: %+v", answer)
+			}
+
+			target.mu.Lock()
+			defer target.mu.Unlock()
+			if target.fetches != tt.fetches {
+				t.Errorf("expected %d config fetches, got %d", tt.fetches, target.fetches)
+			}
+		})
+	}
+
+	for _, body := range seen {
+		if bytes.Contains(body, []byte("secret")) {
+			t.Error("expected the relay not to see the question")
+		}
+	}
+}
+
+func TestResolver_LookupODoHAuthenticated(t *testing.T) {
+	target := newODoHTarget(t)
+
+	// The relay has a certificate for dns.example, unlike the target, so
+	// it can only be reached if it is authenticated on its own.
+	cert, pool := newTestCertificate(t)
+	pool.AddCert(target.Certificate())
+
+	var seen [][]byte
+	relay := newODoHRelay(t, target.Client(), &cert, &seen)
+	_, port, _ := net.SplitHostPort(relay.Listener.Addr().String())
+
+	targetPin := donut.Pin(target.Certificate())
+	relayPin := donut.Pin(cert.Leaf)
+	other := "sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+
+	tests := map[string]struct {
+		pins       map[string][]string
+		serverName string
+		err        func(err error) bool
+	}{
+		"root CA pool": {},
+		"pinned target": {
+			pins: map[string][]string{"127.0.0.1": {targetPin}},
+		},
+		"pinned relay": {
+			pins: map[string][]string{"dns.example": {relayPin}},
+		},
+		"pinned target and relay": {
+			pins: map[string][]string{"127.0.0.1": {targetPin}, "dns.example": {relayPin}},
+		},
+		"server name": {
+			serverName: "example.com",
+		},
+		"mismatched relay pin": {
+			pins: map[string][]string{"dns.example": {other}},
+			err: func(err error) bool {
+				var pinErr *donut.PinError
+				return errors.As(err, &pinErr) && pinErr.Host == "dns.example"
+			},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := donut.New("odoh://"+target.Listener.Addr().String(),
+				donut.WithRelay("https://dns.example:"+port+"/proxy"),
+				donut.WithRootCAs(pool),
+				donut.WithPins(tt.pins),
+				donut.WithServerName(tt.serverName),
+				donut.WithBootstrap(map[string][]string{"dns.example": {"127.0.0.1"}}))
+			defer r.Close()
+
+			_, err := r.Lookup(donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN})
+			if tt.err != nil {
+				if err == nil || !tt.err(err) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestResolver_LookupODoHWithoutRelay(t *testing.T) {
+	r := donut.New("odoh://odoh.example")
+
+	_, err := r.Lookup(donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -1,17 +1,229 @@
 package donut
 
-import "net/http"
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log/slog"
+	"net/http"
+	"strings"
+)
 
 type option func(r *Resolver)
 
+// WithDebug adds a dump of every query sent and response received, decoded in
+// the style of dig, to the events logged by the resolver. Unless a logger is
+// set with WithLogger, events are logged to standard error.
 func WithDebug() option {
 	return func(r *Resolver) {
 		r.debug = true
 	}
 }
 
+// WithLogger sets the logger to which the resolver logs queries sent upstream
+// and the responses received, with their latency, upstream server and
+// response code, as well as queries answered from the cache, all at the debug
+// level. Queries that fail are logged as warnings.
+func WithLogger(l *slog.Logger) option {
+	return func(r *Resolver) {
+		r.logger = l
+	}
+}
+
 func WithClient(c *http.Client) option {
 	return func(r *Resolver) {
 		r.client = c
 	}
 }
+
+// WithTransport sets the transport used to exchange messages with the
+// upstream server, ignoring the scheme of the host given to New.
+func WithTransport(t Transport) option {
+	return func(r *Resolver) {
+		r.transport = t
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used to connect to the upstream
+// server.
+func WithTLSConfig(c *tls.Config) option {
+	return func(r *Resolver) {
+		r.tlsConfig = c
+	}
+}
+
+// WithServerName sets the name used to authenticate the upstream server and
+// sent in the TLS server name indication. This is needed when the server is
+// given by IP address.
+func WithServerName(name string) option {
+	return func(r *Resolver) {
+		r.serverName = name
+	}
+}
+
+// WithRelay sets the URL of the relay through which queries are sent to an
+// Oblivious DNS over HTTPS target.
+func WithRelay(url string) option {
+	return func(r *Resolver) {
+		r.relay = url
+	}
+}
+
+// WithCache sets the cache used to answer queries without going to the
+// upstream server. A cache may be shared by several resolvers.
+func WithCache(c *Cache) option {
+	return func(r *Resolver) {
+		r.cache = c
+	}
+}
+
+// WithUpstreams adds upstream servers to send queries to besides the host
+// given to New, in any of the forms accepted by New. Servers that fail are
+// benched for a time that grows with every consecutive failure.
+func WithUpstreams(servers ...string) option {
+	return func(r *Resolver) {
+		r.upstreams = append(r.upstreams, servers...)
+	}
+}
+
+// WithStrategy sets how queries are spread between the upstream servers. The
+// default is Failover.
+func WithStrategy(s Strategy) option {
+	return func(r *Resolver) {
+		r.strategy = s
+	}
+}
+
+// WithRetry retries queries that fail according to the policy, such as
+// DefaultRetryPolicy. By default a query is sent only once.
+func WithRetry(p RetryPolicy) option {
+	return func(r *Resolver) {
+		r.retry = &p
+	}
+}
+
+// WithFollowAliases makes Lookup and LookupMessage follow CNAME and DNAME
+// records until the records of the type asked for are found, sending further
+// queries when an upstream answers with only part of the chain. At most limit
+// aliases are followed, or DefaultMaxAliases if limit is not positive.
+func WithFollowAliases(limit int) option {
+	return func(r *Resolver) {
+		if limit <= 0 {
+			limit = DefaultMaxAliases
+		}
+		r.maxAliases = limit
+	}
+}
+
+// WithIterative resolves names iteratively, starting from the root servers and
+// following referrals to the servers authoritative for each name over plain
+// DNS, rather than sending queries to an upstream recursive resolver.
+func WithIterative(c IterativeConfig) option {
+	return func(r *Resolver) {
+		r.iterative = &c
+	}
+}
+
+// WithResolvConf applies the search list and ndots option of a resolv.conf
+// file, such as one read with LoadResolvConf, to names that are not fully
+// qualified, trying them as the stub resolver in glibc does. If the host
+// given to New is empty, queries are also sent to the name servers of the
+// file with its timeout and attempts.
+func WithResolvConf(c *ResolvConf) option {
+	return func(r *Resolver) {
+		r.resolvConf = c
+	}
+}
+
+// WithHosts answers queries for the names in a hosts file and static records
+// before going upstream, including PTR queries for their addresses. The file
+// is read again whenever it changes.
+func WithHosts(c HostsConfig) option {
+	return func(r *Resolver) {
+		r.hostsConf = &c
+	}
+}
+
+// WithBatchConcurrency sets how many questions LookupBatch looks up at the
+// same time, or DefaultBatchConcurrency if n is not positive.
+func WithBatchConcurrency(n int) option {
+	return func(r *Resolver) {
+		r.batchConcurrency = n
+	}
+}
+
+// WithMetrics records every query looked up by the resolver, such as with the
+// PrometheusMetrics returned by NewPrometheusMetrics. Metrics may be shared by
+// several resolvers.
+func WithMetrics(m Metrics) option {
+	return func(r *Resolver) {
+		r.metrics = m
+	}
+}
+
+// WithInterceptors wraps every exchange of a query with the upstream in the
+// interceptors, such as to trace it with any tracing library. The first
+// interceptor given is the outermost. See Interceptor for the queries that
+// are not intercepted.
+func WithInterceptors(interceptors ...Interceptor) option {
+	return func(r *Resolver) {
+		r.interceptors = append(r.interceptors, interceptors...)
+	}
+}
+
+// WithBootstrap sets the addresses of upstream hosts, so that connecting to
+// them does not depend on the system resolver. This matters when the resolver
+// serves the system itself, such as in a proxy listening on port 53.
+func WithBootstrap(addrs map[string][]string) option {
+	return func(r *Resolver) {
+		if r.bootstrapAddrs == nil {
+			r.bootstrapAddrs = make(map[string][]string)
+		}
+		for host, a := range addrs {
+			host = strings.ToLower(strings.TrimSuffix(host, "."))
+			r.bootstrapAddrs[host] = append(r.bootstrapAddrs[host], a...)
+		}
+	}
+}
+
+// WithBootstrapServers sets plain DNS servers, such as udp://9.9.9.9 or
+// 1.1.1.1:53, used to resolve upstream hosts that have no addresses set with
+// WithBootstrap instead of the system resolver. The servers are tried in
+// order.
+func WithBootstrapServers(servers ...string) option {
+	return func(r *Resolver) {
+		r.bootstrapServers = append(r.bootstrapServers, servers...)
+	}
+}
+
+// WithRootCAs sets the certificate authorities trusted to sign the
+// certificates of upstream servers, instead of those of the system. This
+// allows private servers behind an internal CA.
+func WithRootCAs(pool *x509.CertPool) option {
+	return func(r *Resolver) {
+		r.rootCAs = pool
+	}
+}
+
+// WithClientCertificate sets the certificate presented to upstream servers
+// that ask for one, for mutual TLS.
+func WithClientCertificate(cert tls.Certificate) option {
+	return func(r *Resolver) {
+		r.certificates = append(r.certificates, cert)
+	}
+}
+
+// WithPins sets the public keys that each upstream host must present, as
+// returned by Pin. A connection is refused with a PinError unless a
+// certificate in the chain has one of the pinned keys. Hosts without pins are
+// verified as usual.
+func WithPins(pins map[string][]string) option {
+	return func(r *Resolver) {
+		if r.pinSets == nil {
+			r.pinSets = make(map[string][]string)
+		}
+		for host, p := range pins {
+			host = strings.ToLower(strings.TrimSuffix(host, "."))
+			r.pinSets[host] = append(r.pinSets[host], p...)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package donut
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// PinError is returned when no certificate presented by an upstream server
+// has a public key matching the pins set for its host with WithPins.
+type PinError struct {
+	Host string
+
+	// Got holds the pins of the certificates the server presented, so that
+	// the pins can be updated if the server has legitimately changed keys.
+	Got []string
+}
+
+func (e *PinError) Error() string {
+	return fmt.Sprintf("tls: no certificate presented by %s matches its pinned public keys, got %s", e.Host, strings.Join(e.Got, ", "))
+}
+
+// Pin returns the pin of a certificate, which is the base64 encoded SHA-256
+// hash of its DER encoded SubjectPublicKeyInfo prefixed with "sha256/", as
+// described in https://datatracker.ietf.org/doc/html/rfc7469#section-2.4
+func Pin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// parsePins decodes the pin sets set with WithPins, which may be given with
+// or without the "sha256/" prefix.
+func parsePins(sets map[string][]string) (map[string][][]byte, error) {
+	if len(sets) == 0 {
+		return nil, nil
+	}
+
+	pins := make(map[string][][]byte, len(sets))
+	for host, set := range sets {
+		for _, pin := range set {
+			sum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+			if err != nil || len(sum) != sha256.Size {
+				return nil, fmt.Errorf("invalid pin %q for %s: expected a base64 encoded SHA-256 hash", pin, host)
+			}
+			pins[host] = append(pins[host], sum)
+		}
+	}
+
+	return pins, nil
+}
+
+// verifyPins returns a function that checks that a certificate in the chain
+// presented by host has one of the pinned public keys, in addition to any
+// verification already configured. The verified chains are used when the
+// certificate has been verified, so that a pin may also match a root from the
+// configured pool.
+func verifyPins(host string, pins [][]byte, next func([][]byte, [][]*x509.Certificate) error) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if next != nil {
+			if err := next(rawCerts, verifiedChains); err != nil {
+				return err
+			}
+		}
+
+		var certs []*x509.Certificate
+		for _, chain := range verifiedChains {
+			certs = append(certs, chain...)
+		}
+		if len(verifiedChains) == 0 {
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return err
+				}
+				certs = append(certs, cert)
+			}
+		}
+
+		var got []string
+		for _, cert := range certs {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(sum[:], pin) {
+					return nil
+				}
+			}
+			got = append(got, Pin(cert))
+		}
+
+		return &PinError{Host: host, Got: got}
+	}
+}
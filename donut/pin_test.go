@@ -0,0 +1,152 @@
+package donut_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/tomasbasham/donut"
+)
+
+func dohHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(answerA(query, net.IPv4(192, 0, 2, 1), 300))
+}
+
+func TestResolver_LookupPinned(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(dohHandler))
+	defer s.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+
+	pin := donut.Pin(s.Certificate())
+	other := "sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+
+	tests := map[string]struct {
+		resolver func(server string) *donut.Resolver
+		err      func(err error) bool
+	}{
+		"untrusted": {
+			resolver: func(server string) *donut.Resolver {
+				return donut.New(server)
+			},
+			err: func(err error) bool {
+				var unknown x509.UnknownAuthorityError
+				return errors.As(err, &unknown)
+			},
+		},
+		"root CA pool": {
+			resolver: func(server string) *donut.Resolver {
+				return donut.New(server, donut.WithRootCAs(pool))
+			},
+		},
+		"matching pin": {
+			resolver: func(server string) *donut.Resolver {
+				return donut.New(server, donut.WithRootCAs(pool), donut.WithPins(map[string][]string{"127.0.0.1": {other, pin}}))
+			},
+		},
+		"pin without prefix": {
+			resolver: func(server string) *donut.Resolver {
+				return donut.New(server, donut.WithRootCAs(pool), donut.WithPins(map[string][]string{"127.0.0.1": {pin[len("sha256/"):]}}))
+			},
+		},
+		"mismatched pin": {
+			resolver: func(server string) *donut.Resolver {
+				return donut.New(server, donut.WithRootCAs(pool), donut.WithPins(map[string][]string{"127.0.0.1": {other}}))
+			},
+			err: func(err error) bool {
+				var pinErr *donut.PinError
+				return errors.As(err, &pinErr) && pinErr.Host == "127.0.0.1" && slices.Contains(pinErr.Got, pin)
+			},
+		},
+		"pin for another host": {
+			resolver: func(server string) *donut.Resolver {
+				return donut.New(server, donut.WithRootCAs(pool), donut.WithPins(map[string][]string{"dns.example": {other}}))
+			},
+		},
+		"invalid pin": {
+			resolver: func(server string) *donut.Resolver {
+				return donut.New(server, donut.WithRootCAs(pool), donut.WithPins(map[string][]string{"127.0.0.1": {"sha256/not a pin"}}))
+			},
+			err: func(err error) bool {
+				return err != nil
+			},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := tt.resolver(s.URL + "/dns-query")
+			defer r.Close()
+
+			_, err := r.Lookup(donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN})
+			if tt.err != nil {
+				if err == nil || !tt.err(err) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestResolver_LookupClientCertificate(t *testing.T) {
+	cert, pool := newTestCertificate(t)
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(dohHandler))
+	s.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}
+	s.StartTLS()
+	defer s.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Certificate())
+
+	tests := map[string]struct {
+		resolver func(server string) *donut.Resolver
+		err      bool
+	}{
+		"with certificate": {
+			resolver: func(server string) *donut.Resolver {
+				return donut.New(server, donut.WithRootCAs(roots), donut.WithClientCertificate(cert))
+			},
+		},
+		"without certificate": {
+			resolver: func(server string) *donut.Resolver {
+				return donut.New(server, donut.WithRootCAs(roots))
+			},
+			err: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := tt.resolver(s.URL + "/dns-query")
+			defer r.Close()
+
+			_, err := r.Lookup(donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN})
+			if tt.err && err == nil {
+				t.Fatal("expected an error")
+			}
+			if !tt.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
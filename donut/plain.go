@@ -0,0 +1,152 @@
+package donut
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+)
+
+// defaultUDPTimeout bounds how long to wait for a response over UDP when the
+// context has no deadline, since a lost datagram would otherwise leave us
+// waiting forever.
+const defaultUDPTimeout = 5 * time.Second
+
+// udpTransport sends queries to a plain DNS server over UDP, as described in
+// https://datatracker.ietf.org/doc/html/rfc1035#section-4.2.1
+//
+// Truncated responses are retried over TCP as described in
+// https://datatracker.ietf.org/doc/html/rfc7766#section-5
+type udpTransport struct {
+	addr string
+	dial dialFunc
+	tcp  *streamTransport
+}
+
+// dialFunc connects to an address on the named network, as the DialContext
+// method of net.Dialer does.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// newUDPTransport creates a transport for plain DNS over UDP, connecting with
+// dial. Upstream servers are dialled with the dialContext of the resolver, so
+// that their hosts are resolved by the bootstrap, while the bootstrap servers
+// themselves are dialled directly.
+func newUDPTransport(e endpoint, dial dialFunc) *udpTransport {
+	return &udpTransport{
+		addr: e.addr(),
+		dial: dial,
+		tcp:  newTCPTransport(e, dial),
+	}
+}
+
+// newTCPTransport creates a transport for plain DNS over TCP, connecting with
+// dial.
+func newTCPTransport(e endpoint, dial dialFunc) *streamTransport {
+	return &streamTransport{
+		addr: e.addr(),
+		dial: func(ctx context.Context, addr string) (net.Conn, error) {
+			return dial(ctx, "tcp", addr)
+		},
+	}
+}
+
+func (t *udpTransport) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) < headerLen {
+		return nil, errShortMessage
+	}
+
+	resp, err := t.exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp[2]&0x02 != 0 {
+		return t.tcp.Exchange(ctx, query)
+	}
+
+	return resp, nil
+}
+
+func (t *udpTransport) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := t.dial(ctx, "udp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultUDPTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	// Unblock the read below as soon as the caller gives up.
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	// A random ID, along with the random source port chosen when dialing,
+	// makes it harder for an attacker to spoof a response as described in
+	// https://datatracker.ietf.org/doc/html/rfc5452
+	id := uint16(rand.Uint32())
+	msg := append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(msg, id)
+
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0xFFFF)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		// Anything that is not a response to our question is ignored rather
+		// than treated as an error, since it may have been sent by an attacker
+		// hoping to disrupt the exchange.
+		resp := buf[:n]
+		if n < headerLen || binary.BigEndian.Uint16(resp) != id || resp[2]&0x80 == 0 || !sameQuestion(msg, resp) {
+			continue
+		}
+
+		resp = append([]byte(nil), resp...)
+		copy(resp, query[:2])
+		return resp, nil
+	}
+}
+
+// Close closes the TCP connection used for truncated responses, if any.
+func (t *udpTransport) Close() error {
+	return t.tcp.Close()
+}
+
+// sameQuestion reports whether the response answers the question of the
+// query. Names are compared without regard to case since servers are free to
+// change it.
+func sameQuestion(query, resp []byte) bool {
+	qm, rm := message{query}, message{resp}
+	if binary.BigEndian.Uint16(query[4:6]) == 0 {
+		return true
+	}
+
+	if binary.BigEndian.Uint16(resp[4:6]) == 0 {
+		return false
+	}
+
+	q, _, err := qm.decodeQuestion(headerLen)
+	if err != nil {
+		return false
+	}
+
+	r, _, err := rm.decodeQuestion(headerLen)
+	if err != nil {
+		return false
+	}
+
+	return q.Type == r.Type && q.Class == r.Class && strings.EqualFold(q.FQDN, r.FQDN)
+}
@@ -0,0 +1,142 @@
+package donut_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tomasbasham/donut"
+)
+
+// plainServer is a DNS server listening on UDP and TCP on the same port. Over
+// UDP it first sends a response with the wrong ID, then truncates responses
+// to names beginning with "big".
+type plainServer struct {
+	addr string
+	tcp  atomic.Int32
+}
+
+func newPlainServer(t *testing.T) *plainServer {
+	t.Helper()
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udp.Close() })
+
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tcp.Close() })
+
+	s := &plainServer{addr: udp.LocalAddr().String()}
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := append([]byte(nil), buf[:n]...)
+
+			spoofed := answerA(query, net.IPv4(203, 0, 113, 1), 300)
+			binary.BigEndian.PutUint16(spoofed, binary.BigEndian.Uint16(query)+1)
+			udp.WriteTo(spoofed, addr)
+
+			resp := answerA(query, net.IPv4(192, 0, 2, 1), 300)
+			if bytes.Contains(query, []byte("\x03big")) {
+				resp = append([]byte(nil), query...)
+				resp[2] |= 0x82
+			}
+			udp.WriteTo(resp, addr)
+		}
+	}()
+
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			s.tcp.Add(1)
+
+			go func() {
+				defer conn.Close()
+				for {
+					var length [2]byte
+					if _, err := io.ReadFull(conn, length[:]); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(length[:]))
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+					resp := answerA(query, net.IPv4(192, 0, 2, 2), 300)
+					conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+				}
+			}()
+		}
+	}()
+
+	return s
+}
+
+func TestResolver_LookupPlain(t *testing.T) {
+	s := newPlainServer(t)
+
+	tests := map[string]struct {
+		server   string
+		name     string
+		expected net.IP
+		tcp      int32
+	}{
+		"udp": {
+			server:   "udp://" + s.addr,
+			name:     "example.com",
+			expected: net.IPv4(192, 0, 2, 1),
+		},
+		"truncated": {
+			server:   "udp://" + s.addr,
+			name:     "big.example.com",
+			expected: net.IPv4(192, 0, 2, 2),
+			tcp:      1,
+		},
+		"tcp": {
+			server:   "tcp://" + s.addr,
+			name:     "example.com",
+			expected: net.IPv4(192, 0, 2, 2),
+			tcp:      1,
+		},
+		"stamp": {
+			server:   donut.Stamp{Protocol: donut.StampPlain, Addr: s.addr}.String(),
+			name:     "example.com",
+			expected: net.IPv4(192, 0, 2, 1),
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			s.tcp.Store(0)
+
+			r := donut.New(tt.server)
+			defer r.Close()
+
+			answer, err := r.Lookup(donut.Question{FQDN: tt.name, Type: donut.A, Class: donut.IN})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(answer) != 1 || !bytes.Equal(answer[0].Data.([]byte), tt.expected.To4()) {
+				t.Errorf("unexpected answer: %+v", answer)
+			}
+			if got := s.tcp.Load(); got != tt.tcp {
+				t.Errorf("expected %d TCP connections, got %d", tt.tcp, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package donut
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy decides which upstream servers a query is sent to when a resolver
+// has more than one.
+type Strategy int
+
+const (
+	// Failover sends queries to the upstream servers in the order they were
+	// given, moving on to the next when one fails.
+	Failover Strategy = iota
+
+	// Random sends each query to a randomly chosen upstream server.
+	Random
+
+	// RoundRobin sends queries to each upstream server in turn.
+	RoundRobin
+
+	// Fastest sends queries to the upstream server with the lowest average
+	// latency.
+	Fastest
+
+	// Race sends each query to every upstream server at once, and uses the
+	// first good response.
+	Race
+)
+
+var strategyNames = map[Strategy]string{
+	Failover:   "failover",
+	Random:     "random",
+	RoundRobin: "round-robin",
+	Fastest:    "fastest",
+	Race:       "race",
+}
+
+// String returns the name of the strategy.
+func (s Strategy) String() string {
+	if name, ok := strategyNames[s]; ok {
+		return name
+	}
+	return "Strategy(" + fmt.Sprint(int(s)) + ")"
+}
+
+// ParseStrategy returns the strategy with the given name, as returned by
+// Strategy.String.
+func ParseStrategy(name string) (Strategy, error) {
+	for s, n := range strategyNames {
+		if n == name {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown strategy %q", name)
+}
+
+const (
+	// latencyWeight is the weight given to the latest sample when updating
+	// the moving average latency of an upstream server.
+	latencyWeight = 0.3
+
+	// minBackoff and maxBackoff bound how long a failing upstream server is
+	// benched for. The time doubles with every consecutive failure.
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+)
+
+// errUpstreamTimeout is the cause of a context that ran out of the time given
+// to a single upstream server, which counts as a failure of the server rather
+// than of the caller.
+var errUpstreamTimeout = errors.New("upstream server timed out")
+
+// poolTransport sends queries to several upstream servers according to a
+// strategy. Servers that fail or time out are benched, and only used again
+// once their backoff has passed or every other server is benched too.
+type poolTransport struct {
+	strategy  Strategy
+	upstreams []*upstream
+	next      atomic.Uint32
+	now       func() time.Time
+}
+
+// upstream is an upstream server in a pool along with its health.
+type upstream struct {
+	server    string
+	transport Transport
+
+	mu       sync.Mutex
+	latency  time.Duration
+	failures int
+	benched  time.Time
+}
+
+func (r *Resolver) newPoolTransport(servers []string) (*poolTransport, error) {
+	p := &poolTransport{
+		strategy: r.strategy,
+		now:      time.Now,
+	}
+
+	for _, server := range servers {
+		t, err := r.newTransport(server)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.upstreams = append(p.upstreams, &upstream{server: server, transport: t})
+	}
+
+	return p, nil
+}
+
+func (p *poolTransport) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	upstreams := p.order()
+
+	if p.strategy == Race {
+		return p.race(ctx, upstreams, query)
+	}
+
+	var resp []byte
+	var errs []error
+	for i, u := range upstreams {
+		uctx, cancel := share(ctx, len(upstreams)-i)
+		buf, err := p.exchange(uctx, u, query)
+		cancel()
+		if err == nil && !upstreamFailed(buf) {
+			recordUpstream(ctx, u.server)
+			return buf, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			recordUpstream(ctx, u.server)
+			resp = buf
+		}
+	}
+
+	// A failure reported by the server is more useful to the caller than an
+	// error.
+	if resp != nil {
+		return resp, nil
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// share bounds the exchange with one of the n upstream servers left to try to
+// its share of the time left before the deadline of the context, if any, so
+// that a server that hangs leaves time for those after it.
+func share(ctx context.Context, n int) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok || n <= 1 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, time.Until(deadline)/time.Duration(n), errUpstreamTimeout)
+}
+
+// race sends the query to every upstream server at once, returning the first
+// good response and cancelling the other exchanges.
+func (p *poolTransport) race(ctx context.Context, upstreams []*upstream, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type raceResult struct {
+		upstream *upstream
+		exchangeResult
+	}
+
+	results := make(chan raceResult, len(upstreams))
+	for _, u := range upstreams {
+		go func() {
+			resp, err := p.exchange(ctx, u, query)
+			results <- raceResult{u, exchangeResult{buf: resp, err: err}}
+		}()
+	}
+
+	var resp []byte
+	var errs []error
+	for range upstreams {
+		res := <-results
+		if res.err == nil && !upstreamFailed(res.buf) {
+			recordUpstream(ctx, res.upstream.server)
+			return res.buf, nil
+		}
+		if res.err != nil {
+			errs = append(errs, res.err)
+		} else {
+			recordUpstream(ctx, res.upstream.server)
+			resp = res.buf
+		}
+	}
+
+	if resp != nil {
+		return resp, nil
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// exchange sends the query to a single upstream server, recording its health.
+func (p *poolTransport) exchange(ctx context.Context, u *upstream, query []byte) ([]byte, error) {
+	start := p.now()
+	resp, err := u.transport.Exchange(ctx, query)
+
+	// An exchange cut short by the caller says nothing about the server,
+	// unlike one that ran out of the time it was given.
+	if ctx.Err() != nil && !errors.Is(context.Cause(ctx), errUpstreamTimeout) {
+		return resp, err
+	}
+
+	if err != nil || upstreamFailed(resp) {
+		u.fail(p.now())
+	} else {
+		u.succeed(p.now().Sub(start))
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", u.server, err)
+	}
+
+	return resp, nil
+}
+
+// order returns the upstream servers in the order they should be tried,
+// according to the strategy. Benched servers come last.
+func (p *poolTransport) order() []*upstream {
+	now := p.now()
+
+	var healthy, benched []*upstream
+	for _, u := range p.upstreams {
+		if u.isBenched(now) {
+			benched = append(benched, u)
+		} else {
+			healthy = append(healthy, u)
+		}
+	}
+
+	switch p.strategy {
+	case Random:
+		rand.Shuffle(len(healthy), func(i, j int) {
+			healthy[i], healthy[j] = healthy[j], healthy[i]
+		})
+	case RoundRobin:
+		if len(healthy) > 0 {
+			n := int(p.next.Add(1)-1) % len(healthy)
+			healthy = append(healthy[n:], healthy[:n]...)
+		}
+	case Fastest:
+		// Servers without a measured latency sort first, so that every server
+		// is tried at least once.
+		slices.SortStableFunc(healthy, func(a, b *upstream) int {
+			return cmp.Compare(a.averageLatency(), b.averageLatency())
+		})
+	}
+
+	// Racing benched servers would only add load to servers that are already
+	// struggling, unless there is nothing else to use.
+	if p.strategy == Race && len(healthy) > 0 {
+		return healthy
+	}
+
+	return append(healthy, benched...)
+}
+
+// Close closes the transports of every upstream server.
+func (p *poolTransport) Close() error {
+	var errs []error
+	for _, u := range p.upstreams {
+		errs = append(errs, closeTransport(u.transport))
+	}
+	return errors.Join(errs...)
+}
+
+func (u *upstream) isBenched(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return now.Before(u.benched)
+}
+
+func (u *upstream) averageLatency() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.latency
+}
+
+// fail benches the server for twice as long as the last time it failed.
+func (u *upstream) fail(now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	backoff := min(minBackoff<<min(u.failures, 16), maxBackoff)
+	u.failures++
+	u.benched = now.Add(backoff)
+}
+
+// succeed clears the failures of the server and updates its moving average
+// latency.
+func (u *upstream) succeed(latency time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.failures = 0
+	u.benched = time.Time{}
+
+	if u.latency == 0 {
+		u.latency = latency
+	} else {
+		u.latency = time.Duration(latencyWeight*float64(latency) + (1-latencyWeight)*float64(u.latency))
+	}
+}
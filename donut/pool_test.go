@@ -0,0 +1,271 @@
+package donut_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tomasbasham/donut"
+)
+
+// dohServer is a DNS over HTTPS server answering with its own address, which
+// can be made to fail, fail a number of times or go slow on demand.
+type dohServer struct {
+	*httptest.Server
+	ip       net.IP
+	hits     atomic.Int32
+	fail     atomic.Bool
+	failNext atomic.Int32
+	delay    atomic.Int64
+}
+
+func newDoHServer(t *testing.T, ip net.IP) *dohServer {
+	t.Helper()
+
+	s := &dohServer{ip: ip}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.hits.Add(1)
+
+		query, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		select {
+		case <-time.After(time.Duration(s.delay.Load())):
+		case <-r.Context().Done():
+			return
+		}
+
+		if n := s.failNext.Load(); s.fail.Load() || n > 0 && s.failNext.CompareAndSwap(n, n-1) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(answerA(query, s.ip, 300))
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *dohServer) url() string {
+	return s.URL + "/dns-query"
+}
+
+// newPool starts n DoH servers answering with 192.0.2.1, 192.0.2.2 and so on.
+func newPool(t *testing.T, n int) []*dohServer {
+	servers := make([]*dohServer, n)
+	for i := range servers {
+		servers[i] = newDoHServer(t, net.IPv4(192, 0, 2, byte(i+1)))
+	}
+	return servers
+}
+
+func newPoolResolver(servers []*dohServer, strategy donut.Strategy) *donut.Resolver {
+	var urls []string
+	for _, s := range servers[1:] {
+		urls = append(urls, s.url())
+	}
+
+	// Every httptest server uses the same certificate, so any of their clients
+	// trusts them all.
+	return donut.New(servers[0].url(),
+		donut.WithUpstreams(urls...),
+		donut.WithStrategy(strategy),
+		donut.WithClient(servers[0].Client()))
+}
+
+func lookupIP(t *testing.T, r *donut.Resolver) net.IP {
+	t.Helper()
+
+	answer, err := r.Lookup(donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answer) != 1 {
+		t.Fatalf("unexpected answer: %+v", answer)
+	}
+
+	return net.IP(answer[0].Data.([]byte))
+}
+
+func hits(servers []*dohServer) []int32 {
+	h := make([]int32, len(servers))
+	for i, s := range servers {
+		h[i] = s.hits.Load()
+	}
+	return h
+}
+
+func TestResolver_LookupFailover(t *testing.T) {
+	servers := newPool(t, 3)
+	servers[0].fail.Store(true)
+
+	r := newPoolResolver(servers, donut.Failover)
+	defer r.Close()
+
+	for i := 0; i < 3; i++ {
+		if ip := lookupIP(t, r); !ip.Equal(servers[1].ip) {
+			t.Errorf("expected %s, got %s", servers[1].ip, ip)
+		}
+	}
+
+	// The failing server is benched after the first query.
+	if got := hits(servers); got[0] != 1 || got[1] != 3 || got[2] != 0 {
+		t.Errorf("unexpected hits: %v", got)
+	}
+}
+
+func TestResolver_LookupFailoverTimeout(t *testing.T) {
+	servers := newPool(t, 2)
+	servers[0].delay.Store(int64(5 * time.Second))
+
+	r := newPoolResolver(servers, donut.Failover)
+	defer r.Close()
+
+	// The first server hangs rather than failing, which must leave time for
+	// the second to answer.
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		answer, err := r.LookupContext(ctx, donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN})
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(answer) != 1 || !bytes.Equal(answer[0].Data.([]byte), servers[1].ip.To4()) {
+			t.Errorf("expected %s, got %+v", servers[1].ip, answer)
+		}
+	}
+
+	// The hanging server is benched after the first query.
+	if got := hits(servers); got[0] != 1 || got[1] != 2 {
+		t.Errorf("unexpected hits: %v", got)
+	}
+}
+
+func TestResolver_LookupRoundRobin(t *testing.T) {
+	servers := newPool(t, 3)
+
+	r := newPoolResolver(servers, donut.RoundRobin)
+	defer r.Close()
+
+	for i := 0; i < 6; i++ {
+		if ip := lookupIP(t, r); !ip.Equal(servers[i%3].ip) {
+			t.Errorf("query %d: expected %s, got %s", i, servers[i%3].ip, ip)
+		}
+	}
+}
+
+func TestResolver_LookupRandom(t *testing.T) {
+	servers := newPool(t, 2)
+
+	r := newPoolResolver(servers, donut.Random)
+	defer r.Close()
+
+	for i := 0; i < 50; i++ {
+		lookupIP(t, r)
+	}
+
+	if got := hits(servers); got[0] == 0 || got[1] == 0 {
+		t.Errorf("expected queries to be spread between servers, got %v", got)
+	}
+}
+
+func TestResolver_LookupFastest(t *testing.T) {
+	servers := newPool(t, 2)
+	servers[0].delay.Store(int64(50 * time.Millisecond))
+
+	r := newPoolResolver(servers, donut.Fastest)
+	defer r.Close()
+
+	// Each server is measured once before the fastest is preferred.
+	for i := 0; i < 5; i++ {
+		lookupIP(t, r)
+	}
+
+	if got := hits(servers); got[0] != 1 || got[1] != 4 {
+		t.Errorf("unexpected hits: %v", got)
+	}
+}
+
+func TestResolver_LookupRace(t *testing.T) {
+	tests := map[string]struct {
+		setup    func(servers []*dohServer)
+		expected net.IP
+		err      bool
+	}{
+		"fastest wins": {
+			setup: func(servers []*dohServer) {
+				servers[0].delay.Store(int64(time.Second))
+			},
+			expected: net.IPv4(192, 0, 2, 2),
+		},
+		"failure ignored": {
+			setup: func(servers []*dohServer) {
+				servers[1].fail.Store(true)
+				servers[0].delay.Store(int64(50 * time.Millisecond))
+			},
+			expected: net.IPv4(192, 0, 2, 1),
+		},
+		"all fail": {
+			setup: func(servers []*dohServer) {
+				servers[0].fail.Store(true)
+				servers[1].fail.Store(true)
+			},
+			err: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			servers := newPool(t, 2)
+			tt.setup(servers)
+
+			r := newPoolResolver(servers, donut.Race)
+			defer r.Close()
+
+			start := time.Now()
+			answer, err := r.Lookup(donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN})
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(answer) != 1 || !bytes.Equal(answer[0].Data.([]byte), tt.expected.To4()) {
+				t.Errorf("expected %s, got %+v", tt.expected, answer)
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("expected the fastest answer to win, took %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestParseStrategy(t *testing.T) {
+	for _, s := range []donut.Strategy{donut.Failover, donut.Random, donut.RoundRobin, donut.Fastest, donut.Race} {
+		got, err := donut.ParseStrategy(s.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != s {
+			t.Errorf("expected %s, got %s", s, got)
+		}
+	}
+
+	if _, err := donut.ParseStrategy("fastest-first"); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,258 @@
+package donut
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets of the
+// latency histograms, from a response cached on the same host to an upstream
+// server at the limit of its timeout.
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// PrometheusMetrics is Metrics that serves what it has recorded in the
+// Prometheus text exposition format, as described in
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+type PrometheusMetrics struct {
+	inFlight atomic.Int64
+
+	mu              sync.Mutex
+	queries         map[queryLabels]uint64
+	errors          map[queryLabels]uint64
+	cache           map[string]uint64
+	refreshes       map[refreshLabels]uint64
+	refreshErrors   map[refreshLabels]uint64
+	latency         histogram
+	upstreamLatency map[string]*histogram
+}
+
+// queryLabels are the labels by which queries are counted. The response code
+// is left empty when counting errors.
+type queryLabels struct {
+	t        RecordType
+	rcode    string
+	upstream string
+}
+
+// refreshLabels are the labels by which refreshes of the cache are counted.
+// The response code is left empty when counting errors.
+type refreshLabels struct {
+	status   string
+	rcode    string
+	upstream string
+}
+
+// histogram counts observations into latencyBuckets, the last count being of
+// those above every bucket.
+type histogram struct {
+	counts []uint64
+	sum    float64
+	total  uint64
+}
+
+// NewPrometheusMetrics creates metrics to be set on one or more resolvers with
+// WithMetrics, and served over HTTP or written with WriteTo.
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		queries:         make(map[queryLabels]uint64),
+		errors:          make(map[queryLabels]uint64),
+		cache:           make(map[string]uint64),
+		refreshes:       make(map[refreshLabels]uint64),
+		refreshErrors:   make(map[refreshLabels]uint64),
+		upstreamLatency: make(map[string]*histogram),
+	}
+}
+
+func (m *PrometheusMetrics) QueryStarted() {
+	m.inFlight.Add(1)
+}
+
+func (m *PrometheusMetrics) QueryDone(o QueryObservation) {
+	m.inFlight.Add(-1)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if o.Err != nil {
+		m.errors[queryLabels{t: o.Type, upstream: o.Upstream}]++
+	} else {
+		m.queries[queryLabels{t: o.Type, rcode: o.RCode.String(), upstream: o.Upstream}]++
+	}
+
+	if o.Cache != "" {
+		m.cache[o.Cache]++
+	}
+
+	seconds := o.Latency.Seconds()
+	m.latency.observe(seconds)
+
+	if o.Upstream != "" {
+		h, ok := m.upstreamLatency[o.Upstream]
+		if !ok {
+			h = &histogram{}
+			m.upstreamLatency[o.Upstream] = h
+		}
+		h.observe(seconds)
+	}
+}
+
+func (m *PrometheusMetrics) RefreshDone(o QueryObservation) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if o.Err != nil {
+		m.refreshErrors[refreshLabels{status: o.Cache, upstream: o.Upstream}]++
+		return
+	}
+	m.refreshes[refreshLabels{status: o.Cache, rcode: o.RCode.String(), upstream: o.Upstream}]++
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets)+1)
+	}
+
+	i, _ := slices.BinarySearch(latencyBuckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.total++
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+
+	m.mu.Lock()
+
+	writeHeader(&b, "donut_queries_total", "counter", "Queries answered, by record type, response code and the upstream server that answered, which is empty for those answered locally.")
+	for _, l := range sortedKeys(m.queries, compareQueryLabels) {
+		fmt.Fprintf(&b, "donut_queries_total{type=%s,rcode=%s,upstream=%s} %d\n",
+			quoteLabel(l.t.String()), quoteLabel(l.rcode), quoteLabel(l.upstream), m.queries[l])
+	}
+
+	writeHeader(&b, "donut_query_errors_total", "counter", "Queries that failed without a response, by record type and the last upstream server tried.")
+	for _, l := range sortedKeys(m.errors, compareQueryLabels) {
+		fmt.Fprintf(&b, "donut_query_errors_total{type=%s,upstream=%s} %d\n",
+			quoteLabel(l.t.String()), quoteLabel(l.upstream), m.errors[l])
+	}
+
+	writeHeader(&b, "donut_cache_lookups_total", "counter", "Queries looked up in the cache, by whether the response was a hit, prefetch, stale or miss.")
+	statuses := make([]string, 0, len(m.cache))
+	for status := range m.cache {
+		statuses = append(statuses, status)
+	}
+	slices.Sort(statuses)
+	var hits, lookups uint64
+	for _, status := range statuses {
+		fmt.Fprintf(&b, "donut_cache_lookups_total{result=%s} %d\n", quoteLabel(status), m.cache[status])
+		if status != "miss" {
+			hits += m.cache[status]
+		}
+		lookups += m.cache[status]
+	}
+
+	writeHeader(&b, "donut_cache_hit_ratio", "gauge", "Share of the queries looked up in the cache that were answered from it.")
+	ratio := 0.0
+	if lookups > 0 {
+		ratio = float64(hits) / float64(lookups)
+	}
+	fmt.Fprintf(&b, "donut_cache_hit_ratio %s\n", formatFloat(ratio))
+
+	writeHeader(&b, "donut_cache_refreshes_total", "counter", "Queries sent upstream in the background to refresh the cache, by the status of the cached response, response code and the upstream server that answered.")
+	for _, l := range sortedKeys(m.refreshes, compareRefreshLabels) {
+		fmt.Fprintf(&b, "donut_cache_refreshes_total{status=%s,rcode=%s,upstream=%s} %d\n",
+			quoteLabel(l.status), quoteLabel(l.rcode), quoteLabel(l.upstream), m.refreshes[l])
+	}
+
+	writeHeader(&b, "donut_cache_refresh_errors_total", "counter", "Refreshes of the cache that failed without a response, by the status of the cached response and the last upstream server tried.")
+	for _, l := range sortedKeys(m.refreshErrors, compareRefreshLabels) {
+		fmt.Fprintf(&b, "donut_cache_refresh_errors_total{status=%s,upstream=%s} %d\n",
+			quoteLabel(l.status), quoteLabel(l.upstream), m.refreshErrors[l])
+	}
+
+	writeHeader(&b, "donut_query_duration_seconds", "histogram", "Time taken to answer queries, wherever they were answered from.")
+	m.latency.write(&b, "donut_query_duration_seconds", "")
+
+	writeHeader(&b, "donut_upstream_query_duration_seconds", "histogram", "Time taken to answer queries sent upstream, by the upstream server that answered.")
+	upstreams := make([]string, 0, len(m.upstreamLatency))
+	for upstream := range m.upstreamLatency {
+		upstreams = append(upstreams, upstream)
+	}
+	slices.Sort(upstreams)
+	for _, upstream := range upstreams {
+		m.upstreamLatency[upstream].write(&b, "donut_upstream_query_duration_seconds", "upstream="+quoteLabel(upstream)+",")
+	}
+
+	m.mu.Unlock()
+
+	writeHeader(&b, "donut_queries_in_flight", "gauge", "Queries being looked up.")
+	fmt.Fprintf(&b, "donut_queries_in_flight %d\n", m.inFlight.Load())
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// write writes the buckets, sum and count of the histogram, with labels being
+// any labels to put before the bucket bound, each followed by a comma.
+func (h *histogram) write(b *strings.Builder, name, labels string) {
+	var cumulative uint64
+	for i, bound := range latencyBuckets {
+		if h.counts != nil {
+			cumulative += h.counts[i]
+		}
+		fmt.Fprintf(b, "%s_bucket{%sle=%q} %d\n", name, labels, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(b, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.total)
+
+	if labels != "" {
+		labels = "{" + strings.TrimSuffix(labels, ",") + "}"
+	}
+	fmt.Fprintf(b, "%s_sum%s %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(b, "%s_count%s %d\n", name, labels, h.total)
+}
+
+func writeHeader(b *strings.Builder, name, kind, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sortedKeys returns the labels counted in order, so that the output is
+// stable between scrapes.
+func sortedKeys[K comparable](counts map[K]uint64, compare func(a, b K) int) []K {
+	labels := make([]K, 0, len(counts))
+	for l := range counts {
+		labels = append(labels, l)
+	}
+	slices.SortFunc(labels, compare)
+	return labels
+}
+
+func compareQueryLabels(a, b queryLabels) int {
+	return cmp.Or(cmp.Compare(a.t, b.t), cmp.Compare(a.rcode, b.rcode), cmp.Compare(a.upstream, b.upstream))
+}
+
+func compareRefreshLabels(a, b refreshLabels) int {
+	return cmp.Or(cmp.Compare(a.status, b.status), cmp.Compare(a.rcode, b.rcode), cmp.Compare(a.upstream, b.upstream))
+}
+
+// quoteLabel quotes a label value, escaping backslashes, double quotes and
+// line feeds as the text format requires.
+func quoteLabel(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
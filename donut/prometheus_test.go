@@ -0,0 +1,89 @@
+package donut_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tomasbasham/donut"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	m := donut.NewPrometheusMetrics()
+
+	observations := []donut.QueryObservation{
+		{Type: donut.A, RCode: donut.NoError, Upstream: "udp://192.0.2.53:53", Cache: "miss", Latency: 20 * time.Millisecond},
+		{Type: donut.A, RCode: donut.NoError, Cache: "hit", Latency: 100 * time.Microsecond},
+		{Type: donut.A, RCode: donut.NoError, Cache: "hit", Latency: 100 * time.Microsecond},
+		{Type: donut.AAAA, RCode: donut.NXDomain, Upstream: "udp://192.0.2.53:53", Cache: "miss", Latency: 3 * time.Second},
+		{Type: donut.A, Upstream: `tls://"quoted"`, Err: errors.New("upstream failed"), Latency: 10 * time.Second},
+	}
+	for _, o := range observations {
+		m.QueryStarted()
+		m.QueryDone(o)
+	}
+	m.QueryStarted()
+
+	m.RefreshDone(donut.QueryObservation{Type: donut.A, RCode: donut.NoError, Upstream: "udp://192.0.2.53:53", Cache: "prefetch", Latency: 20 * time.Millisecond})
+	m.RefreshDone(donut.QueryObservation{Type: donut.A, Upstream: "udp://192.0.2.53:53", Cache: "stale", Err: errors.New("upstream failed")})
+
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("expected the text format, got content type %q", ct)
+	}
+
+	var b strings.Builder
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(b.String(), "\n")
+
+	expected := []string{
+		`# TYPE donut_queries_total counter`,
+		`donut_queries_total{type="A",rcode="NOERROR",upstream=""} 2`,
+		`donut_queries_total{type="A",rcode="NOERROR",upstream="udp://192.0.2.53:53"} 1`,
+		`donut_queries_total{type="AAAA",rcode="NXDOMAIN",upstream="udp://192.0.2.53:53"} 1`,
+		`donut_query_errors_total{type="A",upstream="tls://\"quoted\""} 1`,
+		`donut_cache_lookups_total{result="hit"} 2`,
+		`donut_cache_lookups_total{result="miss"} 2`,
+		`donut_cache_hit_ratio 0.5`,
+		`donut_cache_refreshes_total{status="prefetch",rcode="NOERROR",upstream="udp://192.0.2.53:53"} 1`,
+		`donut_cache_refresh_errors_total{status="stale",upstream="udp://192.0.2.53:53"} 1`,
+		`# TYPE donut_query_duration_seconds histogram`,
+		`donut_query_duration_seconds_bucket{le="0.0005"} 2`,
+		`donut_query_duration_seconds_bucket{le="0.025"} 3`,
+		`donut_query_duration_seconds_bucket{le="5"} 4`,
+		`donut_query_duration_seconds_bucket{le="10"} 5`,
+		`donut_query_duration_seconds_bucket{le="+Inf"} 5`,
+		`donut_query_duration_seconds_count 5`,
+		`donut_upstream_query_duration_seconds_bucket{upstream="udp://192.0.2.53:53",le="0.025"} 1`,
+		`donut_upstream_query_duration_seconds_bucket{upstream="udp://192.0.2.53:53",le="+Inf"} 2`,
+		`donut_upstream_query_duration_seconds_sum{upstream="udp://192.0.2.53:53"} 3.02`,
+		`donut_upstream_query_duration_seconds_count{upstream="udp://192.0.2.53:53"} 2`,
+		`# TYPE donut_queries_in_flight gauge`,
+		`donut_queries_in_flight 1`,
+	}
+	for _, line := range expected {
+		found := false
+		for _, l := range lines {
+			if l == line {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("expected line %s in:\n%s", line, b.String())
+		}
+	}
+}
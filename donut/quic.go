@@ -0,0 +1,225 @@
+package donut
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+)
+
+// DNS over QUIC error codes as defined in
+// https://datatracker.ietf.org/doc/html/rfc9250#section-8.4
+const (
+	doqNoError          = 0x0
+	doqRequestCancelled = 0x3
+)
+
+// quicTransport sends queries to a DNS over QUIC server as described in
+// https://datatracker.ietf.org/doc/html/rfc9250
+//
+// A single connection is reused for all queries, with each query sent on a
+// stream of its own so that a slow response does not hold up any other.
+type quicTransport struct {
+	addr      string
+	tlsConfig *tls.Config
+
+	// bootstrap resolves the host of addr in place of the system resolver,
+	// if set.
+	bootstrap *bootstrap
+
+	mu   sync.Mutex
+	conn quic.Connection
+}
+
+// newQUICTransport creates a DNS over QUIC transport. The server is
+// authenticated in the same way as for DNS over TLS.
+func (r *Resolver) newQUICTransport(e endpoint) *quicTransport {
+	config := r.newTLSConfig(e)
+	config.NextProtos = []string{"doq"}
+
+	return &quicTransport{
+		addr:      e.addr(),
+		tlsConfig: config,
+		bootstrap: r.bootstrap,
+	}
+}
+
+func (t *quicTransport) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) < headerLen {
+		return nil, errShortMessage
+	}
+
+	for {
+		conn, reused, err := t.getConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := t.exchange(ctx, conn, query)
+
+		// The server may have closed an idle connection without us noticing, in
+		// which case the query is sent again on a fresh connection.
+		if err != nil && reused && ctx.Err() == nil && conn.Context().Err() != nil {
+			continue
+		}
+
+		return resp, err
+	}
+}
+
+func (t *quicTransport) exchange(ctx context.Context, conn quic.Connection, query []byte) ([]byte, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Abandon the stream if the caller gives up on the query, letting the
+	// server know it need not bother answering.
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelRead(doqRequestCancelled)
+		stream.CancelWrite(doqRequestCancelled)
+	})
+	defer stop()
+
+	// The message ID must be set to 0 as the stream already identifies the
+	// query, see https://datatracker.ietf.org/doc/html/rfc9250#section-4.2.1
+	frame := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(frame, uint16(len(query)))
+	copy(frame[2:], query)
+	binary.BigEndian.PutUint16(frame[2:], 0)
+
+	if _, err := stream.Write(frame); err != nil {
+		return nil, err
+	}
+
+	// Closing the stream only closes our side of it, indicating to the server
+	// that the query is complete.
+	if err := stream.Close(); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(stream, resp); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	if len(resp) < headerLen {
+		return nil, errShortMessage
+	}
+
+	copy(resp, query[:2])
+	return resp, nil
+}
+
+// Close closes the connection in use by the transport.
+func (t *quicTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn == nil {
+		return nil
+	}
+
+	err := t.conn.CloseWithError(doqNoError, "")
+	t.conn = nil
+	return err
+}
+
+// getConn returns the connection to open the next stream on, dialing a new one
+// if there is none or the previous one has been closed. The returned boolean
+// reports whether the connection has been used before.
+func (t *quicTransport) getConn(ctx context.Context) (quic.Connection, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn != nil && t.conn.Context().Err() == nil {
+		return t.conn, true, nil
+	}
+
+	conn, err := t.dial(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	t.conn = conn
+	return conn, false, nil
+}
+
+// dial connects to the server, resolving its host with the bootstrap if there
+// is one. Every address of the host is tried in turn, as for TCP transports.
+func (t *quicTransport) dial(ctx context.Context) (quic.Connection, error) {
+	if t.bootstrap == nil {
+		return quic.DialAddr(ctx, t.addr, t.tlsConfig, nil)
+	}
+
+	host, port, err := net.SplitHostPort(t.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := []string{host}
+	if net.ParseIP(host) == nil {
+		if addrs, err = t.bootstrap.lookup(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+
+	var errs []error
+	for _, ip := range addrs {
+		conn, err := dialQUIC(ctx, net.JoinHostPort(ip, port), t.tlsConfig)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		errs = append(errs, err)
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// dialQUIC connects to the address, which must be an IP address and port,
+// over a UDP socket of its own.
+func dialQUIC(ctx context.Context, addr string, config *tls.Config) (quic.Connection, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := quic.Dial(ctx, udpConn, udpAddr, config, nil)
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+
+	// Unlike quic.DialAddr, quic.Dial leaves the socket open once the
+	// connection is closed.
+	context.AfterFunc(conn.Context(), func() { udpConn.Close() })
+
+	return conn, nil
+}
+
+// contextError returns the error of ctx in place of err if ctx is done, since
+// cancelling a stream surfaces as a less helpful stream error.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
@@ -0,0 +1,160 @@
+package donut_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/quic-go/quic-go"
+
+	"github.com/tomasbasham/donut"
+)
+
+// quicServer is a DNS over QUIC server answering every query with an A
+// record, recording the message IDs it receives.
+type quicServer struct {
+	addr  string
+	conns atomic.Int32
+
+	mu  sync.Mutex
+	ids []uint16
+}
+
+func newQUICServer(t *testing.T) (*quicServer, *tls.Config) {
+	t.Helper()
+
+	cert, pool := newTestCertificate(t)
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"doq"},
+	}
+
+	l, err := quic.ListenAddr("127.0.0.1:0", config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &quicServer{addr: l.Addr().String()}
+
+	go func() {
+		for {
+			conn, err := l.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			s.conns.Add(1)
+			go s.serve(conn)
+		}
+	}()
+
+	return s, &tls.Config{RootCAs: pool}
+}
+
+func (s *quicServer) serve(conn quic.Connection) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer stream.Close()
+
+			// The client closes its side of the stream once the query is sent.
+			frame, err := io.ReadAll(stream)
+			if err != nil || len(frame) < 2 {
+				return
+			}
+			query := frame[2:]
+
+			s.mu.Lock()
+			s.ids = append(s.ids, binary.BigEndian.Uint16(query))
+			s.mu.Unlock()
+
+			resp := answerA(query, net.IPv4(192, 0, 2, 1), 300)
+			stream.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+		}()
+	}
+}
+
+func TestResolver_LookupQUIC(t *testing.T) {
+	s, config := newQUICServer(t)
+
+	r := donut.New("quic://"+s.addr, donut.WithTLSConfig(config))
+	defer r.Close()
+
+	names := []string{"a.example", "b.example", "c.example"}
+
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			id := uint16(0x1000 + i)
+			resp, err := r.LookupRaw(newQuery(id, name))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if got := binary.BigEndian.Uint16(resp); got != id {
+				t.Errorf("expected response ID %#04x, got %#04x", id, got)
+			}
+			if !bytes.Contains(resp, []byte{0xC0, 0x0C, 0x00, 0x01}) {
+				t.Errorf("expected an answer for %s", name)
+			}
+		}()
+	}
+	wg.Wait()
+
+	answer, err := r.Lookup(donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answer) != 1 || answer[0].Name != "example.com." {
+		t.Fatalf("unexpected answer: %+v", answer)
+	}
+
+	if got := s.conns.Load(); got != 1 {
+		t.Errorf("expected 1 connection, got %d", got)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range s.ids {
+		if id != 0 {
+			t.Errorf("expected message ID 0 on the wire, got %#04x", id)
+		}
+	}
+}
+
+func TestResolver_LookupQUICReconnect(t *testing.T) {
+	s, config := newQUICServer(t)
+
+	r := donut.New("quic://"+s.addr, donut.WithTLSConfig(config))
+	defer r.Close()
+
+	question := donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN}
+	if _, err := r.Lookup(question); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing the resolver drops the connection, after which the next lookup
+	// must establish a new one.
+	r.Close()
+
+	if _, err := r.Lookup(question); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := s.conns.Load(); got != 2 {
+		t.Errorf("expected 2 connections, got %d", got)
+	}
+}
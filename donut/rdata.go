@@ -0,0 +1,282 @@
+package donut
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// errUnsupportedRData is returned by parseRData for record types whose
+// presentation format it cannot parse.
+var errUnsupportedRData = errors.New("unsupported record data")
+
+// parseRData converts the presentation format of a record's data, as found in
+// zone files and JSON responses, into its wire format.
+func parseRData(t RecordType, s string) ([]byte, error) {
+	// Data of any type may be given in the generic format described in
+	// https://datatracker.ietf.org/doc/html/rfc3597#section-5
+	if strings.HasPrefix(s, `\# `) {
+		return parseGenericRData(s)
+	}
+
+	fields := strings.Fields(s)
+
+	switch t {
+	case A:
+		ip := net.ParseIP(s).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid A record data %q", s)
+		}
+		return ip, nil
+
+	case AAAA:
+		ip := net.ParseIP(s)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid AAAA record data %q", s)
+		}
+		return ip.To16(), nil
+
+	case NS, CNAME, PTR, DNAME:
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("invalid %s record data %q", t, s)
+		}
+		return appendName(nil, fields[0]), nil
+
+	case MX:
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid MX record data %q", s)
+		}
+		rdata, err := appendUint(nil, fields[0], 16)
+		if err != nil {
+			return nil, err
+		}
+		return appendName(rdata, fields[1]), nil
+
+	case SRV:
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("invalid SRV record data %q", s)
+		}
+		var rdata []byte
+		for _, field := range fields[:3] {
+			var err error
+			if rdata, err = appendUint(rdata, field, 16); err != nil {
+				return nil, err
+			}
+		}
+		return appendName(rdata, fields[3]), nil
+
+	case SOA:
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("invalid SOA record data %q", s)
+		}
+		rdata := appendName(nil, fields[0])
+		rdata = appendName(rdata, fields[1])
+		for _, field := range fields[2:] {
+			var err error
+			if rdata, err = appendUint(rdata, field, 32); err != nil {
+				return nil, err
+			}
+		}
+		return rdata, nil
+
+	case TXT:
+		return parseTXT(s)
+
+	default:
+		return nil, fmt.Errorf("%w %q for record type %s", errUnsupportedRData, s, t)
+	}
+}
+
+// parseGenericRData parses data of the form \# <length> <hex>.
+func parseGenericRData(s string) ([]byte, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid generic record data %q", s)
+	}
+
+	length, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid generic record data %q", s)
+	}
+
+	rdata, err := hex.DecodeString(strings.Join(fields[2:], ""))
+	if err != nil || len(rdata) != length {
+		return nil, fmt.Errorf("invalid generic record data %q", s)
+	}
+
+	return rdata, nil
+}
+
+// parseTXT parses the character strings of a TXT record. Servers differ in
+// whether they quote the strings, so unquoted data is taken to be a single
+// string that is split as needed to fit.
+func parseTXT(s string) ([]byte, error) {
+	var strs []string
+	if strings.HasPrefix(s, `"`) {
+		for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+			str, rest, err := unquote(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid TXT record data %q: %w", s, err)
+			}
+			strs = append(strs, str)
+			s = rest
+		}
+	} else {
+		strs = append(strs, s)
+	}
+
+	var rdata []byte
+	for _, str := range strs {
+		for len(str) > 255 {
+			rdata = append(rdata, 255)
+			rdata = append(rdata, str[:255]...)
+			str = str[255:]
+		}
+		rdata = append(rdata, byte(len(str)))
+		rdata = append(rdata, str...)
+	}
+
+	return rdata, nil
+}
+
+// unquote reads a single quoted character string from the start of s,
+// handling the escapes described in
+// https://datatracker.ietf.org/doc/html/rfc1035#section-5.1
+func unquote(s string) (string, string, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			return b.String(), s[i+1:], nil
+		case '\\':
+			if i+3 < len(s) && isDigits(s[i+1:i+4]) {
+				n, _ := strconv.Atoi(s[i+1 : i+4])
+				if n > 255 {
+					return "", "", fmt.Errorf("invalid escape %q", s[i:i+4])
+				}
+				b.WriteByte(byte(n))
+				i += 3
+			} else if i+1 < len(s) {
+				b.WriteByte(s[i+1])
+				i++
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string")
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func appendUint(b []byte, s string, bits int) ([]byte, error) {
+	n, err := strconv.ParseUint(s, 10, bits)
+	if err != nil {
+		return nil, err
+	}
+	if bits == 16 {
+		return binary.BigEndian.AppendUint16(b, uint16(n)), nil
+	}
+	return binary.BigEndian.AppendUint32(b, uint32(n)), nil
+}
+
+// formatRData returns the presentation format of a record's data, the reverse
+// of parseRData. Data that cannot be decoded, or is of a type without a
+// format of its own, is given in the generic format.
+func formatRData(t RecordType, rdata []byte) string {
+	m := message{rdata}
+
+	switch t {
+	case A:
+		if len(rdata) == net.IPv4len {
+			return net.IP(rdata).String()
+		}
+
+	case AAAA:
+		if len(rdata) == net.IPv6len {
+			return net.IP(rdata).String()
+		}
+
+	case NS, CNAME, PTR, DNAME:
+		if name, next, err := m.parseName(0); err == nil && next == len(rdata) {
+			return name
+		}
+
+	case MX:
+		if len(rdata) > 2 {
+			if name, next, err := m.parseName(2); err == nil && next == len(rdata) {
+				return strconv.Itoa(int(binary.BigEndian.Uint16(rdata))) + " " + name
+			}
+		}
+
+	case SRV:
+		if len(rdata) > 6 {
+			if name, next, err := m.parseName(6); err == nil && next == len(rdata) {
+				return fmt.Sprintf("%d %d %d %s", binary.BigEndian.Uint16(rdata), binary.BigEndian.Uint16(rdata[2:]),
+					binary.BigEndian.Uint16(rdata[4:]), name)
+			}
+		}
+
+	case SOA:
+		mname, next, err := m.parseName(0)
+		if err != nil {
+			break
+		}
+		rname, next, err := m.parseName(next)
+		if err != nil || len(rdata)-next != 20 {
+			break
+		}
+		s := mname + " " + rname
+		for i := next; i < len(rdata); i += 4 {
+			s += " " + strconv.FormatUint(uint64(binary.BigEndian.Uint32(rdata[i:])), 10)
+		}
+		return s
+
+	case TXT:
+		var strs []string
+		for b := rdata; len(b) > 0; b = b[1+int(b[0]):] {
+			if 1+int(b[0]) > len(b) {
+				strs = nil
+				break
+			}
+			strs = append(strs, quote(b[1:1+int(b[0])]))
+		}
+		if strs != nil {
+			return strings.Join(strs, " ")
+		}
+	}
+
+	return fmt.Sprintf(`\# %d %x`, len(rdata), rdata)
+}
+
+// quote returns a character string quoted and escaped as described in
+// https://datatracker.ietf.org/doc/html/rfc1035#section-5.1, the reverse of
+// unquote.
+func quote(s []byte) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, `\%03d`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,204 @@
+package donut
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/fs"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultResolvConf is where the configuration of the system stub resolver is
+// usually found.
+const DefaultResolvConf = "/etc/resolv.conf"
+
+// The limits glibc places on the configuration, as defined in resolv.h.
+const (
+	maxNameservers = 3
+	maxNDots       = 15
+	maxTimeout     = 30 * time.Second
+	maxAttempts    = 5
+)
+
+// ResolvConf is the configuration of the system stub resolver, as described in
+// resolv.conf(5). It is set with WithResolvConf.
+type ResolvConf struct {
+	// Nameservers holds the addresses of the servers to query, in order.
+	Nameservers []string
+
+	// Search holds the domains appended to names that are not fully
+	// qualified, in order.
+	Search []string
+
+	// NDots is the number of dots a name must have for it to be tried as
+	// given before the search domains are appended to it.
+	NDots int
+
+	// Timeout is how long to wait for the first response from a server,
+	// which is doubled with each later attempt.
+	Timeout time.Duration
+
+	// Attempts is the number of times each server is queried before giving
+	// up.
+	Attempts int
+}
+
+// LoadResolvConf reads the named resolv.conf file, applying the LOCALDOMAIN and
+// RES_OPTIONS environment variables as glibc does. A missing file gives the
+// defaults, with the local server as the only name server and the domain of
+// the host as the only search domain.
+func LoadResolvConf(name string) (*ResolvConf, error) {
+	f, err := os.Open(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	var r io.Reader = strings.NewReader("")
+	if f != nil {
+		defer f.Close()
+		r = f
+	}
+
+	c, err := ParseResolvConf(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Search == nil {
+		if hostname, err := os.Hostname(); err == nil {
+			if _, domain, ok := strings.Cut(hostname, "."); ok && domain != "" {
+				c.Search = []string{fqdn(domain)}
+			}
+		}
+	}
+
+	if domains, ok := os.LookupEnv("LOCALDOMAIN"); ok {
+		c.Search = searchDomains(strings.Fields(domains))
+	}
+
+	if options := os.Getenv("RES_OPTIONS"); options != "" {
+		c.parseOptions(strings.Fields(options))
+	}
+
+	return c, nil
+}
+
+// ParseResolvConf reads the nameserver, search, domain and options lines of a
+// resolv.conf file. Like glibc, it ignores anything it does not understand,
+// keeps only the first three name servers and lets the last of the search and
+// domain lines win. The local server is used if none are given.
+func ParseResolvConf(r io.Reader) (*ResolvConf, error) {
+	c := &ResolvConf{
+		NDots:    1,
+		Timeout:  5 * time.Second,
+		Attempts: 2,
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "nameserver":
+			if len(fields) < 2 || len(c.Nameservers) == maxNameservers {
+				continue
+			}
+			if addr, err := netip.ParseAddr(fields[1]); err == nil {
+				c.Nameservers = append(c.Nameservers, addr.String())
+			}
+		case "domain":
+			if len(fields) > 1 {
+				c.Search = searchDomains(fields[1:2])
+			}
+		case "search":
+			c.Search = searchDomains(fields[1:])
+		case "options":
+			c.parseOptions(fields[1:])
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(c.Nameservers) == 0 {
+		c.Nameservers = []string{"127.0.0.1"}
+	}
+
+	return c, nil
+}
+
+// parseOptions applies the ndots, timeout and attempts options, capped at the
+// same limits as glibc.
+func (c *ResolvConf) parseOptions(options []string) {
+	for _, option := range options {
+		name, value, ok := strings.Cut(option, ":")
+		if !ok {
+			continue
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			continue
+		}
+
+		switch name {
+		case "ndots":
+			c.NDots = min(n, maxNDots)
+		case "timeout":
+			c.Timeout = min(time.Duration(n)*time.Second, maxTimeout)
+		case "attempts":
+			c.Attempts = max(min(n, maxAttempts), 1)
+		}
+	}
+}
+
+// searchDomains returns the domains as fully qualified names, leaving out the
+// root which would only repeat the name as given.
+func searchDomains(domains []string) []string {
+	search := []string{}
+	for _, domain := range domains {
+		if domain = fqdn(domain); domain != "." {
+			search = append(search, domain)
+		}
+	}
+	return search
+}
+
+// names returns the names to try in turn for a name, following the rules of
+// res_nsearch in glibc. A name ending with a dot is only ever tried as given.
+// Otherwise a name with at least NDots dots is tried as given first, then
+// with each of the search domains appended, and a name with fewer dots is
+// only tried as given once the search domains have been.
+func (c *ResolvConf) names(name string) []string {
+	if strings.HasSuffix(name, ".") {
+		return []string{name}
+	}
+
+	dots := strings.Count(name, ".")
+
+	var names []string
+	if dots >= c.NDots {
+		names = append(names, name+".")
+	}
+	for _, domain := range c.Search {
+		names = append(names, name+"."+domain)
+	}
+	if dots < c.NDots {
+		names = append(names, name+".")
+	}
+
+	return names
+}
@@ -0,0 +1,313 @@
+package donut_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tomasbasham/donut"
+)
+
+func TestParseResolvConf(t *testing.T) {
+	tests := map[string]struct {
+		input    string
+		expected donut.ResolvConf
+	}{
+		"empty": {
+			expected: donut.ResolvConf{
+				Nameservers: []string{"127.0.0.1"},
+				NDots:       1,
+				Timeout:     5 * time.Second,
+				Attempts:    2,
+			},
+		},
+		"full": {
+			input: "# generated\n" +
+				"; by hand\n" +
+				"nameserver 192.0.2.53\n" +
+				"nameserver 2001:db8::53\n" +
+				"search Corp.Example example.\n" +
+				"options ndots:2 timeout:3 attempts:4 rotate\n",
+			expected: donut.ResolvConf{
+				Nameservers: []string{"192.0.2.53", "2001:db8::53"},
+				Search:      []string{"corp.example.", "example."},
+				NDots:       2,
+				Timeout:     3 * time.Second,
+				Attempts:    4,
+			},
+		},
+		"last of search and domain wins": {
+			input: "search a.example b.example\ndomain c.example d.example\n",
+			expected: donut.ResolvConf{
+				Nameservers: []string{"127.0.0.1"},
+				Search:      []string{"c.example."},
+				NDots:       1,
+				Timeout:     5 * time.Second,
+				Attempts:    2,
+			},
+		},
+		"at most three name servers": {
+			input: "nameserver 192.0.2.1\nnameserver bogus\nnameserver 192.0.2.2\n" +
+				"nameserver 192.0.2.3\nnameserver 192.0.2.4\n",
+			expected: donut.ResolvConf{
+				Nameservers: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"},
+				NDots:       1,
+				Timeout:     5 * time.Second,
+				Attempts:    2,
+			},
+		},
+		"options capped": {
+			input: "options ndots:20 timeout:60 attempts:0\noptions attempts:x ndots:-1\n",
+			expected: donut.ResolvConf{
+				Nameservers: []string{"127.0.0.1"},
+				NDots:       15,
+				Timeout:     30 * time.Second,
+				Attempts:    1,
+			},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			c, err := donut.ParseResolvConf(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*c, tt.expected) {
+				t.Errorf("expected %+v, got %+v", tt.expected, *c)
+			}
+		})
+	}
+}
+
+func TestLoadResolvConf(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(name, []byte("nameserver 192.0.2.53\nsearch example.\noptions ndots:3\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("LOCALDOMAIN", "a.example b.example")
+	t.Setenv("RES_OPTIONS", "ndots:4 attempts:3")
+
+	c, err := donut.LoadResolvConf(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := donut.ResolvConf{
+		Nameservers: []string{"192.0.2.53"},
+		Search:      []string{"a.example.", "b.example."},
+		NDots:       4,
+		Timeout:     5 * time.Second,
+		Attempts:    3,
+	}
+	if !reflect.DeepEqual(*c, expected) {
+		t.Errorf("expected %+v, got %+v", expected, *c)
+	}
+
+	if _, err := donut.LoadResolvConf(filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Errorf("expected the defaults for a missing file, got %v", err)
+	}
+}
+
+func TestResolver_LookupSearch(t *testing.T) {
+	rcode := func(rcode donut.RCode, names ...string) func(q donut.Question) *donut.Message {
+		return func(q donut.Question) *donut.Message {
+			for _, name := range names {
+				if strings.EqualFold(q.FQDN, name) {
+					return &donut.Message{RCode: rcode}
+				}
+			}
+			return nil
+		}
+	}
+
+	tests := map[string]struct {
+		name     string
+		search   []string
+		ndots    int
+		records  []donut.Record
+		override func(q donut.Question) *donut.Message
+		tried    []string
+		rcode    donut.RCode
+		answers  int
+	}{
+		"short name": {
+			name:    "host",
+			search:  []string{"corp.example.", "example."},
+			records: []donut.Record{aRecord("host.example.", 192, 0, 2, 1)},
+			tried:   []string{"host.corp.example.", "host.example."},
+			answers: 1,
+		},
+		"dotted name tried first": {
+			name:    "www.example",
+			search:  []string{"corp.example."},
+			records: []donut.Record{aRecord("www.example.", 192, 0, 2, 1)},
+			tried:   []string{"www.example."},
+			answers: 1,
+		},
+		"dotted name falls back to the search list": {
+			name:    "host.corp",
+			search:  []string{"example."},
+			records: []donut.Record{aRecord("host.corp.example.", 192, 0, 2, 1)},
+			tried:   []string{"host.corp.", "host.corp.example."},
+			answers: 1,
+		},
+		"ndots": {
+			name:    "www.example",
+			search:  []string{"corp.example."},
+			ndots:   2,
+			records: []donut.Record{aRecord("www.example.", 192, 0, 2, 1)},
+			tried:   []string{"www.example.corp.example.", "www.example."},
+			answers: 1,
+		},
+		"fully qualified": {
+			name:   "host.",
+			search: []string{"example."},
+			tried:  []string{"host."},
+			rcode:  donut.NXDomain,
+		},
+		"no data preferred": {
+			name:   "host",
+			search: []string{"a.example.", "b.example."},
+			records: []donut.Record{
+				{Name: "host.a.example.", Type: donut.TXT, Class: donut.IN, TTL: 300, Data: []byte("\x02hi")},
+			},
+			tried: []string{"host.a.example.", "host.b.example.", "host."},
+			rcode: donut.NoError,
+		},
+		"name as given preferred": {
+			name:   "www.example",
+			search: []string{"corp.example."},
+			records: []donut.Record{
+				{Name: "www.example.corp.example.", Type: donut.TXT, Class: donut.IN, TTL: 300, Data: []byte("\x02hi")},
+			},
+			tried: []string{"www.example.", "www.example.corp.example."},
+			rcode: donut.NXDomain,
+		},
+		"server failure moves on": {
+			name:     "host",
+			search:   []string{"a.example.", "b.example."},
+			records:  []donut.Record{aRecord("host.b.example.", 192, 0, 2, 1)},
+			override: rcode(donut.ServFail, "host.a.example."),
+			tried:    []string{"host.a.example.", "host.b.example."},
+			answers:  1,
+		},
+		"server failure reported": {
+			name:     "host",
+			search:   []string{"a.example.", "b.example."},
+			override: rcode(donut.ServFail, "host.a.example."),
+			tried:    []string{"host.a.example.", "host.b.example.", "host."},
+			rcode:    donut.ServFail,
+		},
+		"refusal ends the search": {
+			name:     "host",
+			search:   []string{"a.example.", "b.example."},
+			records:  []donut.Record{aRecord("host.b.example.", 192, 0, 2, 1)},
+			override: rcode(donut.Refused, "host.a.example."),
+			tried:    []string{"host.a.example.", "host."},
+			rcode:    donut.NXDomain,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := &authServer{ip: "127.0.0.1", zones: []string{"."}, records: tt.records, override: tt.override}
+			port := startAuthServers(t, server)
+
+			r := donut.New("", donut.WithResolvConf(&donut.ResolvConf{
+				Nameservers: []string{net.JoinHostPort(server.ip, port)},
+				Search:      tt.search,
+				NDots:       max(tt.ndots, 1),
+				Timeout:     time.Second,
+				Attempts:    1,
+			}))
+			defer r.Close()
+
+			msg, err := r.LookupMessage(context.Background(), donut.Question{FQDN: tt.name, Type: donut.A, Class: donut.IN})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tried := server.names(); !reflect.DeepEqual(tried, tt.tried) {
+				t.Errorf("expected %v to be tried, got %v", tt.tried, tried)
+			}
+			if msg.RCode != tt.rcode {
+				t.Errorf("expected %v, got %v", tt.rcode, msg.RCode)
+			}
+			if len(msg.Answers) != tt.answers {
+				t.Errorf("expected %d answers, got %d", tt.answers, len(msg.Answers))
+			}
+		})
+	}
+}
+
+func TestResolver_LookupStubFailover(t *testing.T) {
+	refuse := func(q donut.Question) *donut.Message {
+		return &donut.Message{RCode: donut.Refused}
+	}
+
+	tests := map[string]struct {
+		first    func(q donut.Question) *donut.Message
+		second   func(q donut.Question) *donut.Message
+		attempts int
+		rcode    donut.RCode
+		asked    [2]int
+	}{
+		"first server answers": {
+			attempts: 2,
+			asked:    [2]int{1, 0},
+		},
+		"refusal moves on": {
+			first:    refuse,
+			attempts: 2,
+			asked:    [2]int{1, 1},
+		},
+		"every server refuses": {
+			first:    refuse,
+			second:   refuse,
+			attempts: 2,
+			rcode:    donut.Refused,
+			asked:    [2]int{2, 2},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			records := []donut.Record{aRecord("host.example.", 192, 0, 2, 1)}
+			first := &authServer{ip: "127.0.0.1", zones: []string{"."}, records: records, override: tt.first}
+			second := &authServer{ip: "127.0.0.2", zones: []string{"."}, records: records, override: tt.second}
+			port := startAuthServers(t, first, second)
+
+			r := donut.New("", donut.WithResolvConf(&donut.ResolvConf{
+				Nameservers: []string{net.JoinHostPort(first.ip, port), net.JoinHostPort(second.ip, port)},
+				NDots:       1,
+				Timeout:     time.Second,
+				Attempts:    tt.attempts,
+			}))
+			defer r.Close()
+
+			msg, err := r.LookupMessage(context.Background(), donut.Question{FQDN: "host.example.", Type: donut.A, Class: donut.IN})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if msg.RCode != tt.rcode {
+				t.Errorf("expected %v, got %v", tt.rcode, msg.RCode)
+			}
+			if asked := [2]int{len(first.names()), len(second.names())}; asked != tt.asked {
+				t.Errorf("expected the servers to be asked %v times, got %v", tt.asked, asked)
+			}
+		})
+	}
+}
+
+func TestResolver_LookupStubInvalidNameserver(t *testing.T) {
+	r := donut.New("", donut.WithResolvConf(&donut.ResolvConf{Nameservers: []string{"ns.example"}}))
+
+	if _, err := r.Lookup(donut.Question{FQDN: "host.example.", Type: donut.A, Class: donut.IN}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
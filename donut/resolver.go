@@ -1,98 +1,424 @@
 package donut
 
 import (
-	"bytes"
-	"fmt"
-	"io"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"log/slog"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// refreshTimeout bounds lookups that refresh the cache in the background.
+const refreshTimeout = 10 * time.Second
+
 const (
 	CloudflareHost = "cloudflare-dns.com"
 	GoogleHost     = "dns.google"
 )
 
 type Resolver struct {
-	Host   string
-	debug  bool
-	client *http.Client
+	Host       string
+	debug      bool
+	logger     *slog.Logger
+	client     *http.Client
+	tlsConfig  *tls.Config
+	serverName string
+	rootCAs    *x509.CertPool
+	relay      string
+	cache      *Cache
+	upstreams  []string
+	strategy   Strategy
+	retry      *RetryPolicy
+	maxAliases int
+	iterative  *IterativeConfig
+	resolvConf *ResolvConf
+	hostsConf  *HostsConfig
+	hosts      *hosts
+	metrics    Metrics
+	transport  Transport
+	err        error
+
+	// interceptors wrap every exchange with the upstream, the first being
+	// the outermost.
+	interceptors []Interceptor
+
+	// batchConcurrency bounds the questions of a batch looked up at once.
+	batchConcurrency int
+
+	// bootstrap resolves the hosts of upstream servers, configured with
+	// bootstrapAddrs and bootstrapServers.
+	bootstrapAddrs   map[string][]string
+	bootstrapServers []string
+	bootstrap        *bootstrap
+
+	// certificates are presented to upstream servers asking for a client
+	// certificate, and pins are the public keys each upstream host must have,
+	// decoded from pinSets.
+	certificates []tls.Certificate
+	pinSets      map[string][]string
+	pins         map[string][][]byte
+
+	// httpClients are the HTTP clients created by the resolver, whose idle
+	// connections are closed along with it.
+	httpClients []*http.Client
+
+	// background tracks lookups refreshing the cache after the caller has
+	// been answered.
+	background sync.WaitGroup
+
+	// flights coalesces identical queries in flight at the same time.
+	flights   flightGroup
+	queries   atomic.Uint64
+	coalesced atomic.Uint64
 }
 
+// New creates a resolver that sends queries to host. The host may be given as
+// a URL to select the transport: https://host/path for DNS over HTTPS,
+// https+json://host/path for the JSON API, odoh://host/path for Oblivious DNS
+// over HTTPS, tls://host:port for DNS over TLS, quic://host:port for DNS over
+// QUIC and udp://host:port or tcp://host:port for plain DNS. It may also be
+// given as an sdns:// stamp. A bare hostname uses DNS over HTTPS.
+//
+// Further upstream servers may be given with WithUpstreams, in which case
+// queries are spread between them according to the strategy set with
+// WithStrategy. With WithIterative the host is ignored and names are resolved
+// from the root servers instead. With WithResolvConf and an empty host,
+// queries are sent to the name servers of the resolv.conf file, as the stub
+// resolver of the system would.
 func New(host string, opts ...option) *Resolver {
 	r := &Resolver{Host: host}
 	for _, opt := range opts {
 		opt(r)
 	}
+	if r.debug && r.logger == nil {
+		r.logger = newDebugLogger()
+	}
+	if r.transport == nil {
+		r.pins, r.err = parsePins(r.pinSets)
+	}
+	if r.transport == nil && r.err == nil {
+		r.bootstrap, r.err = r.newBootstrap()
+	}
+	if r.hostsConf != nil && r.err == nil {
+		r.hosts, r.err = newHosts(*r.hostsConf)
+	}
+	if r.err != nil {
+		return r
+	}
+	if r.transport == nil && r.iterative != nil {
+		var t *iterativeTransport
+		if t, r.err = r.newIterativeTransport(*r.iterative); r.err == nil {
+			r.transport = t
+		}
+	} else if r.transport == nil && host == "" && r.resolvConf != nil {
+		var t *stubTransport
+		if t, r.err = r.newStubTransport(r.resolvConf); r.err == nil {
+			r.transport = t
+		}
+	} else if r.transport == nil && len(r.upstreams) > 0 {
+		var p *poolTransport
+		if p, r.err = r.newPoolTransport(append([]string{host}, r.upstreams...)); r.err == nil {
+			r.transport = p
+		}
+	} else if r.transport == nil {
+		r.transport, r.err = r.newTransport(host)
+	}
+	if r.retry != nil && r.err == nil {
+		r.transport = &retryTransport{transport: r.transport, policy: *r.retry}
+	}
+	if len(r.interceptors) > 0 && r.err == nil {
+		r.transport = &interceptedTransport{transport: r.transport, interceptors: r.interceptors, host: host}
+	}
 	return r
 }
 
+// Lookup sends the question and returns the records that answer it.
 func (r *Resolver) Lookup(q Question) ([]Record, error) {
-	question := encodeMessage([]Question{q})
+	return r.LookupContext(context.Background(), q)
+}
 
-	if r.debug {
-		fmt.Printf("question: % 02x\n", question)
+// LookupContext is like Lookup, but the lookup is abandoned once ctx is done.
+func (r *Resolver) LookupContext(ctx context.Context, q Question) ([]Record, error) {
+	if r.maxAliases > 0 || r.resolvConf != nil {
+		msg, err := r.LookupMessage(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		return msg.Answers, nil
 	}
 
-	msg, err := r.lookup(question)
+	msg, err := r.lookup(ctx, encodeMessage([]Question{q}))
 	if err != nil {
 		return nil, err
 	}
 
-	if r.debug {
-		fmt.Printf("answer: % 02x\n", msg)
+	return msg.parseMessage()
+}
+
+// LookupMessage sends the question and returns the full response, including
+// the header flags and the authority and additional sections.
+func (r *Resolver) LookupMessage(ctx context.Context, q Question) (*Message, error) {
+	return r.resolvConf.search(q.FQDN, func(name string) (*Message, error) {
+		q := Question{FQDN: name, Type: q.Type, Class: q.Class}
+		if r.maxAliases > 0 {
+			msg, _, err := r.followAliases(ctx, q)
+			return msg, err
+		}
+		return r.lookupQuestion(ctx, q)
+	})
+}
+
+func (r *Resolver) lookupQuestion(ctx context.Context, q Question) (*Message, error) {
+	msg, err := r.lookup(ctx, encodeMessage([]Question{q}))
+	if err != nil {
+		return nil, err
 	}
 
-	return msg.parseMessage()
+	return msg.unpack()
 }
 
+// LookupRaw sends a wire format query and returns the wire format response.
 func (r *Resolver) LookupRaw(q []byte) ([]byte, error) {
-	if r.debug {
-		fmt.Printf("question: % 02x\n", q)
-	}
+	return r.LookupRawContext(context.Background(), q)
+}
 
-	msg, err := r.lookup(q)
+// LookupRawContext is like LookupRaw, but the lookup is abandoned once ctx is
+// done.
+func (r *Resolver) LookupRawContext(ctx context.Context, q []byte) ([]byte, error) {
+	msg, err := r.lookup(ctx, q)
 	if err != nil {
 		return nil, err
 	}
 
-	if r.debug {
-		fmt.Printf("answer: % 02x\n", msg)
+	return msg.buf, nil
+}
+
+// Close waits for any background refreshes of the cache to finish, then
+// releases any connections held open by the resolver.
+func (r *Resolver) Close() error {
+	r.background.Wait()
+
+	for _, c := range r.httpClients {
+		c.CloseIdleConnections()
 	}
 
-	return msg.buf, nil
+	var errs []error
+	if r.bootstrap != nil {
+		errs = append(errs, r.bootstrap.Close())
+	}
+	if r.transport != nil {
+		errs = append(errs, closeTransport(r.transport))
+	}
+	return errors.Join(errs...)
 }
 
-func (r *Resolver) lookup(query []byte) (message, error) {
-	url := "https://" + r.Host + "/dns-query"
-	body := bytes.NewBuffer(query)
+func (r *Resolver) lookup(ctx context.Context, query []byte) (message, error) {
+	if r.err != nil {
+		return message{}, r.err
+	}
 
-	req, err := http.NewRequest("POST", url, body)
-	if err != nil {
-		return message{}, err
+	if r.metrics == nil {
+		msg, _, err := r.lookupFrom(ctx, query)
+		return msg, err
 	}
 
-	req.Header.Set("Accept", "application/dns-message")
-	req.Header.Set("Content-Type", "application/dns-message")
+	r.metrics.QueryStarted()
+	start := time.Now()
+	msg, src, err := r.lookupFrom(ctx, query)
+	r.metrics.QueryDone(newQueryObservation(query, msg, src, err, time.Since(start)))
 
-	if r.client == nil {
-		r.client = http.DefaultClient
+	return msg, err
+}
+
+// source says where the response to a query came from.
+type source struct {
+	// cache is the status of the response in the cache, as given in
+	// QueryObservation, or empty if the cache was not consulted.
+	cache string
+
+	// hosts is set if the response came from the hosts file or static
+	// records.
+	hosts bool
+
+	// upstream is the server that answered, if the query was sent upstream.
+	upstream string
+}
+
+// lookupFrom answers the query from the hosts file, the cache or the upstream
+// server, in that order, saying which answered it.
+func (r *Resolver) lookupFrom(ctx context.Context, query []byte) (message, source, error) {
+	if r.hosts != nil {
+		if buf, ok := r.hosts.answer(query); ok {
+			r.logHostsHit(ctx, buf)
+			return message{buf}, source{hosts: true}, nil
+		}
+	}
+
+	r.queries.Add(1)
+
+	key, ok := newCacheKey(query)
+	if !ok {
+		buf, _, server, err := r.send(ctx, query, func(ctx context.Context) ([]byte, bool, error) {
+			buf, err := r.transport.Exchange(ctx, query)
+			return buf, false, err
+		})
+		if err != nil {
+			return message{}, source{upstream: server}, err
+		}
+		return message{buf}, source{upstream: server}, nil
+	}
+
+	var src source
+	if r.cache != nil {
+		cached, status := r.cache.get(key, binary.BigEndian.Uint16(query))
+		switch status {
+		case cacheHit:
+			r.logCacheHit(ctx, cached, "hit")
+			return message{cached}, source{cache: "hit"}, nil
+		case cachePrefetch:
+			r.logCacheHit(ctx, cached, "prefetch")
+			r.refresh(ctx, key, query, "prefetch")
+			return message{cached}, source{cache: "prefetch"}, nil
+		case cacheStale:
+			msg, src := r.lookupStale(ctx, key, query, cached)
+			return msg, src, nil
+		}
+		src.cache = "miss"
+		ctx = withCacheStatus(ctx, "miss")
 	}
 
-	resp, err := r.client.Do(req)
+	buf, shared, server, err := r.send(ctx, query, func(ctx context.Context) ([]byte, bool, error) {
+		return r.exchange(ctx, key, query)
+	})
+	src.upstream = server
 	if err != nil {
-		return message{}, err
+		return message{}, src, err
+	}
+
+	// The query that made the exchange has already cached the response.
+	if r.cache != nil && !shared {
+		r.cache.set(key, buf)
 	}
 
-	defer resp.Body.Close()
+	return message{buf}, src, nil
+}
+
+// lookupStale sends the query upstream, falling back to the stale response if
+// the upstream server fails, or does not answer before the stale answer
+// timeout or the context is done. The cache is refreshed whenever the
+// upstream server answers, even if the stale response was used.
+func (r *Resolver) lookupStale(ctx context.Context, key cacheKey, query, stale []byte) (message, source) {
+	done := r.refresh(ctx, key, query, "stale")
 
-	if resp.StatusCode != http.StatusOK {
-		return message{}, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	var timeout <-chan time.Time
+	if r.cache.staleTimeout > 0 {
+		timer := time.NewTimer(r.cache.staleTimeout)
+		defer timer.Stop()
+		timeout = timer.C
 	}
 
-	buf, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return message{}, err
+	select {
+	case res := <-done:
+		if res.err != nil || upstreamFailed(res.buf) {
+			r.logCacheHit(ctx, stale, "stale")
+			return message{stale}, source{cache: "stale"}
+		}
+		return message{res.buf}, source{cache: "miss", upstream: res.server}
+	case <-timeout:
+		r.logCacheHit(ctx, stale, "stale")
+		return message{stale}, source{cache: "stale"}
+	case <-ctx.Done():
+		r.logCacheHit(ctx, stale, "stale")
+		return message{stale}, source{cache: "stale"}
+	}
+}
+
+// send sends the query upstream with exchange, logging the query and the
+// response. It returns the upstream server that answered along with the
+// response.
+func (r *Resolver) send(ctx context.Context, query []byte, exchange func(ctx context.Context) ([]byte, bool, error)) ([]byte, bool, string, error) {
+	ctx, upstream := withUpstreamRecorder(ctx)
+	r.logQuery(ctx, query)
+
+	start := time.Now()
+	buf, shared, err := exchange(ctx)
+	latency := time.Since(start)
+
+	server := r.upstreamName(upstream)
+	r.logResponse(ctx, query, buf, err, server, shared, latency)
+
+	return buf, shared, server, err
+}
+
+// upstreamName returns the upstream server recorded by the transport, or the
+// host of the resolver, since only transports choosing between several
+// servers say which one answered.
+func (r *Resolver) upstreamName(upstream *upstreamRecorder) string {
+	if server := upstream.get(); server != "" {
+		return server
 	}
+	return r.Host
+}
+
+type exchangeResult struct {
+	buf []byte
+	err error
+
+	// server is the upstream server that answered, if known.
+	server string
+}
 
-	return message{buf}, nil
+// refresh sends the query upstream in the background and caches the response,
+// with status being the status of the cached response: prefetch or stale. The
+// lookup is not cancelled along with ctx, since the caller may already have
+// been answered from the cache, but is bounded by refreshTimeout. Refreshes
+// of the same query are coalesced, so that however many queries find a stale
+// response only one of them goes upstream.
+func (r *Resolver) refresh(ctx context.Context, key cacheKey, query []byte, status string) <-chan exchangeResult {
+	query = append([]byte(nil), query...)
+	done := make(chan exchangeResult, 1)
+
+	r.background.Add(1)
+	go func() {
+		defer r.background.Done()
+
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), refreshTimeout)
+		defer cancel()
+		ctx = withCacheStatus(ctx, status)
+
+		start := time.Now()
+		buf, shared, server, err := r.send(ctx, query, func(ctx context.Context) ([]byte, bool, error) {
+			return r.exchange(ctx, key, query)
+		})
+
+		// Only the refresh that made the exchange caches and records it.
+		if !shared {
+			if err == nil {
+				r.cache.set(key, buf)
+			}
+			if r.metrics != nil {
+				src := source{cache: status, upstream: server}
+				r.metrics.RefreshDone(newQueryObservation(query, message{buf}, src, err, time.Since(start)))
+			}
+		}
+
+		done <- exchangeResult{buf: buf, err: err, server: server}
+	}()
+
+	return done
+}
+
+// upstreamFailed reports whether the response says that the server failed to
+// answer the query, in which case a stale response is preferable.
+func upstreamFailed(resp []byte) bool {
+	if len(resp) < headerLen {
+		return true
+	}
+	rcode := RCode(resp[3] & 0x0F)
+	return rcode == ServFail || rcode == Refused
 }
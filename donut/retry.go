@@ -0,0 +1,184 @@
+package donut
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+)
+
+// RetryClass is a set of failures that a query may be retried on.
+type RetryClass uint8
+
+const (
+	// RetryNetwork retries queries that fail to reach the upstream server or
+	// time out.
+	RetryNetwork RetryClass = 1 << iota
+
+	// RetryServerError retries queries answered with a 5xx HTTP status.
+	RetryServerError
+
+	// RetryServFail retries queries answered with SERVFAIL.
+	RetryServFail
+)
+
+// RetryPolicy describes how a query that fails is retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a query is sent, including the first.
+	MaxAttempts int
+
+	// InitialBackoff is how long to wait before the first retry. The wait
+	// doubles with every retry up to MaxBackoff, and a random jitter of up to
+	// half of it is taken off so that clients do not retry in lockstep.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// AttemptTimeout bounds each attempt separately from the deadline of the
+	// context, which bounds the query as a whole. A timeout of 0 leaves each
+	// attempt bounded by the context alone. An attempt that times out counts
+	// as a failure of the upstream server it was sent to, so that the next
+	// attempt goes to another server if there are several.
+	AttemptTimeout time.Duration
+
+	// RetryOn is the set of failures that are retried.
+	RetryOn RetryClass
+}
+
+// DefaultRetryPolicy retries transient failures twice.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+	AttemptTimeout: 2 * time.Second,
+	RetryOn:        RetryNetwork | RetryServerError | RetryServFail,
+}
+
+// RetryError is returned when a query fails after being retried, and holds the
+// error from every attempt.
+type RetryError struct {
+	Attempts []error
+}
+
+func (e *RetryError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "query failed after %d attempts", len(e.Attempts))
+	for i, err := range e.Attempts {
+		fmt.Fprintf(&b, "; attempt %d: %v", i+1, err)
+	}
+	return b.String()
+}
+
+func (e *RetryError) Unwrap() []error {
+	return e.Attempts
+}
+
+// errServFail records an attempt answered with SERVFAIL in a RetryError.
+var errServFail = errors.New("server failure")
+
+// retryTransport retries queries sent through another transport according to
+// a policy.
+type retryTransport struct {
+	transport Transport
+	policy    RetryPolicy
+}
+
+func (t *retryTransport) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var attempts []error
+	for attempt := 1; ; attempt++ {
+		resp, err := t.attempt(ctx, query)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		class, retryable := t.classify(resp, err)
+		if !retryable || class&t.policy.RetryOn == 0 || attempt >= t.policy.MaxAttempts {
+			// A failure reported by the server is returned as is, for the
+			// caller to make sense of.
+			if err == nil {
+				return resp, nil
+			}
+			if attempt == 1 {
+				return nil, err
+			}
+			return nil, &RetryError{Attempts: append(attempts, err)}
+		}
+
+		if err == nil {
+			err = errServFail
+		}
+		attempts = append(attempts, err)
+
+		timer := time.NewTimer(t.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (t *retryTransport) attempt(ctx context.Context, query []byte) ([]byte, error) {
+	if t.policy.AttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, t.policy.AttemptTimeout, errUpstreamTimeout)
+		defer cancel()
+	}
+	return t.transport.Exchange(ctx, query)
+}
+
+// classify returns the class of a failed attempt, reporting false if the
+// attempt succeeded or failed in a way that retrying cannot fix.
+func (t *retryTransport) classify(resp []byte, err error) (RetryClass, bool) {
+	var statusErr *StatusError
+	switch {
+	case err == nil:
+		if len(resp) >= headerLen && RCode(resp[3]&0x0F) == ServFail {
+			return RetryServFail, true
+		}
+		return 0, false
+	case errors.As(err, &statusErr):
+		return RetryServerError, statusErr.StatusCode >= 500
+	case isNetworkError(err):
+		return RetryNetwork, true
+	default:
+		return 0, false
+	}
+}
+
+// backoff returns how long to wait after the given attempt.
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	d := t.policy.InitialBackoff << min(attempt-1, 30)
+	if t.policy.MaxBackoff > 0 && (d > t.policy.MaxBackoff || d <= 0) {
+		d = t.policy.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d - rand.N(d/2+1)
+}
+
+// Close closes the underlying transport.
+func (t *retryTransport) Close() error {
+	return closeTransport(t.transport)
+}
+
+// isNetworkError reports whether err is a failure to reach the server or a
+// timeout, as opposed to, for example, a certificate that does not verify.
+func isNetworkError(err error) bool {
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+
+	return errors.As(err, &opErr) ||
+		errors.As(err, &dnsErr) ||
+		(errors.As(err, &netErr) && netErr.Timeout()) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, errConnClosed)
+}
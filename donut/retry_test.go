@@ -0,0 +1,199 @@
+package donut_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tomasbasham/donut"
+)
+
+var errRefused = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+func servFail(query []byte) []byte {
+	resp := append([]byte(nil), query...)
+	resp[2] |= 0x80
+	resp[3] = 0x82
+	return resp
+}
+
+func TestResolver_LookupRetry(t *testing.T) {
+	policy := donut.RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+		AttemptTimeout: 50 * time.Millisecond,
+		RetryOn:        donut.RetryNetwork | donut.RetryServerError | donut.RetryServFail,
+	}
+
+	tests := map[string]struct {
+		policy   donut.RetryPolicy
+		attempts []func(ctx context.Context, query []byte) ([]byte, error)
+		calls    int32
+		rcode    donut.RCode
+		err      func(err error) bool
+	}{
+		"network error": {
+			policy: policy,
+			attempts: []func(ctx context.Context, query []byte) ([]byte, error){
+				func(ctx context.Context, query []byte) ([]byte, error) { return nil, errRefused },
+			},
+			calls: 2,
+		},
+		"server error": {
+			policy: policy,
+			attempts: []func(ctx context.Context, query []byte) ([]byte, error){
+				func(ctx context.Context, query []byte) ([]byte, error) {
+					return nil, &donut.StatusError{StatusCode: 503}
+				},
+				func(ctx context.Context, query []byte) ([]byte, error) {
+					return nil, &donut.StatusError{StatusCode: 502}
+				},
+			},
+			calls: 3,
+		},
+		"client error": {
+			policy: policy,
+			attempts: []func(ctx context.Context, query []byte) ([]byte, error){
+				func(ctx context.Context, query []byte) ([]byte, error) {
+					return nil, &donut.StatusError{StatusCode: 400}
+				},
+			},
+			calls: 1,
+			err: func(err error) bool {
+				var statusErr *donut.StatusError
+				return errors.As(err, &statusErr) && statusErr.StatusCode == 400
+			},
+		},
+		"attempt timeout": {
+			policy: policy,
+			attempts: []func(ctx context.Context, query []byte) ([]byte, error){
+				func(ctx context.Context, query []byte) ([]byte, error) {
+					<-ctx.Done()
+					return nil, ctx.Err()
+				},
+			},
+			calls: 2,
+		},
+		"servfail": {
+			policy: policy,
+			attempts: []func(ctx context.Context, query []byte) ([]byte, error){
+				func(ctx context.Context, query []byte) ([]byte, error) { return servFail(query), nil },
+				func(ctx context.Context, query []byte) ([]byte, error) { return servFail(query), nil },
+				func(ctx context.Context, query []byte) ([]byte, error) { return servFail(query), nil },
+			},
+			calls: 3,
+			rcode: donut.ServFail,
+		},
+		"class not retried": {
+			policy: donut.RetryPolicy{MaxAttempts: 3, RetryOn: donut.RetryServFail},
+			attempts: []func(ctx context.Context, query []byte) ([]byte, error){
+				func(ctx context.Context, query []byte) ([]byte, error) { return nil, errRefused },
+			},
+			calls: 1,
+			err: func(err error) bool {
+				return errors.Is(err, errRefused)
+			},
+		},
+		"every attempt fails": {
+			policy: policy,
+			attempts: []func(ctx context.Context, query []byte) ([]byte, error){
+				func(ctx context.Context, query []byte) ([]byte, error) { return nil, errRefused },
+				func(ctx context.Context, query []byte) ([]byte, error) {
+					return nil, &donut.StatusError{StatusCode: 503}
+				},
+				func(ctx context.Context, query []byte) ([]byte, error) { return nil, errRefused },
+			},
+			calls: 3,
+			err: func(err error) bool {
+				var retryErr *donut.RetryError
+				return errors.As(err, &retryErr) && len(retryErr.Attempts) == 3 && errors.Is(err, errRefused)
+			},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var calls atomic.Int32
+			transport := transportFunc(func(ctx context.Context, query []byte) ([]byte, error) {
+				n := int(calls.Add(1))
+				if n <= len(tt.attempts) {
+					return tt.attempts[n-1](ctx, query)
+				}
+				return answerA(query, net.IPv4(192, 0, 2, 1), 300), nil
+			})
+
+			r := donut.New(donut.GoogleHost, donut.WithTransport(transport), donut.WithRetry(tt.policy))
+
+			msg, err := r.LookupMessage(context.Background(), donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN})
+			if got := calls.Load(); got != tt.calls {
+				t.Errorf("expected %d attempts, got %d", tt.calls, got)
+			}
+
+			if tt.err != nil {
+				if err == nil || !tt.err(err) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if msg.RCode != tt.rcode {
+				t.Errorf("expected rcode %d, got %d", tt.rcode, msg.RCode)
+			}
+		})
+	}
+}
+
+func TestResolver_LookupRetryCancelled(t *testing.T) {
+	transport := transportFunc(func(ctx context.Context, query []byte) ([]byte, error) {
+		return nil, errRefused
+	})
+
+	policy := donut.DefaultRetryPolicy
+	policy.InitialBackoff = time.Minute
+
+	r := donut.New(donut.GoogleHost, donut.WithTransport(transport), donut.WithRetry(policy))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := r.LookupContext(ctx, donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to cut the backoff short, got %v", err)
+	}
+}
+
+func TestResolver_LookupRetryUpstreams(t *testing.T) {
+	servers := newPool(t, 2)
+	servers[0].failNext.Store(1)
+	servers[1].delay.Store(int64(5 * time.Second))
+
+	policy := donut.RetryPolicy{
+		MaxAttempts:    2,
+		InitialBackoff: time.Millisecond,
+		AttemptTimeout: 100 * time.Millisecond,
+		RetryOn:        donut.RetryNetwork | donut.RetryServerError,
+	}
+
+	r := donut.New(servers[0].url(),
+		donut.WithUpstreams(servers[1].url()),
+		donut.WithClient(servers[0].Client()),
+		donut.WithRetry(policy))
+	defer r.Close()
+
+	// The first attempt fails on the first server and times out on the
+	// second, which benches both, so the retry starts again from the first
+	// rather than waiting on the second once more.
+	if ip := lookupIP(t, r); !ip.Equal(servers[0].ip) {
+		t.Errorf("expected %s, got %s", servers[0].ip, ip)
+	}
+
+	if got := hits(servers); got[0] != 2 || got[1] != 1 {
+		t.Errorf("unexpected hits: %v", got)
+	}
+}
@@ -0,0 +1,160 @@
+package donut
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// rootHints are the root servers as published by IANA at
+// https://www.internic.net/domain/named.root
+const rootHints = `
+.                        3600000      NS    A.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET.      3600000      A     198.41.0.4
+A.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:ba3e::2:30
+.                        3600000      NS    B.ROOT-SERVERS.NET.
+B.ROOT-SERVERS.NET.      3600000      A     170.247.170.2
+B.ROOT-SERVERS.NET.      3600000      AAAA  2801:1b8:10::b
+.                        3600000      NS    C.ROOT-SERVERS.NET.
+C.ROOT-SERVERS.NET.      3600000      A     192.33.4.12
+C.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:2::c
+.                        3600000      NS    D.ROOT-SERVERS.NET.
+D.ROOT-SERVERS.NET.      3600000      A     199.7.91.13
+D.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:2d::d
+.                        3600000      NS    E.ROOT-SERVERS.NET.
+E.ROOT-SERVERS.NET.      3600000      A     192.203.230.10
+E.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:a8::e
+.                        3600000      NS    F.ROOT-SERVERS.NET.
+F.ROOT-SERVERS.NET.      3600000      A     192.5.5.241
+F.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:2f::f
+.                        3600000      NS    G.ROOT-SERVERS.NET.
+G.ROOT-SERVERS.NET.      3600000      A     192.112.36.4
+G.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:12::d0d
+.                        3600000      NS    H.ROOT-SERVERS.NET.
+H.ROOT-SERVERS.NET.      3600000      A     198.97.190.53
+H.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:1::53
+.                        3600000      NS    I.ROOT-SERVERS.NET.
+I.ROOT-SERVERS.NET.      3600000      A     192.36.148.17
+I.ROOT-SERVERS.NET.      3600000      AAAA  2001:7fe::53
+.                        3600000      NS    J.ROOT-SERVERS.NET.
+J.ROOT-SERVERS.NET.      3600000      A     192.58.128.30
+J.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:c27::2:30
+.                        3600000      NS    K.ROOT-SERVERS.NET.
+K.ROOT-SERVERS.NET.      3600000      A     193.0.14.129
+K.ROOT-SERVERS.NET.      3600000      AAAA  2001:7fd::1
+.                        3600000      NS    L.ROOT-SERVERS.NET.
+L.ROOT-SERVERS.NET.      3600000      A     199.7.83.42
+L.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:9f::42
+.                        3600000      NS    M.ROOT-SERVERS.NET.
+M.ROOT-SERVERS.NET.      3600000      A     202.12.27.33
+M.ROOT-SERVERS.NET.      3600000      AAAA  2001:dc3::35
+`
+
+// nameserver is a server authoritative for a zone, along with its addresses
+// if they are known.
+type nameserver struct {
+	name  string
+	addrs []string
+}
+
+// loadRootHints reads the root servers from the named root hints file, or
+// returns the built in hints if no file is named.
+func loadRootHints(name string) ([]nameserver, error) {
+	if name == "" {
+		return parseRootHints(strings.NewReader(rootHints))
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	servers, err := parseRootHints(f)
+	if err != nil {
+		return nil, fmt.Errorf("root hints %s: %w", name, err)
+	}
+
+	return servers, nil
+}
+
+// parseRootHints reads root hints in the zone file format of named.root, with
+// NS records for the root and A and AAAA records for the servers they name.
+// The TTL and class of each record are optional, and anything following a
+// semicolon is a comment.
+func parseRootHints(r io.Reader) ([]nameserver, error) {
+	var names []string
+	addrs := make(map[string][]string)
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), ";")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		owner := fqdn(fields[0])
+		fields = fields[1:]
+
+		// Skip over the TTL and class, which may come in either order.
+		for len(fields) > 0 {
+			if _, err := strconv.ParseUint(fields[0], 10, 32); err == nil || strings.EqualFold(fields[0], "IN") {
+				fields = fields[1:]
+				continue
+			}
+			break
+		}
+
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a type and a value", line)
+		}
+
+		switch value := fields[1]; strings.ToUpper(fields[0]) {
+		case "NS":
+			if owner != "." {
+				return nil, fmt.Errorf("line %d: NS record for %s rather than the root", line, owner)
+			}
+			names = append(names, fqdn(value))
+		case "A", "AAAA":
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("line %d: invalid address %q", line, value)
+			}
+			addrs[owner] = append(addrs[owner], ip.String())
+		default:
+			return nil, fmt.Errorf("line %d: unexpected record type %s", line, fields[0])
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var servers []nameserver
+	for _, name := range names {
+		if len(addrs[name]) > 0 {
+			servers = append(servers, nameserver{name: name, addrs: addrs[name]})
+		}
+	}
+
+	if len(servers) == 0 {
+		return nil, errors.New("no root servers with addresses")
+	}
+
+	return servers, nil
+}
+
+// fqdn returns the name lowercased and ending with a dot.
+func fqdn(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
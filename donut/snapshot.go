@@ -0,0 +1,153 @@
+package donut
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// snapshotMagic identifies a cache snapshot, and is followed by the version of
+// the format.
+const (
+	snapshotMagic   = "DNUT"
+	snapshotVersion = 1
+)
+
+var errSnapshotFormat = errors.New("invalid cache snapshot")
+
+// Save writes a snapshot of the cache to w, which can be read back with Load
+// to warm another cache, for example after a restart.
+//
+// The snapshot starts with the magic "DNUT" and a version octet, followed by
+// one entry per cached response from the least to the most recently used:
+//
+//	+--------+------+-------+-------+-------+---------+---------+--------+----------+
+//	| len(1) | name | type  | class | flags | stored  | expires | len(2) | response |
+//	|        |      | (2)   | (2)   | (1)   | (8)     | (8)     |        |          |
+//	+--------+------+-------+-------+-------+---------+---------+--------+----------+
+//
+// where flags holds the DO bit in bit 0 and the CD bit in bit 1, stored and
+// expires are Unix times in seconds, and response is the wire format response
+// as received from the upstream server.
+func (c *Cache) Save(w io.Writer) error {
+	c.mu.Lock()
+	entries := make([]*cacheEntry, 0, c.lru.Len())
+	for el := c.lru.Back(); el != nil; el = el.Prev() {
+		entries = append(entries, el.Value.(*cacheEntry))
+	}
+	c.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(snapshotMagic)
+	bw.WriteByte(snapshotVersion)
+
+	var b []byte
+	for _, e := range entries {
+		if len(e.key.name) > 0xFF || len(e.msg) > 0xFFFF {
+			continue
+		}
+
+		var flags byte
+		if e.key.do {
+			flags |= 1 << 0
+		}
+		if e.key.cd {
+			flags |= 1 << 1
+		}
+
+		b = append(b[:0], byte(len(e.key.name)))
+		b = append(b, e.key.name...)
+		b = binary.BigEndian.AppendUint16(b, uint16(e.key.qtype))
+		b = binary.BigEndian.AppendUint16(b, uint16(e.key.class))
+		b = append(b, flags)
+		b = binary.BigEndian.AppendUint64(b, uint64(e.stored.Unix()))
+		b = binary.BigEndian.AppendUint64(b, uint64(e.expires.Unix()))
+		b = binary.BigEndian.AppendUint16(b, uint16(len(e.msg)))
+		b = append(b, e.msg...)
+
+		if _, err := bw.Write(b); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Load adds the responses in a snapshot written by Save to the cache. Responses
+// that have expired, and can no longer be served stale, are discarded.
+func (c *Cache) Load(r io.Reader) error {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return fmt.Errorf("%w: %w", errSnapshotFormat, err)
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return errSnapshotFormat
+	}
+	if header[len(snapshotMagic)] != snapshotVersion {
+		return fmt.Errorf("%w: unsupported version %d", errSnapshotFormat, header[len(snapshotMagic)])
+	}
+
+	now := c.now()
+
+	for {
+		entry, err := readSnapshotEntry(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", errSnapshotFormat, err)
+		}
+
+		if !now.Before(entry.expires.Add(c.serveStale)) {
+			continue
+		}
+
+		c.add(entry)
+	}
+}
+
+// readSnapshotEntry reads the next entry of a snapshot, returning io.EOF if
+// there are none left.
+func readSnapshotEntry(r *bufio.Reader) (*cacheEntry, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	fixed := make([]byte, int(n)+2+2+1+8+8+2)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	name, fixed := string(fixed[:n]), fixed[n:]
+	flags := fixed[4]
+
+	entry := &cacheEntry{
+		key: cacheKey{
+			name:  name,
+			qtype: RecordType(binary.BigEndian.Uint16(fixed[0:2])),
+			class: RecordClass(binary.BigEndian.Uint16(fixed[2:4])),
+			do:    flags&(1<<0) != 0,
+			cd:    flags&(1<<1) != 0,
+		},
+		stored:  time.Unix(int64(binary.BigEndian.Uint64(fixed[5:13])), 0),
+		expires: time.Unix(int64(binary.BigEndian.Uint64(fixed[13:21])), 0),
+		msg:     make([]byte, binary.BigEndian.Uint16(fixed[21:23])),
+	}
+
+	if _, err := io.ReadFull(r, entry.msg); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	m := message{entry.msg}
+	if entry.ttls, err = m.ttlOffsets(); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
@@ -0,0 +1,79 @@
+package donut_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tomasbasham/donut"
+)
+
+func TestCache_SaveLoad(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	saved := donut.NewCache(10)
+	donut.SetCacheClock(saved, func() time.Time { return now })
+
+	// Fill the cache with a long lived and a short lived response.
+	for name, ttl := range map[string]uint32{"long.example": 300, "short.example": 10} {
+		r := donut.New(donut.GoogleHost, donut.WithTransport(&fakeTransport{ttl: ttl}), donut.WithCache(saved))
+		if _, err := r.Lookup(donut.Question{FQDN: name, Type: donut.A, Class: donut.IN}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var snapshot bytes.Buffer
+	if err := saved.Save(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	// Load the snapshot once the short lived response has expired.
+	loaded := donut.NewCache(10)
+	donut.SetCacheClock(loaded, func() time.Time { return now.Add(100 * time.Second) })
+
+	if err := loaded.Load(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := loaded.Len(); got != 1 {
+		t.Errorf("expected 1 cached response, got %d", got)
+	}
+
+	failing := transportFunc(func(ctx context.Context, query []byte) ([]byte, error) {
+		return nil, errors.New("connection refused")
+	})
+	r := donut.New(donut.GoogleHost, donut.WithTransport(failing), donut.WithCache(loaded))
+
+	answer, err := r.Lookup(donut.Question{FQDN: "long.example", Type: donut.A, Class: donut.IN})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(answer) != 1 || !bytes.Equal(answer[0].Data.([]byte), net.IPv4(192, 0, 2, 1).To4()) || answer[0].TTL != 200 {
+		t.Errorf("expected 192.0.2.1 with TTL 200, got %+v", answer)
+	}
+}
+
+func TestCache_LoadInvalid(t *testing.T) {
+	var snapshot bytes.Buffer
+	if err := donut.NewCache(10).Save(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][]byte{
+		"empty":       {},
+		"bad magic":   []byte("XXXX\x01"),
+		"bad version": []byte("DNUT\x02"),
+		"truncated":   append(snapshot.Bytes(), 0x07, 'e', 'x'),
+	}
+	for name, b := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := donut.NewCache(10).Load(bytes.NewReader(b)); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
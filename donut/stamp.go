@@ -0,0 +1,275 @@
+package donut
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// StampProtocol identifies the protocol of the server described by a stamp.
+type StampProtocol uint8
+
+const (
+	StampPlain StampProtocol = 0x00
+	StampDoH   StampProtocol = 0x02
+	StampDoT   StampProtocol = 0x03
+	StampDoQ   StampProtocol = 0x04
+)
+
+// StampProps are the informal properties a server claims to have.
+type StampProps uint64
+
+const (
+	StampDNSSEC   StampProps = 1 << 0
+	StampNoLog    StampProps = 1 << 1
+	StampNoFilter StampProps = 1 << 2
+)
+
+// Stamp describes how to reach a DNS server, as published by the DNSCrypt
+// project and described in https://dnscrypt.info/stamps-specifications
+type Stamp struct {
+	Protocol StampProtocol
+	Props    StampProps
+
+	// Addr is the IP address, and optionally port, of the server. For
+	// encrypted protocols it may be empty, in which case Host is resolved.
+	Addr string
+
+	// Hashes are SHA-256 digests of the TBS certificate of certificates in the
+	// server's chain, one of which must be present for the server to be
+	// trusted.
+	Hashes [][]byte
+
+	// Host is the name, and optionally port, used to authenticate the server.
+	Host string
+
+	// Path is the path of a DNS over HTTPS endpoint.
+	Path string
+
+	// Bootstrap holds the IP addresses of resolvers that may be used to
+	// resolve Host. They are kept so that a stamp survives being decoded and
+	// encoded again, but are not used to reach the server: Host is resolved
+	// as for any other upstream, so pass them to WithBootstrapServers to use
+	// them.
+	Bootstrap []string
+}
+
+var errInvalidStamp = errors.New("invalid stamp")
+
+// ParseStamp decodes a stamp of the form sdns://...
+func ParseStamp(s string) (Stamp, error) {
+	encoded, ok := strings.CutPrefix(s, "sdns://")
+	if !ok {
+		return Stamp{}, fmt.Errorf("%w: missing sdns:// prefix", errInvalidStamp)
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Stamp{}, fmt.Errorf("%w: %w", errInvalidStamp, err)
+	}
+
+	if len(b) < 9 {
+		return Stamp{}, errInvalidStamp
+	}
+
+	stamp := Stamp{
+		Protocol: StampProtocol(b[0]),
+		Props:    StampProps(binary.LittleEndian.Uint64(b[1:9])),
+	}
+
+	d := stampDecoder{b: b[9:]}
+	stamp.Addr = d.string()
+
+	switch stamp.Protocol {
+	case StampPlain:
+	case StampDoH:
+		stamp.Hashes = d.vector()
+		stamp.Host = d.string()
+		stamp.Path = d.string()
+		if !d.done() {
+			stamp.Bootstrap = d.strings()
+		}
+	case StampDoT, StampDoQ:
+		stamp.Hashes = d.vector()
+		stamp.Host = d.string()
+		if !d.done() {
+			stamp.Bootstrap = d.strings()
+		}
+	default:
+		return Stamp{}, fmt.Errorf("%w: unsupported protocol %#02x", errInvalidStamp, stamp.Protocol)
+	}
+
+	if d.err != nil || !d.done() {
+		return Stamp{}, errInvalidStamp
+	}
+
+	return stamp, nil
+}
+
+// String encodes the stamp in the sdns:// form.
+func (s Stamp) String() string {
+	b := []byte{byte(s.Protocol)}
+	b = binary.LittleEndian.AppendUint64(b, uint64(s.Props))
+	b = appendLP(b, s.Addr)
+
+	switch s.Protocol {
+	case StampDoH:
+		b = appendVLP(b, s.Hashes)
+		b = appendLP(b, s.Host)
+		b = appendLP(b, s.Path)
+		if len(s.Bootstrap) > 0 {
+			b = appendVLP(b, stringsToBytes(s.Bootstrap))
+		}
+	case StampDoT, StampDoQ:
+		b = appendVLP(b, s.Hashes)
+		b = appendLP(b, s.Host)
+		if len(s.Bootstrap) > 0 {
+			b = appendVLP(b, stringsToBytes(s.Bootstrap))
+		}
+	}
+
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// endpoint returns how to reach the server described by the stamp.
+func (s Stamp) endpoint() (endpoint, error) {
+	var scheme, port string
+	switch s.Protocol {
+	case StampPlain:
+		scheme, port = "udp", "53"
+	case StampDoH:
+		scheme, port = "https", "443"
+	case StampDoT:
+		scheme, port = "tls", "853"
+	case StampDoQ:
+		scheme, port = "quic", "853"
+	default:
+		return endpoint{}, fmt.Errorf("%w: unsupported protocol %#02x", errInvalidStamp, s.Protocol)
+	}
+
+	// The port given with the host takes precedence over the default, and the
+	// one given with the address over both.
+	host, port := splitHostPort(s.Host, port)
+	ip, port := splitHostPort(s.Addr, port)
+
+	if host == "" {
+		host = ip
+	}
+
+	if host == "" {
+		return endpoint{}, fmt.Errorf("%w: missing address", errInvalidStamp)
+	}
+
+	return endpoint{
+		scheme: scheme,
+		host:   host,
+		ip:     ip,
+		port:   port,
+		path:   s.Path,
+		hashes: s.Hashes,
+	}, nil
+}
+
+// splitHostPort splits an address that may or may not have a port, returning
+// the given port when it does not.
+func splitHostPort(addr, port string) (string, string) {
+	if h, p, err := net.SplitHostPort(addr); err == nil {
+		return h, p
+	}
+	return strings.Trim(addr, "[]"), port
+}
+
+type stampDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *stampDecoder) done() bool {
+	return len(d.b) == 0
+}
+
+// string reads a length prefixed string.
+func (d *stampDecoder) string() string {
+	if d.err != nil {
+		return ""
+	}
+
+	if len(d.b) < 1 || len(d.b) < 1+int(d.b[0]) {
+		d.err = errInvalidStamp
+		return ""
+	}
+
+	s := string(d.b[1 : 1+int(d.b[0])])
+	d.b = d.b[1+int(d.b[0]):]
+	return s
+}
+
+// vector reads a set of variable length prefixed values, where the most
+// significant bit of each length is set for all but the last value.
+func (d *stampDecoder) vector() [][]byte {
+	var values [][]byte
+	for d.err == nil {
+		if len(d.b) < 1 {
+			d.err = errInvalidStamp
+			return nil
+		}
+
+		length := int(d.b[0] &^ 0x80)
+		more := d.b[0]&0x80 != 0
+
+		if len(d.b) < 1+length {
+			d.err = errInvalidStamp
+			return nil
+		}
+
+		if length > 0 {
+			values = append(values, d.b[1:1+length])
+		}
+		d.b = d.b[1+length:]
+
+		if !more {
+			break
+		}
+	}
+	return values
+}
+
+func (d *stampDecoder) strings() []string {
+	var values []string
+	for _, v := range d.vector() {
+		values = append(values, string(v))
+	}
+	return values
+}
+
+func appendLP(b []byte, s string) []byte {
+	b = append(b, byte(len(s)))
+	return append(b, s...)
+}
+
+func appendVLP(b []byte, values [][]byte) []byte {
+	if len(values) == 0 {
+		return append(b, 0)
+	}
+
+	for i, v := range values {
+		length := byte(len(v))
+		if i < len(values)-1 {
+			length |= 0x80
+		}
+		b = append(b, length)
+		b = append(b, v...)
+	}
+	return b
+}
+
+func stringsToBytes(s []string) [][]byte {
+	b := make([][]byte, len(s))
+	for i, v := range s {
+		b[i] = []byte(v)
+	}
+	return b
+}
@@ -0,0 +1,145 @@
+package donut_test
+
+import (
+	"crypto/sha256"
+	"reflect"
+	"testing"
+
+	"github.com/tomasbasham/donut"
+)
+
+func hashes(n int) [][]byte {
+	h := make([]byte, n)
+	for i := range h {
+		h[i] = byte(i)
+	}
+	return [][]byte{h}
+}
+
+func TestParseStamp(t *testing.T) {
+	tests := map[string]struct {
+		stamp    string
+		expected donut.Stamp
+		err      bool
+	}{
+		"plain": {
+			stamp: "sdns://AAEAAAAAAAAABzkuOS45Ljk",
+			expected: donut.Stamp{
+				Protocol: donut.StampPlain,
+				Props:    donut.StampDNSSEC,
+				Addr:     "9.9.9.9",
+			},
+		},
+		"doh": {
+			stamp: "sdns://AgcAAAAAAAAABzEuMS4xLjEgAAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8SY2xvdWRmbGFyZS1kbnMuY29tCi9kbnMtcXVlcnk",
+			expected: donut.Stamp{
+				Protocol: donut.StampDoH,
+				Props:    donut.StampDNSSEC | donut.StampNoLog | donut.StampNoFilter,
+				Addr:     "1.1.1.1",
+				Hashes:   hashes(32),
+				Host:     "cloudflare-dns.com",
+				Path:     "/dns-query",
+			},
+		},
+		"missing prefix": {
+			stamp: "AAEAAAAAAAAABzkuOS45Ljk",
+			err:   true,
+		},
+		"truncated": {
+			stamp: "sdns://AgcAAAAAAAAABzEuMS4xLjEgAAECAw",
+			err:   true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			stamp, err := donut.ParseStamp(tt.stamp)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(stamp, tt.expected) {
+				t.Errorf("expected %+v, got %+v", tt.expected, stamp)
+			}
+			if got := stamp.String(); got != tt.stamp {
+				t.Errorf("expected %q, got %q", tt.stamp, got)
+			}
+		})
+	}
+}
+
+func TestStamp_String(t *testing.T) {
+	tests := map[string]donut.Stamp{
+		"dot": {
+			Protocol:  donut.StampDoT,
+			Addr:      "[2001:db8::1]:853",
+			Hashes:    append(hashes(32), hashes(16)...),
+			Host:      "dns.example",
+			Bootstrap: []string{"192.0.2.53", "192.0.2.54"},
+		},
+		"doq without hashes": {
+			Protocol: donut.StampDoQ,
+			Props:    donut.StampNoLog,
+			Host:     "dns.example:8853",
+		},
+	}
+	for name, stamp := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := donut.ParseStamp(stamp.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, stamp) {
+				t.Errorf("expected %+v, got %+v", stamp, got)
+			}
+		})
+	}
+}
+
+func TestResolver_LookupStamp(t *testing.T) {
+	tests := map[string]struct {
+		hashes func(s *tlsServer) [][]byte
+		err    bool
+	}{
+		"matching hash": {
+			hashes: func(s *tlsServer) [][]byte {
+				sum := sha256.Sum256(s.cert.Leaf.RawTBSCertificate)
+				return [][]byte{sum[:]}
+			},
+		},
+		"mismatched hash": {
+			hashes: func(s *tlsServer) [][]byte {
+				return hashes(32)
+			},
+			err: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			s, config := newTLSServer(t, 1)
+
+			stamp := donut.Stamp{
+				Protocol: donut.StampDoT,
+				Addr:     s.addr,
+				Hashes:   tt.hashes(s),
+				Host:     "dns.example",
+			}
+
+			r := donut.New(stamp.String(), donut.WithTLSConfig(config))
+			defer r.Close()
+
+			_, err := r.Lookup(donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN})
+			if tt.err && err == nil {
+				t.Fatal("expected an error")
+			}
+			if !tt.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
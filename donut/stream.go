@@ -0,0 +1,242 @@
+package donut
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+)
+
+var errConnClosed = errors.New("connection closed")
+
+// streamTransport sends queries over a stream oriented connection, such as TCP
+// or TLS, where each message is prefixed with its two octet length as
+// described in https://datatracker.ietf.org/doc/html/rfc1035#section-4.2.2
+//
+// A single connection is reused for all queries and several queries may be
+// outstanding on it at once. Responses are matched to their queries using the
+// message ID so a server is free to answer them in any order, as permitted by
+// https://datatracker.ietf.org/doc/html/rfc7766#section-6.2.1.1
+type streamTransport struct {
+	addr string
+	dial func(ctx context.Context, addr string) (net.Conn, error)
+
+	mu   sync.Mutex
+	conn *pipelinedConn
+}
+
+func (t *streamTransport) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) < headerLen {
+		return nil, errShortMessage
+	}
+
+	for {
+		conn, reused, err := t.getConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := conn.exchange(ctx, query)
+
+		// A server is allowed to close an idle connection at any time, which we
+		// may only notice once a query has been written to it. In that case the
+		// query is sent again on a fresh connection.
+		if errors.Is(err, errConnClosed) && reused && ctx.Err() == nil {
+			continue
+		}
+
+		return resp, err
+	}
+}
+
+// Close closes the connection in use by the transport, failing any queries
+// still waiting for a response.
+func (t *streamTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn == nil {
+		return nil
+	}
+
+	t.conn.close(errConnClosed)
+	t.conn = nil
+	return nil
+}
+
+// getConn returns the connection to send the next query on, dialing a new one
+// if there is none or the previous one has failed. The returned boolean
+// reports whether the connection has been used before.
+func (t *streamTransport) getConn(ctx context.Context) (*pipelinedConn, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn != nil && !t.conn.closed() {
+		return t.conn, true, nil
+	}
+
+	conn, err := t.dial(ctx, t.addr)
+	if err != nil {
+		return nil, false, err
+	}
+
+	t.conn = newPipelinedConn(conn)
+	return t.conn, false, nil
+}
+
+// pipelinedConn multiplexes queries over a single connection.
+type pipelinedConn struct {
+	conn net.Conn
+
+	// wmu serialises writes so frames from concurrent queries do not
+	// interleave.
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint16]chan []byte
+	err     error
+	done    chan struct{}
+}
+
+func newPipelinedConn(conn net.Conn) *pipelinedConn {
+	c := &pipelinedConn{
+		conn:    conn,
+		pending: make(map[uint16]chan []byte),
+		done:    make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+func (c *pipelinedConn) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	id, ch, err := c.register()
+	if err != nil {
+		return nil, err
+	}
+	defer c.unregister(id)
+
+	// Queries from different callers may share an ID, so each is given one
+	// that is unique on this connection. The caller's ID is restored on the
+	// response.
+	frame := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(frame, uint16(len(query)))
+	copy(frame[2:], query)
+	binary.BigEndian.PutUint16(frame[2:], id)
+
+	if err := c.write(ctx, frame); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		copy(resp, query[:2])
+		return resp, nil
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *pipelinedConn) write(ctx context.Context, frame []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	deadline, _ := ctx.Deadline()
+	c.conn.SetWriteDeadline(deadline)
+
+	if _, err := c.conn.Write(frame); err != nil {
+		c.close(errConnClosed)
+		return fmt.Errorf("%w: %w", errConnClosed, err)
+	}
+
+	return nil
+}
+
+// register allocates a message ID that is not in use by any other
+// outstanding query on the connection.
+func (c *pipelinedConn) register() (uint16, chan []byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return 0, nil, c.err
+	}
+
+	if len(c.pending) >= 1<<16 {
+		return 0, nil, errors.New("too many outstanding queries")
+	}
+
+	for {
+		id := uint16(rand.Uint32())
+		if _, ok := c.pending[id]; ok {
+			continue
+		}
+
+		ch := make(chan []byte, 1)
+		c.pending[id] = ch
+		return id, ch, nil
+	}
+}
+
+func (c *pipelinedConn) unregister(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+func (c *pipelinedConn) readLoop() {
+	var length [2]byte
+	for {
+		if _, err := io.ReadFull(c.conn, length[:]); err != nil {
+			c.close(errConnClosed)
+			return
+		}
+
+		msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(c.conn, msg); err != nil {
+			c.close(errConnClosed)
+			return
+		}
+
+		if len(msg) < headerLen {
+			continue
+		}
+
+		// Responses to queries that have since been abandoned are dropped.
+		c.mu.Lock()
+		ch, ok := c.pending[binary.BigEndian.Uint16(msg)]
+		delete(c.pending, binary.BigEndian.Uint16(msg))
+		c.mu.Unlock()
+
+		if ok {
+			ch <- msg
+		}
+	}
+}
+
+func (c *pipelinedConn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+
+	c.err = err
+	close(c.done)
+	c.conn.Close()
+}
+
+func (c *pipelinedConn) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
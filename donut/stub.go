@@ -0,0 +1,173 @@
+package donut
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stubTransport sends queries to the name servers of a resolv.conf file over
+// plain DNS, trying each in turn for the configured number of attempts as the
+// stub resolver in glibc does.
+type stubTransport struct {
+	servers  []*udpTransport
+	timeout  time.Duration
+	attempts int
+}
+
+// newStubTransport creates a transport for the name servers of c, which may
+// be given as addresses or, unlike in a resolv.conf file, as addresses and
+// ports.
+func (r *Resolver) newStubTransport(c *ResolvConf) (*stubTransport, error) {
+	t := &stubTransport{
+		timeout:  c.Timeout,
+		attempts: max(c.Attempts, 1),
+	}
+	if t.timeout <= 0 {
+		t.timeout = defaultUDPTimeout
+	}
+
+	for _, server := range c.Nameservers {
+		e := endpoint{scheme: "udp", port: "53"}
+		if addr, err := netip.ParseAddrPort(server); err == nil {
+			e.host, e.port = addr.Addr().String(), strconv.Itoa(int(addr.Port()))
+		} else if addr, err := netip.ParseAddr(server); err == nil {
+			e.host = addr.String()
+		} else {
+			return nil, &net.AddrError{Err: "invalid name server address", Addr: server}
+		}
+		t.servers = append(t.servers, newUDPTransport(e, r.dialContext))
+	}
+
+	if len(t.servers) == 0 {
+		return nil, errors.New("no name servers")
+	}
+
+	return t, nil
+}
+
+// Exchange sends the query to each server in turn until one answers without
+// failing, going round the servers once per attempt. The first attempt waits
+// for the configured timeout, and each later attempt waits twice as long as
+// the one before spread across the servers, as res_send in glibc does. A
+// server answering SERVFAIL or REFUSED is passed over, but its response is
+// returned if no other server does better.
+func (t *stubTransport) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var failed []byte
+	var err error
+
+	for attempt := range t.attempts {
+		timeout := t.timeout << attempt
+		if attempt > 0 {
+			timeout /= time.Duration(len(t.servers))
+		}
+		timeout = max(timeout, time.Second)
+
+		for _, server := range t.servers {
+			var resp []byte
+			resp, err = t.exchange(ctx, server, query, timeout)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if err != nil {
+				continue
+			}
+			recordUpstream(ctx, server.addr)
+			if !upstreamFailed(resp) {
+				return resp, nil
+			}
+			failed = resp
+		}
+	}
+
+	if failed != nil {
+		return failed, nil
+	}
+	return nil, err
+}
+
+// Close closes any TCP connections to the servers.
+func (t *stubTransport) Close() error {
+	var errs []error
+	for _, server := range t.servers {
+		errs = append(errs, server.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (t *stubTransport) exchange(ctx context.Context, server *udpTransport, query []byte, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return server.Exchange(ctx, query)
+}
+
+// search looks up a name under each of the names given by the search list in
+// turn, returning the first response with records in its answer, following
+// res_nsearch in glibc. A name that does not exist, has no records, or whose
+// server failed moves the search on to the next domain, while any other
+// response or error ends it, though the name as given is still tried if it
+// has not been.
+//
+// If no name has records, the result for the name as given is returned when
+// it was tried before the search list, and otherwise the first response with
+// no records, the first SERVFAIL response, or the last result, in that order.
+func (c *ResolvConf) search(name string, lookup func(name string) (*Message, error)) (*Message, error) {
+	if c == nil {
+		return lookup(name)
+	}
+
+	names := c.names(name)
+	absolute := strings.TrimSuffix(name, ".") + "."
+
+	var first, noData, failed, last *Message
+	var firstErr, err error
+	triedFirst, done := false, false
+
+	for i, name := range names {
+		if done && name != absolute {
+			continue
+		}
+
+		last, err = lookup(name)
+		if err == nil && last.RCode == NoError && len(last.Answers) > 0 {
+			return last, nil
+		}
+
+		// The name as given is tried first when it has enough dots, and its
+		// result wins over those of the search list.
+		if i == 0 && name == absolute && len(names) > 1 {
+			first, firstErr, triedFirst = last, err, true
+			continue
+		}
+
+		switch {
+		case err != nil:
+			done = true
+		case last.RCode == NoError:
+			if noData == nil {
+				noData = last
+			}
+		case last.RCode == NXDomain:
+		case last.RCode == ServFail:
+			if failed == nil {
+				failed = last
+			}
+		default:
+			done = true
+		}
+	}
+
+	switch {
+	case triedFirst:
+		return first, firstErr
+	case noData != nil:
+		return noData, nil
+	case failed != nil:
+		return failed, nil
+	}
+	return last, err
+}
@@ -0,0 +1,120 @@
+package donut
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+)
+
+// newTLSTransport creates a transport for DNS over TLS as described in
+// https://datatracker.ietf.org/doc/html/rfc7858
+//
+// The server is authenticated using the name configured with WithServerName,
+// falling back to the host of the endpoint. The host is resolved by the
+// bootstrap, if any.
+func (r *Resolver) newTLSTransport(e endpoint) *streamTransport {
+	config := r.newTLSConfig(e)
+
+	return &streamTransport{
+		addr: e.addr(),
+		dial: func(ctx context.Context, addr string) (net.Conn, error) {
+			conn, err := r.dialContext(ctx, "tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+
+			tlsConn := tls.Client(conn, config)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+
+			return tlsConn, nil
+		},
+	}
+}
+
+// customTLS reports whether the resolver has any TLS settings of its own, as
+// opposed to the defaults of the system.
+func (r *Resolver) customTLS() bool {
+	return r.tlsConfig != nil || r.serverName != "" || r.rootCAs != nil || len(r.certificates) > 0 || len(r.pins) > 0
+}
+
+// newTLSConfig returns the TLS configuration used to connect to the endpoint.
+// The authentication name takes precedence over the host of the endpoint,
+// which is used only when no name has been configured or the endpoint is an
+// ODoH relay.
+func (r *Resolver) newTLSConfig(e endpoint) *tls.Config {
+	var config *tls.Config
+	if r.tlsConfig != nil {
+		config = r.tlsConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+
+	if e.relay {
+		config.ServerName = e.host
+	}
+
+	if config.ServerName == "" {
+		config.ServerName = r.serverName
+	}
+
+	if config.ServerName == "" {
+		config.ServerName = e.host
+	}
+
+	if r.rootCAs != nil {
+		config.RootCAs = r.rootCAs
+	}
+
+	if len(r.certificates) > 0 {
+		config.Certificates = append(config.Certificates, r.certificates...)
+	}
+
+	if len(e.hashes) > 0 {
+		config.VerifyPeerCertificate = verifyCertificateHashes(e.hashes, config.VerifyPeerCertificate)
+	}
+
+	if pins, ok := r.pins[strings.ToLower(e.host)]; ok {
+		config.VerifyPeerCertificate = verifyPins(e.host, pins, config.VerifyPeerCertificate)
+	}
+
+	return config
+}
+
+var errCertificateHash = errors.New("tls: no certificate in the chain matches the expected hashes")
+
+// verifyCertificateHashes returns a function that checks that a certificate
+// presented by the server has a TBS certificate with one of the given SHA-256
+// hashes, in addition to any verification already configured.
+func verifyCertificateHashes(hashes [][]byte, next func([][]byte, [][]*x509.Certificate) error) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		if next != nil {
+			if err := next(rawCerts, chains); err != nil {
+				return err
+			}
+		}
+
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+
+			sum := sha256.Sum256(cert.RawTBSCertificate)
+			for _, hash := range hashes {
+				if bytes.Equal(sum[:], hash) {
+					return nil
+				}
+			}
+		}
+
+		return errCertificateHash
+	}
+}
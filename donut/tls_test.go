@@ -0,0 +1,166 @@
+package donut_test
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tomasbasham/donut"
+)
+
+// tlsServer is a DNS over TLS server that reads queries in batches and
+// answers each batch in reverse order.
+type tlsServer struct {
+	addr       string
+	cert       tls.Certificate
+	conns      atomic.Int32
+	serverName atomic.Value
+}
+
+func newTLSServer(t *testing.T, batch int) (*tlsServer, *tls.Config) {
+	t.Helper()
+
+	cert, pool := newTestCertificate(t)
+	s := &tlsServer{cert: cert}
+
+	config := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			s.serverName.Store(hello.ServerName)
+			return &cert, nil
+		},
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s.addr = l.Addr().String()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.conns.Add(1)
+			go s.serve(conn, batch)
+		}
+	}()
+
+	return s, &tls.Config{RootCAs: pool}
+}
+
+func (s *tlsServer) serve(conn net.Conn, batch int) {
+	defer conn.Close()
+
+	for {
+		queries := make([][]byte, 0, batch)
+		for len(queries) < batch {
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+			queries = append(queries, query)
+		}
+
+		for i := len(queries) - 1; i >= 0; i-- {
+			resp := answerA(queries[i], net.IPv4(192, 0, 2, 1), 300)
+			frame := binary.BigEndian.AppendUint16(nil, uint16(len(resp)))
+			if _, err := conn.Write(append(frame, resp...)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestResolver_LookupTLS(t *testing.T) {
+	tests := map[string]struct {
+		serverName string
+		expected   string
+	}{
+		"ip address": {
+			expected: "",
+		},
+		"authentication name": {
+			serverName: "dns.example",
+			expected:   "dns.example",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			s, config := newTLSServer(t, 1)
+
+			r := donut.New("tls://"+s.addr, donut.WithTLSConfig(config), donut.WithServerName(tt.serverName))
+			defer r.Close()
+
+			for i := 0; i < 3; i++ {
+				answer, err := r.Lookup(donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(answer) != 1 || answer[0].Name != "example.com." {
+					t.Fatalf("unexpected answer: %+v", answer)
+				}
+			}
+
+			if got := s.conns.Load(); got != 1 {
+				t.Errorf("expected 1 connection, got %d", got)
+			}
+			if got := s.serverName.Load(); got != tt.expected {
+				t.Errorf("expected server name %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestResolver_LookupTLSPipelined(t *testing.T) {
+	names := []string{"a.example", "b.example", "c.example", "d.example"}
+	s, config := newTLSServer(t, len(names))
+
+	r := donut.New("tls://"+s.addr, donut.WithTLSConfig(config))
+	defer r.Close()
+
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			answer, err := r.Lookup(donut.Question{FQDN: name, Type: donut.A, Class: donut.IN})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if len(answer) != 1 || answer[0].Name != name+"." {
+				t.Errorf("unexpected answer for %s: %+v", name, answer)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := s.conns.Load(); got != 1 {
+		t.Errorf("expected 1 connection, got %d", got)
+	}
+}
+
+func TestResolver_LookupTLSUntrusted(t *testing.T) {
+	s, _ := newTLSServer(t, 1)
+
+	r := donut.New("tls://" + s.addr)
+	defer r.Close()
+
+	_, err := r.Lookup(donut.Question{FQDN: "example.com", Type: donut.A, Class: donut.IN})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
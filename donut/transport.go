@@ -0,0 +1,152 @@
+package donut
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Transport exchanges a single wire format DNS query for its response. The
+// query is passed as it should appear on the wire and implementations must not
+// modify it.
+type Transport interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+var errShortMessage = errors.New("dns message too short")
+
+// headerLen is the length of the fixed DNS message header.
+const headerLen = 12
+
+// defaultPorts are the ports used for each scheme when none is given.
+var defaultPorts = map[string]string{
+	"udp":        "53",
+	"tcp":        "53",
+	"https":      "443",
+	"https+json": "443",
+	"odoh":       "443",
+	"tls":        "853",
+	"quic":       "853",
+}
+
+// endpoint describes how to reach a server.
+type endpoint struct {
+	scheme string
+
+	// host is the name of the server, used to authenticate it.
+	host string
+
+	// ip is the address to connect to in place of resolving host, if known.
+	ip string
+
+	port string
+	path string
+
+	// hashes are SHA-256 digests of the TBS certificate of certificates, one
+	// of which must be in the server's chain.
+	hashes [][]byte
+	// relay is set for the relay of an ODoH target, which is authenticated by
+	// its own host rather than by the name configured for the upstream.
+	relay bool
+}
+
+// addr returns the address to connect to.
+func (e endpoint) addr() string {
+	if e.ip != "" {
+		return net.JoinHostPort(e.ip, e.port)
+	}
+	return net.JoinHostPort(e.host, e.port)
+}
+
+// authority returns the host and, if it is not the default, the port to use in
+// a URL for the endpoint.
+func (e endpoint) authority() string {
+	if e.port == defaultPorts[e.scheme] {
+		if strings.Contains(e.host, ":") {
+			return "[" + e.host + "]"
+		}
+		return e.host
+	}
+	return net.JoinHostPort(e.host, e.port)
+}
+
+// parseServer parses a server given as a stamp or URL. A server without a
+// scheme is taken to be the hostname of a DNS over HTTPS server so that
+// existing callers passing GoogleHost or CloudflareHost continue to work.
+func parseServer(server string) (endpoint, error) {
+	if strings.HasPrefix(server, "sdns://") {
+		stamp, err := ParseStamp(server)
+		if err != nil {
+			return endpoint{}, err
+		}
+		return stamp.endpoint()
+	}
+
+	if !strings.Contains(server, "://") {
+		server = "https://" + server
+	}
+
+	u, err := url.Parse(server)
+	if err != nil {
+		return endpoint{}, fmt.Errorf("invalid server %q: %w", server, err)
+	}
+
+	if u.Hostname() == "" {
+		return endpoint{}, fmt.Errorf("invalid server %q: missing host", server)
+	}
+
+	port, ok := defaultPorts[u.Scheme]
+	if !ok {
+		return endpoint{}, fmt.Errorf("invalid server %q: unsupported scheme %q", server, u.Scheme)
+	}
+
+	if p := u.Port(); p != "" {
+		port = p
+	}
+
+	return endpoint{
+		scheme: u.Scheme,
+		host:   u.Hostname(),
+		port:   port,
+		path:   u.Path,
+	}, nil
+}
+
+// newTransport creates the transport for the given server.
+func (r *Resolver) newTransport(server string) (Transport, error) {
+	e, err := parseServer(server)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.scheme {
+	case "udp":
+		return newUDPTransport(e, r.dialContext), nil
+	case "tcp":
+		return newTCPTransport(e, r.dialContext), nil
+	case "https":
+		return r.newHTTPSTransport(e)
+	case "https+json":
+		return r.newJSONTransport(e)
+	case "odoh":
+		return r.newODoHTransport(e)
+	case "tls":
+		return r.newTLSTransport(e), nil
+	case "quic":
+		return r.newQUICTransport(e), nil
+	default:
+		return nil, fmt.Errorf("invalid server %q: unsupported scheme %q", server, e.scheme)
+	}
+}
+
+// closeTransport closes t if it holds resources that need releasing.
+func closeTransport(t Transport) error {
+	if c, ok := t.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}